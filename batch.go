@@ -0,0 +1,137 @@
+package runamqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// BatchMessage is a message published with PublishBatch
+type BatchMessage struct {
+	Body    []byte
+	Options *PublishOptions
+	// Delay publishes the message like PublishAfter. Optional
+	Delay time.Duration
+}
+
+// BatchResult is the outcome of publishing a message of a batch, Err is nil when it was published and confirmed by the broker
+type BatchResult struct {
+	Message BatchMessage
+	Err     error
+}
+
+// BatchResults are the outcomes of publishing a batch, in the order of its messages
+type BatchResults []BatchResult
+
+// Failed returns the messages which were not published, so they can be tried again
+func (r BatchResults) Failed() []BatchMessage {
+	var failed []BatchMessage
+	for _, result := range r {
+		if result.Err != nil {
+			failed = append(failed, result.Message)
+		}
+	}
+	return failed
+}
+
+// Err returns the errors of the messages which were not published joined together, or nil when they all were
+func (r BatchResults) Err() error {
+	var errs []error
+	for i, result := range r {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("message %d: %w", i, result.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type preparedMessage struct {
+	index        int
+	exchangeName string
+	pattern      string
+	publishing   amqp.Publishing
+}
+
+// PublishBatch publishes messages one after the other on a single confirm channel without waiting for each to be confirmed, then waits for the broker to confirm all of them, whether the publisher is confirmable or not. It returns the result of every message, so the ones which failed can be published again. An error is returned when nothing could be published.
+//
+// Unlike Publish the bodies are not logged. With an Outbox the messages which are not published are stored to be published later, so only the invalid ones fail.
+func (p *Publisher) PublishBatch(ctx context.Context, messages []BatchMessage) (BatchResults, error) {
+	if p.outbox != nil {
+		return p.publishBatchThroughOutbox(ctx, messages)
+	}
+	return p.publishBatch(ctx, messages)
+}
+
+func (p *Publisher) publishBatch(ctx context.Context, messages []BatchMessage) (BatchResults, error) {
+	if !p.publishReady.Load() {
+		return nil, errors.New("unable to publish the batch, not ready to publish, try later")
+	}
+
+	results := make(BatchResults, len(messages))
+	prepared := make([]preparedMessage, 0, len(messages))
+
+	// messages are prepared before borrowing the channel, as delay queues are declared on a channel of the pool
+	for i, message := range messages {
+		results[i].Message = message
+
+		exchangeName, pattern, publishing, err := p.prepare(message.Body, message.Options, message.Delay)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		prepared = append(prepared, preparedMessage{index: i, exchangeName: exchangeName, pattern: pattern, publishing: publishing})
+	}
+
+	ch, err := p.batchChannels.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish the batch with error: %s", err.Error())
+	}
+	defer p.batchChannels.Put(ch)
+
+	confirmations := make([]*amqp.DeferredConfirmation, len(prepared))
+
+	for n, message := range prepared {
+		confirmations[n], err = ch.PublishWithDeferredConfirmWithContext(ctx, message.exchangeName, message.pattern, true, false, message.publishing)
+
+		if err != nil {
+			// the channel is closed or ctx is done, so none of the rest can be published either
+			for _, rest := range prepared[n:] {
+				results[rest.index].Err = fmt.Errorf("failed to publish message with error: %w", err)
+			}
+			prepared, confirmations = prepared[:n], confirmations[:n]
+			break
+		}
+	}
+
+	for n, confirmation := range confirmations {
+		if confirmation == nil {
+			results[prepared[n].index].Err = errors.New("the message can not be confirmed, as it was not published on a confirm channel")
+			continue
+		}
+
+		acked, err := confirmation.WaitContext(ctx)
+		switch {
+		case err != nil:
+			results[prepared[n].index].Err = fmt.Errorf("stopped waiting for the broker to confirm the message: %w", err)
+		case !acked:
+			results[prepared[n].index].Err = fmt.Errorf(`the message published to exchange "%s" was not confirmed by the broker`, prepared[n].exchangeName)
+		}
+	}
+
+	failed := len(results.Failed())
+	p.config.Logger.Debug(fmt.Sprintf(`Published a batch of %d messages to exchange "%s", %d of them failed`, len(messages), p.config.exchange.Name, failed))
+
+	return results, results.allFailed()
+}
+
+// allFailed returns the errors of the messages when not one of them was published
+func (r BatchResults) allFailed() error {
+	if len(r) == 0 || len(r.Failed()) < len(r) {
+		return nil
+	}
+	return r.Err()
+}
@@ -0,0 +1,111 @@
+package runamqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBatchResultsFailed(t *testing.T) {
+	results := BatchResults{
+		{Message: BatchMessage{Body: []byte("published")}},
+		{Message: BatchMessage{Body: []byte("failed")}, Err: errors.New("not confirmed")},
+	}
+
+	failed := results.Failed()
+
+	if len(failed) != 1 || string(failed[0].Body) != "failed" {
+		t.Error("expected only the failed message but got", failed)
+	}
+
+	if err := results.Err(); err == nil || err.Error() != "message 1: not confirmed" {
+		t.Error("expected the error of the failed message but got", err)
+	}
+
+	if err := results[:1].Err(); err != nil {
+		t.Error("did not expect an error when every message was published", err)
+	}
+}
+
+func TestPublishBatchWhenNotReady(t *testing.T) {
+	publisher := new(Publisher)
+
+	if _, err := publisher.PublishBatch(context.Background(), []BatchMessage{{Body: payload}}); err == nil {
+		t.Error("expected an error when the publisher is not ready")
+	}
+}
+
+func TestPublishBatchConfirmsEveryMessage(t *testing.T) {
+	t.Parallel()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+
+	consumer := NewConsumer(consumerConfig)
+	assertReady(t, consumer.QueuesBound)
+	defer consumer.Close()
+
+	publisherConfig := consumerConfig.NewPublisherConfig()
+	publisherConfig.confirmable = true
+
+	publisher, err := NewPublisher(publisherConfig)
+	assertNoError(t, err)
+	defer publisher.Close()
+
+	var batch []BatchMessage
+	for i := 0; i < 100; i++ {
+		batch = append(batch, BatchMessage{Body: []byte(fmt.Sprint(i))})
+	}
+	batch = append(batch, BatchMessage{Body: payload, Delay: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	results, err := publisher.PublishBatch(ctx, batch)
+	assertNoError(t, err)
+
+	if failed := results.Failed(); len(failed) != 1 || string(failed[0].Body) != string(payload) {
+		t.Error("expected only the delayed message to fail without a delay mode", results.Err())
+	}
+
+	for i := 0; i < 100; i++ {
+		message := getMessage(t, consumer.Messages)
+		if string(message.Body()) != fmt.Sprint(i) {
+			t.Fatal("expected message", i, "but got", string(message.Body()))
+		}
+		assertNoError(t, message.Ack())
+	}
+}
+
+func TestPublishBatchIsConfirmedWhenThePublisherIsNotConfirmable(t *testing.T) {
+	t.Parallel()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+
+	consumer := NewConsumer(consumerConfig)
+	assertReady(t, consumer.QueuesBound)
+	defer consumer.Close()
+
+	publisherConfig := consumerConfig.NewPublisherConfig()
+	publisherConfig.confirmable = false
+
+	publisher, err := NewPublisher(publisherConfig)
+	assertNoError(t, err)
+	defer publisher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	results, err := publisher.PublishBatch(ctx, []BatchMessage{{Body: []byte("first")}, {Body: []byte("second")}})
+	assertNoError(t, err)
+	assertNoError(t, results.Err())
+
+	for _, expected := range []string{"first", "second"} {
+		message := getMessage(t, consumer.Messages)
+		if string(message.Body()) != expected {
+			t.Error("expected", expected, "but got", string(message.Body()))
+		}
+		assertNoError(t, message.Ack())
+	}
+}
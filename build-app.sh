@@ -5,4 +5,4 @@ set -o nounset
 set -o pipefail
 
 go fmt $(go list ./... | grep -v /vendor/)
-go test $(go list ./... | grep -v acceptance-tests ) --cover -timeout 25s
\ No newline at end of file
+CGO_ENABLED=1 go test $(go list ./... | grep -v acceptance-tests ) -race --cover -timeout 60s
\ No newline at end of file
@@ -0,0 +1,179 @@
+package runamqp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mergermarket/run-amqp/connection"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ClientConfig is used to create a Client which shares its connections between consumers and publishers
+type ClientConfig struct {
+	connectionConfig
+	separatePublishConnection bool
+}
+
+// NewClientConfig config for establishing a Client
+type NewClientConfig struct {
+	URL    string
+	Logger logger
+	// SeparatePublishConnection will open a second connection which is only used by publishers, as recommended by RabbitMQ, so flow control on publishing does not slow down consuming. Optional
+	SeparatePublishConnection bool
+	// ServiceName is sent as a client property and used for the default connection name. Optional
+	ServiceName string
+	// ConnectionName is shown for the connection in the management UI, defaults to the service name and the hostname. Optional
+	ConnectionName string
+	// Version of the service, sent as a client property. Optional
+	Version string
+	// ClientProperties are sent when connecting, in addition to the ones above. Optional
+	ClientProperties map[string]interface{}
+	// Credentials replace the username and password of the URL every time it connects, so rotated credentials are picked up. Optional
+	Credentials connection.CredentialsProvider
+}
+
+// Config returns a ClientConfig to create a Client with
+func (p *NewClientConfig) Config() ClientConfig {
+	return ClientConfig{
+		connectionConfig: connectionConfig{
+			URL:         p.URL,
+			Logger:      orDefaultLogger(p.Logger),
+			Properties:  newClientProperties(p.ConnectionName, p.ServiceName, p.Version, p.ClientProperties),
+			Credentials: p.Credentials,
+		},
+		separatePublishConnection: p.SeparatePublishConnection,
+	}
+}
+
+// Client owns the managed connections to rabbit and hands out consumers and publishers, each of which open their own channels on those connections. Create it once in your application and use it instead of NewConsumer and NewPublisher when you need more than one of them.
+type Client struct {
+	config            ClientConfig
+	consumeConnection connection.ConnectionManager
+	publishConnection connection.ConnectionManager
+}
+
+// NewClient returns a Client with a managed connection to rabbit, plus a separate one for publishing if configured
+func NewClient(config ClientConfig) *Client {
+	c := &Client{
+		config:            config,
+		consumeConnection: config.newConnectionManager(),
+	}
+
+	c.publishConnection = c.consumeConnection
+	if config.separatePublishConnection {
+		publishConfig := config.connectionConfig
+		publishConfig.Properties = withConnectionNameSuffix(config.Properties, "publish")
+		c.publishConnection = publishConfig.newConnectionManager()
+	}
+
+	return c
+}
+
+// NewConsumer returns a Consumer which consumes on channels of the client's connection. The URL of the config is ignored.
+func (c *Client) NewConsumer(config ConsumerConfig) *Consumer {
+	c.warnIfURLIgnored(config.connectionConfig)
+	return newConsumer(config, c.consumeConnection, false)
+}
+
+// NewConsumerContext is like the package level NewConsumerContext, but consumes on channels of the client's connection. The URL of the config is ignored.
+func (c *Client) NewConsumerContext(ctx context.Context, config ConsumerConfig) (*Consumer, error) {
+	c.warnIfURLIgnored(config.connectionConfig)
+	return newConsumerContext(ctx, config, c.consumeConnection, false)
+}
+
+// NewShardedConsumerContext is like the package level NewShardedConsumerContext, but consumes the partitions on channels of the client's connection. The URL of the config is ignored.
+func (c *Client) NewShardedConsumerContext(ctx context.Context, config ConsumerConfig) (*ShardedConsumer, error) {
+	c.warnIfURLIgnored(config.connectionConfig)
+	if err := config.validatePartitions(); err != nil {
+		return nil, err
+	}
+	return newShardedConsumerContext(ctx, config, c.consumeConnection, false)
+}
+
+// NewStreamConsumerContext is like the package level NewStreamConsumerContext, but reads the stream on a channel of the client's connection. The URL of the config is ignored.
+func (c *Client) NewStreamConsumerContext(ctx context.Context, config StreamConsumerConfig) (*StreamConsumer, error) {
+	c.warnIfURLIgnored(config.connectionConfig)
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return newStreamConsumerContext(ctx, config, c.consumeConnection, false)
+}
+
+// NewPublisher returns a Publisher which publishes on a channel of the client's publishing connection. The URL of the config is ignored.
+func (c *Client) NewPublisher(config PublisherConfig) (*Publisher, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSetUpTimeout)
+	defer cancel()
+	return c.NewPublisherContext(ctx, config)
+}
+
+// NewPublisherContext is like the package level NewPublisherContext, but publishes on channels of the client's publishing connection. The URL of the config is ignored.
+func (c *Client) NewPublisherContext(ctx context.Context, config PublisherConfig) (*Publisher, error) {
+	c.warnIfURLIgnored(config.connectionConfig)
+	return newPublisherContext(ctx, config, c.publishConnection, false)
+}
+
+// DiffTopology compares topology with the broker once the client is connected, see Topology.Diff
+func (c *Client) DiffTopology(ctx context.Context, topology Topology) ([]TopologyDifference, error) {
+	pool, err := c.topologyChannels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Close()
+
+	return topology.diff(pool.Get, pool.Put)
+}
+
+// ApplyTopology declares topology once the client is connected, see Topology.Apply
+func (c *Client) ApplyTopology(ctx context.Context, topology Topology) error {
+	pool, err := c.topologyChannels(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	ch, err := pool.Get()
+	if err != nil {
+		return newSetupError(StepChannel, "", err)
+	}
+	defer pool.Put(ch)
+
+	return topology.Apply(ch)
+}
+
+// topologyChannels waits for the client to be connected and returns a pool of channels to declare the topology with
+func (c *Client) topologyChannels(ctx context.Context) (connection.ChannelPool, error) {
+	for c.consumeConnection.ConnectionError() != nil {
+		select {
+		case <-ctx.Done():
+			return nil, new(setUpProgress).timedOut(c.consumeConnection, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	return c.consumeConnection.NewChannelPool("topology", 1, nil), nil
+}
+
+// Close closes the client's connections, and with them the channels of all the consumers and publishers it made
+func (c *Client) Close() {
+	c.consumeConnection.Close()
+	c.publishConnection.Close()
+}
+
+// withConnectionNameSuffix returns a copy of properties where the connection name has suffix, to tell apart the connections of a client
+func withConnectionNameSuffix(properties amqp.Table, suffix string) amqp.Table {
+	table := amqp.Table{}
+	for key, value := range properties {
+		table[key] = value
+	}
+	if name, ok := table["connection_name"].(string); ok {
+		table.SetClientConnectionName(fmt.Sprintf("%s (%s)", name, suffix))
+	}
+	return table
+}
+
+func (c *Client) warnIfURLIgnored(config connectionConfig) {
+	if config.URL != "" && config.URL != c.config.URL {
+		c.config.Logger.Info("The URL of the config is different to the client's, the client's connection will be used")
+	}
+}
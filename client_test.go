@@ -0,0 +1,77 @@
+package runamqp
+
+import (
+	"testing"
+
+	"github.com/mergermarket/run-amqp/helpers"
+)
+
+func newTestClient(t *testing.T, separatePublishConnection bool) *Client {
+	c := NewClientConfig{
+		URL:                       testRabbitURI,
+		Logger:                    helpers.NewTestLogger(t),
+		SeparatePublishConnection: separatePublishConnection,
+	}
+	return NewClient(c.Config())
+}
+
+func TestClientConsumersAndPublisherShareAConnection(t *testing.T) {
+	t.Parallel()
+
+	client := newTestClient(t, false)
+
+	if client.consumeConnection != client.publishConnection {
+		t.Fatal("expected the consumers and publishers to share the same connection")
+	}
+
+	consumer1Config := newTestConsumerConfig(t, consumerConfigOptions{})
+	consumer2Config := newTestConsumerConfig(t, consumerConfigOptions{
+		ExchangeName: consumer1Config.exchange.Name,
+		ServiceName:  consumer1Config.queue.Name + "-second",
+	})
+
+	consumer1 := client.NewConsumer(consumer1Config)
+	assertReady(t, consumer1.QueuesBound)
+
+	consumer2 := client.NewConsumer(consumer2Config)
+	assertReady(t, consumer2.QueuesBound)
+
+	publisher, err := client.NewPublisher(consumer1Config.NewPublisherConfig())
+	assertNoError(t, err)
+
+	assertNoError(t, publisher.Publish(payload, nil))
+
+	for _, consumer := range []*Consumer{consumer1, consumer2} {
+		message := getMessage(t, consumer.Messages)
+		if string(message.Body()) != string(payload) {
+			t.Fatal("failed to get the published message")
+		}
+		assertNoError(t, message.Ack())
+	}
+}
+
+func TestClientWithSeparatePublishConnection(t *testing.T) {
+	t.Parallel()
+
+	client := newTestClient(t, true)
+
+	if client.consumeConnection == client.publishConnection {
+		t.Fatal("expected publishers to have their own connection")
+	}
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+
+	consumer := client.NewConsumer(consumerConfig)
+	assertReady(t, consumer.QueuesBound)
+
+	publisher, err := client.NewPublisher(consumerConfig.NewPublisherConfig())
+	assertNoError(t, err)
+
+	assertNoError(t, publisher.Publish(payload, nil))
+
+	message := getMessage(t, consumer.Messages)
+	if string(message.Body()) != string(payload) {
+		t.Fatal("failed to get the published message")
+	}
+	assertNoError(t, message.Ack())
+}
@@ -2,6 +2,11 @@ package runamqp
 
 import (
 	"fmt"
+	"os"
+	"time"
+
+	"github.com/mergermarket/run-amqp/connection"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type logger interface {
@@ -11,16 +16,66 @@ type logger interface {
 }
 
 type connectionConfig struct {
-	URL    string
-	Logger logger
+	URL         string
+	Logger      logger
+	Properties  amqp.Table
+	Credentials connection.CredentialsProvider
+}
+
+func (c connectionConfig) newConnectionManager() connection.ConnectionManager {
+	return connection.NewConnectionManagerWithOptions(c.URL, c.Logger, connection.Options{
+		Properties:  c.Properties,
+		Credentials: c.Credentials,
+	})
+}
+
+// newClientProperties returns the client properties sent when connecting, so the connection can be recognised in the management UI. The connection name defaults to the service name and the hostname.
+func newClientProperties(connectionName, serviceName, version string, properties map[string]interface{}) amqp.Table {
+	table := amqp.NewConnectionProperties()
+
+	for key, value := range properties {
+		table[key] = value
+	}
+
+	if serviceName != "" {
+		table["service_name"] = serviceName
+	}
+
+	if version != "" {
+		table["service_version"] = version
+	}
+
+	if connectionName == "" {
+		connectionName = defaultConnectionName(serviceName)
+	}
+
+	if connectionName != "" {
+		table.SetClientConnectionName(connectionName)
+	}
+
+	return table
+}
+
+func defaultConnectionName(serviceName string) string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return serviceName
+	}
+	if serviceName == "" {
+		return hostname
+	}
+	return fmt.Sprintf("%s@%s", serviceName, hostname)
 }
 
 type exchange struct {
-	DLE        string
-	Name       string
-	RetryNow   string
-	RetryLater string
-	Type       ExchangeType
+	DLE               string
+	Name              string
+	RetryNow          string
+	RetryLater        string
+	Type              ExchangeType
+	Arguments         amqp.Table
+	AlternateExchange string
+	Bindings          []ExchangeBinding
 }
 
 func (e exchange) String() string {
@@ -28,35 +83,98 @@ func (e exchange) String() string {
 }
 
 type queue struct {
-	DLQ           string
-	MaxPriority   uint8
-	Name          string
-	Patterns      []string
-	PrefetchCount int
-	RetryLater    string
-	RequeueTTL    int16
-	RetryLimit    int
+	DLQ                string
+	MaxPriority        uint8
+	Name               string
+	Patterns           []string
+	HeaderBindings     []HeaderBinding
+	PrefetchCount      int
+	RetryLater         string
+	RequeueTTL         int16
+	RetryLimit         int
+	Type               QueueType
+	DeliveryLimit      int
+	DeadLetterStrategy DeadLetterStrategy
+	MainLimits         QueueLimits
+	DLQLimits          QueueLimits
+	RetryQueueLimits   QueueLimits
+	SingleActive       bool
+	Exclusive          bool
+	RetryTTLPerMessage bool
+	Ephemeral          bool
+	DeadLetterExpired  bool
 }
 
 // PublisherConfig is used to create a connectionConfig to an exchange for publishing messages to
 type PublisherConfig struct {
 	connectionConfig
-	exchange    exchange
-	confirmable bool
+	exchange           exchange
+	confirmable        bool
+	channelPoolSize    int
+	topologyMode       TopologyMode
+	delay              DelayMode
+	outbox             OutboxStore
+	outboxSize         int
+	outboxFlushTimeout time.Duration
 }
 
 // ConsumerConfig is used to create a connectionConfig to an exchange with a corresponding queue to listen to messages on
 type ConsumerConfig struct {
 	connectionConfig
-	exchange exchange
-	queue    queue
+	exchange     exchange
+	queue        queue
+	partitions   partitions
+	topologyMode TopologyMode
+	naming       consumerNaming
+}
+
+// consumerNaming is what the names of a consumer were made from, so the partitions of a sharded consumer are named the same way
+type consumerNaming struct {
+	strategy NamingStrategy
+	exchange string
+	service  string
+}
+
+type partitions struct {
+	Count   int
+	Claimed []int
 }
 type NewPublisherConfig struct {
 	URL          string
 	ExchangeName string
 	ExchangeType ExchangeType
 	Confirmable  bool
-	Logger       logger
+	Logger       logger `json:"-"`
+	// ChannelPoolSize is how many channels the publisher may publish on at the same time, defaults to 1. Optional
+	ChannelPoolSize int
+	// ServiceName is sent as a client property and used for the default connection name. Optional
+	ServiceName string
+	// ConnectionName is shown for the connection in the management UI, defaults to the service name and the hostname. Optional
+	ConnectionName string
+	// Version of the service, sent as a client property. Optional
+	Version string
+	// ClientProperties are sent when connecting, in addition to the ones above. Optional
+	ClientProperties map[string]interface{}
+	// Credentials replace the username and password of the URL every time it connects, so rotated credentials are picked up. Optional
+	Credentials connection.CredentialsProvider `json:"-"`
+	// ExchangeArguments are declared with the exchange, such as the hash-header of a ConsistentHash exchange. They have to be the same wherever the exchange is declared. Optional
+	ExchangeArguments map[string]interface{}
+	// AlternateExchange receives the messages the exchange can not route, instead of them being returned. It is declared as a fanout exchange with a queue of the same name, and has to be the same wherever the exchange is declared. Optional
+	AlternateExchange string
+	// ExchangeBindings bind the exchange to other exchanges, so it also gets their messages. Optional
+	ExchangeBindings []ExchangeBinding
+	// TopologyMode is whether the exchange is declared, only verified to exist, or left alone. Defaults to DeclareTopology. Optional
+	TopologyMode TopologyMode
+	// Naming names the exchange, it has to be the same as the consumers'. Defaults to DefaultNaming. Optional
+	Naming NamingStrategy `json:"-"`
+	// DelayMode is how messages published with PublishAfter and PublishAt are delayed, they can not be delayed without it. Optional
+	DelayMode DelayMode
+	// Outbox stores the messages which can not be published while rabbit is unreachable, so they are published once it is back instead of Publish returning an error. NewPublisher returns without waiting for rabbit, and the publisher is confirmable. Optional
+	Outbox OutboxStore `json:"-"`
+	// OutboxSize is the most messages the Outbox holds, Publish returns ErrOutboxFull beyond it. Defaults to 10000. Optional
+	OutboxSize int
+	// OutboxFlushTimeout is how long Close waits for the Outbox to be published. Defaults to 5 seconds. Optional
+	OutboxFlushTimeout time.Duration
 }
 
 // NewPublisherConfig returns a PublisherConfig derived from the consumer config. This config can be used to create a Publisher to Publish to this consumer
@@ -68,21 +186,40 @@ func (c ConsumerConfig) NewPublisherConfig() PublisherConfig {
 		Confirmable:  false,
 		Logger:       c.Logger,
 	}
-	return nc.Config()
+	config := nc.Config()
+	config.Properties = c.Properties
+	config.Credentials = c.Credentials
+	config.exchange.Arguments = c.exchange.Arguments
+	config.exchange.AlternateExchange = c.exchange.AlternateExchange
+	config.exchange.Bindings = c.exchange.Bindings
+	config.topologyMode = c.topologyMode
+	return config
 }
 
 // NewPublisherConfig config for establishing a RabbitMq Publisher
 func (p *NewPublisherConfig) Config() PublisherConfig {
+	p.Logger = orDefaultLogger(p.Logger)
 
 	return PublisherConfig{
-		confirmable: p.Confirmable,
+		confirmable:        p.Confirmable || p.Outbox != nil,
+		channelPoolSize:    p.ChannelPoolSize,
+		topologyMode:       p.TopologyMode,
+		delay:              p.DelayMode,
+		outbox:             p.Outbox,
+		outboxSize:         p.OutboxSize,
+		outboxFlushTimeout: p.OutboxFlushTimeout,
 		connectionConfig: connectionConfig{
-			URL:    p.URL,
-			Logger: p.Logger,
+			URL:         p.URL,
+			Logger:      p.Logger,
+			Properties:  newClientProperties(p.ConnectionName, p.ServiceName, p.Version, p.ClientProperties),
+			Credentials: p.Credentials,
 		},
 		exchange: exchange{
-			Name: p.ExchangeName,
-			Type: p.ExchangeType,
+			Name:              orDefaultNaming(p.Naming).ExchangeName(p.ExchangeName),
+			Type:              p.ExchangeType,
+			Arguments:         amqp.Table(p.ExchangeArguments),
+			AlternateExchange: p.AlternateExchange,
+			Bindings:          p.ExchangeBindings,
 		},
 	}
 }
@@ -92,45 +229,238 @@ type NewConsumerConfig struct {
 	ExchangeName string
 	ExchangeType ExchangeType
 	Patterns     []string
-	Logger       logger
+	Logger       logger `json:"-"`
 	RequeueTTL   int16
 	RequeueLimit int
 	ServiceName  string
 	Prefetch     int
 	MaxPriority  uint8 // Optional
+	// ConnectionName is shown for the connection in the management UI, defaults to the service name and the hostname. Optional
+	ConnectionName string
+	// Version of the service, sent as a client property along with the service name. Optional
+	Version string
+	// ClientProperties are sent when connecting, in addition to the ones above. Optional
+	ClientProperties map[string]interface{}
+	// Credentials replace the username and password of the URL every time it connects, so rotated credentials are picked up. Optional
+	Credentials connection.CredentialsProvider `json:"-"`
+	// QueueType of the main queue, DLQ and retry queue, defaults to Classic. Messages requeued from a quorum queue are returned to it and retried as counted by its delivery count, so they are not delayed by the RequeueTTL. Optional
+	QueueType QueueType
+	// DeliveryLimit is how many times a quorum queue redelivers a message before dead-lettering it to the DLE. Requeued messages are counted too, so it should be above RequeueLimit for messages to reach the DLE with the reason they were nacked. Optional
+	DeliveryLimit int
+	// DeadLetterStrategy is how quorum queues dead-letter messages. Optional
+	DeadLetterStrategy DeadLetterStrategy
+	// QueueLimits bound the main queue. Optional
+	QueueLimits QueueLimits
+	// DLQLimits bound the DLQ, which otherwise grows with every message that fails. Optional
+	DLQLimits QueueLimits
+	// RetryQueueLimits bound the retry queue. Optional
+	RetryQueueLimits QueueLimits
+	// SingleActiveConsumer declares the main queue so rabbit delivers to only one of its consumers at a time, the others take over in turn when it goes away. Optional
+	SingleActiveConsumer bool
+	// ExclusiveConsumer consumes the main queue exclusively, the other consumers stand by and keep trying to take over. Optional
+	ExclusiveConsumer bool
+	// HeaderBindings bind the main queue to a Headers exchange, which ignores the Patterns. Without any the queue gets every message. Optional
+	HeaderBindings []HeaderBinding
+	// ExchangeArguments are declared with the exchange, such as the hash-header of a ConsistentHash exchange. They have to be the same wherever the exchange is declared. Optional
+	ExchangeArguments map[string]interface{}
+	// Partitions shards the consumer over this many queues, which are bound to a ConsistentHash exchange so the messages with the same routing key always go to the same partition. Use NewShardedConsumer for it. Optional
+	Partitions int
+	// ClaimedPartitions are the partitions this instance consumes, it defaults to all of them. Each partition has a single active consumer, so only one instance processes it at a time and the others take over when it goes away. Optional
+	ClaimedPartitions []int
+	// AlternateExchange receives the messages the exchange can not route. It is declared as a fanout exchange with a queue of the same name, and has to be the same wherever the exchange is declared. Optional
+	AlternateExchange string
+	// ExchangeBindings bind the exchange to other exchanges, so the queue also gets their messages. Optional
+	ExchangeBindings []ExchangeBinding
+	// TopologyMode is whether the exchanges and queues are declared, only verified to exist, or left alone. Defaults to DeclareTopology. Optional
+	TopologyMode TopologyMode
+	// Naming names the exchange and the queues and exchanges made for the consumer. Use Client.MigrateConsumer when changing it. Defaults to DefaultNaming. Optional
+	Naming NamingStrategy `json:"-"`
+	// Ephemeral gives every instance a queue of its own, so each gets every message, such as for invalidating caches. The queue is named by rabbit and deleted when the consumer goes away. There is no DLQ or retry queue, nacked messages are dropped and requeued ones are delivered again straight away. Messages published while it reconnects are missed. Optional
+	Ephemeral bool
+	// DeadLetterExpired dead-letters the messages which expire in the main queue to the DLE, rather than dropping them. Rabbit records why in their x-first-death-reason header, which is "expired". Optional
+	DeadLetterExpired bool
 }
 
 // NewConsumerConfig config for establishing a RabbitMq consumer
 func (p *NewConsumerConfig) Config() ConsumerConfig {
 
+	p.Logger = orDefaultLogger(p.Logger)
+
 	if len(p.Patterns) == 0 {
 		p.Logger.Info("Executive decision made! You did not supply a pattern so we have added a default of '#'")
 		p.Patterns = append(p.Patterns, "#") //testme
 	}
 
-	queueName := fmt.Sprintf("%s-for-%s", p.ExchangeName, p.ServiceName)
+	naming := orDefaultNaming(p.Naming)
+	names := naming.ConsumerNames(p.ExchangeName, p.ServiceName, p.RequeueTTL)
 
 	return ConsumerConfig{
 		connectionConfig: connectionConfig{
-			URL:    p.URL,
-			Logger: p.Logger,
+			URL:         p.URL,
+			Logger:      p.Logger,
+			Properties:  newClientProperties(p.ConnectionName, p.ServiceName, p.Version, p.ClientProperties),
+			Credentials: p.Credentials,
 		},
 		exchange: exchange{
-			Name:       p.ExchangeName,
-			RetryNow:   fmt.Sprintf("%s-for-%s-retry-now", p.ExchangeName, p.ServiceName),
-			RetryLater: fmt.Sprintf("%s-for-%s-retry-%dms-later", p.ExchangeName, p.ServiceName, p.RequeueTTL),
-			DLE:        fmt.Sprintf("%s-for-%s-dle", p.ExchangeName, p.ServiceName),
-			Type:       p.ExchangeType,
+			Name:              naming.ExchangeName(p.ExchangeName),
+			RetryNow:          names.RetryNowExchange,
+			RetryLater:        names.RetryLaterExchange,
+			DLE:               names.DeadLetterExchange,
+			Type:              p.ExchangeType,
+			Arguments:         amqp.Table(p.ExchangeArguments),
+			AlternateExchange: p.AlternateExchange,
+			Bindings:          p.ExchangeBindings,
 		},
 		queue: queue{
-			Name:          queueName,
-			DLQ:           queueName + "-dlq",
-			RetryLater:    fmt.Sprintf("%s-retry-%dms-later", queueName, p.RequeueTTL),
-			RequeueTTL:    p.RequeueTTL,
-			RetryLimit:    p.RequeueLimit,
-			Patterns:      p.Patterns,
-			MaxPriority:   p.MaxPriority,
-			PrefetchCount: p.Prefetch,
+			Name:               names.Queue,
+			DLQ:                names.DeadLetterQueue,
+			RetryLater:         names.RetryLaterQueue,
+			RequeueTTL:         p.RequeueTTL,
+			RetryLimit:         p.RequeueLimit,
+			Patterns:           p.Patterns,
+			HeaderBindings:     p.HeaderBindings,
+			MaxPriority:        p.MaxPriority,
+			PrefetchCount:      p.Prefetch,
+			Type:               p.QueueType,
+			DeliveryLimit:      p.DeliveryLimit,
+			DeadLetterStrategy: p.DeadLetterStrategy,
+			MainLimits:         p.QueueLimits,
+			DLQLimits:          p.DLQLimits,
+			RetryQueueLimits:   p.RetryQueueLimits,
+			SingleActive:       p.SingleActiveConsumer,
+			Exclusive:          p.ExclusiveConsumer,
+			RetryTTLPerMessage: retryTTLPerMessage(naming, p.ExchangeName, p.ServiceName),
+			Ephemeral:          p.Ephemeral,
+			DeadLetterExpired:  p.DeadLetterExpired,
+		},
+		partitions: partitions{
+			Count:   p.Partitions,
+			Claimed: p.ClaimedPartitions,
+		},
+		topologyMode: p.TopologyMode,
+		naming:       consumerNaming{strategy: naming, exchange: p.ExchangeName, service: p.ServiceName},
+	}
+}
+
+type stream struct {
+	Name                string
+	Consumer            string
+	Patterns            []string
+	PrefetchCount       int
+	Offset              StreamOffset
+	OffsetStore         OffsetStore
+	CommitEvery         int
+	CommitInterval      time.Duration
+	MaxLengthBytes      int64
+	MaxAge              string
+	MaxSegmentSizeBytes int64
+}
+
+// StreamConsumerConfig is used to create a StreamConsumer reading a stream bound to an exchange
+type StreamConsumerConfig struct {
+	connectionConfig
+	exchange     exchange
+	stream       stream
+	topologyMode TopologyMode
+}
+
+// NewPublisherConfig returns a PublisherConfig for publishing to the exchange the stream is bound to
+func (c StreamConsumerConfig) NewPublisherConfig() PublisherConfig {
+	nc := NewPublisherConfig{
+		URL:          c.URL,
+		ExchangeName: c.exchange.Name,
+		ExchangeType: c.exchange.Type,
+		Logger:       c.Logger,
+	}
+	config := nc.Config()
+	config.Properties = c.Properties
+	config.Credentials = c.Credentials
+	return config
+}
+
+// NewStreamConsumerConfig config for establishing a RabbitMq stream consumer
+type NewStreamConsumerConfig struct {
+	URL          string
+	ExchangeName string
+	ExchangeType ExchangeType
+	Patterns     []string
+	Logger       logger
+	ServiceName  string
+	// Prefetch is how many messages are delivered before they have to be acknowledged, rabbit requires it for streams
+	Prefetch int
+	// StreamName defaults to the exchange name followed by -stream, so services reading the same exchange share the stream. Optional
+	StreamName string
+	// Offset to start from when there is no stored offset, defaults to OffsetNext. Optional
+	Offset StreamOffset
+	// OffsetStore keeps the last processed offset, so the consumer resumes after it when it is restarted. Optional
+	OffsetStore OffsetStore
+	// OffsetCommitEvery is how many acknowledged messages the last processed offset is stored after, defaults to 100. Optional
+	OffsetCommitEvery int
+	// OffsetCommitInterval is how often the last processed offset is stored when fewer messages were acknowledged, defaults to 5 seconds. Messages processed since the last commit are read again after a crash. Optional
+	OffsetCommitInterval time.Duration
+	// MaxLengthBytes is how big the stream may grow before its oldest segments are discarded. Optional
+	MaxLengthBytes int64
+	// MaxAge is how long messages are retained in the stream, such as 7D or 12h. Optional
+	MaxAge string
+	// MaxSegmentSizeBytes is the size of the files the stream is stored in. Optional
+	MaxSegmentSizeBytes int64
+	// TopologyMode is whether the exchange and stream are declared, only verified to exist, or left alone. Defaults to DeclareTopology. Optional
+	TopologyMode TopologyMode
+	// ConnectionName is shown for the connection in the management UI, defaults to the service name and the hostname. Optional
+	ConnectionName string
+	// Version of the service, sent as a client property along with the service name. Optional
+	Version string
+	// ClientProperties are sent when connecting, in addition to the ones above. Optional
+	ClientProperties map[string]interface{}
+	// Credentials replace the username and password of the URL every time it connects, so rotated credentials are picked up. Optional
+	Credentials connection.CredentialsProvider
+}
+
+// Config returns a StreamConsumerConfig to create a StreamConsumer with
+func (p *NewStreamConsumerConfig) Config() StreamConsumerConfig {
+	p.Logger = orDefaultLogger(p.Logger)
+
+	if len(p.Patterns) == 0 {
+		p.Patterns = append(p.Patterns, "#")
+	}
+
+	streamName := p.StreamName
+	if streamName == "" {
+		streamName = p.ExchangeName + "-stream"
+	}
+
+	if p.OffsetCommitEvery == 0 {
+		p.OffsetCommitEvery = defaultOffsetCommitEvery
+	}
+
+	if p.OffsetCommitInterval == 0 {
+		p.OffsetCommitInterval = defaultOffsetCommitInterval
+	}
+
+	return StreamConsumerConfig{
+		connectionConfig: connectionConfig{
+			URL:         p.URL,
+			Logger:      p.Logger,
+			Properties:  newClientProperties(p.ConnectionName, p.ServiceName, p.Version, p.ClientProperties),
+			Credentials: p.Credentials,
+		},
+		exchange: exchange{
+			Name: p.ExchangeName,
+			Type: p.ExchangeType,
+		},
+		stream: stream{
+			Name:                streamName,
+			Consumer:            fmt.Sprintf("%s-for-%s", streamName, p.ServiceName),
+			Patterns:            p.Patterns,
+			PrefetchCount:       p.Prefetch,
+			Offset:              p.Offset,
+			OffsetStore:         p.OffsetStore,
+			CommitEvery:         p.OffsetCommitEvery,
+			CommitInterval:      p.OffsetCommitInterval,
+			MaxLengthBytes:      p.MaxLengthBytes,
+			MaxAge:              p.MaxAge,
+			MaxSegmentSizeBytes: p.MaxSegmentSizeBytes,
 		},
+		topologyMode: p.TopologyMode,
 	}
 }
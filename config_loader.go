@@ -0,0 +1,235 @@
+package runamqp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mergermarket/run-amqp/connection"
+)
+
+// LoadConsumerConfigFromEnv reads a NewConsumerConfig from environment variables named after prefix, such as AMQP_URL for the prefix AMQP. The variables are URL, EXCHANGE_NAME, EXCHANGE_TYPE, PATTERNS (comma separated), SERVICE_NAME, PREFETCH, REQUEUE_TTL, REQUEUE_LIMIT, MAX_PRIORITY, QUEUE_TYPE, TOPOLOGY_MODE, CONNECTION_NAME, VERSION and CREDENTIALS_FILE, which has to be readable and is watched while connected. The Logger has to be set afterwards. It returns every problem with the variables and the config they make joined together.
+func LoadConsumerConfigFromEnv(prefix string) (NewConsumerConfig, error) {
+	env := envReader{prefix: prefix}
+
+	c := NewConsumerConfig{
+		URL:            env.string("URL"),
+		ExchangeName:   env.string("EXCHANGE_NAME"),
+		ExchangeType:   env.exchangeType("EXCHANGE_TYPE"),
+		Patterns:       env.list("PATTERNS"),
+		ServiceName:    env.string("SERVICE_NAME"),
+		Prefetch:       int(env.int("PREFETCH", 0)),
+		RequeueTTL:     int16(env.int("REQUEUE_TTL", 16)),
+		RequeueLimit:   int(env.int("REQUEUE_LIMIT", 0)),
+		MaxPriority:    uint8(env.uint("MAX_PRIORITY", 8)),
+		QueueType:      QueueType(env.string("QUEUE_TYPE")),
+		TopologyMode:   TopologyMode(env.string("TOPOLOGY_MODE")),
+		ConnectionName: env.string("CONNECTION_NAME"),
+		Version:        env.string("VERSION"),
+		Credentials:    env.credentials("CREDENTIALS_FILE"),
+	}
+
+	if len(env.errs) > 0 {
+		return c, errors.Join(env.errs...)
+	}
+
+	return c, validateConsumer(c)
+}
+
+// LoadPublisherConfigFromEnv reads a NewPublisherConfig from environment variables named after prefix, such as AMQP_URL for the prefix AMQP. The variables are URL, EXCHANGE_NAME, EXCHANGE_TYPE, CONFIRMABLE, CHANNEL_POOL_SIZE, SERVICE_NAME, TOPOLOGY_MODE, DELAY_MODE, CONNECTION_NAME, VERSION and CREDENTIALS_FILE, which has to be readable and is watched while connected. The Logger has to be set afterwards. It returns every problem with the variables and the config they make joined together.
+func LoadPublisherConfigFromEnv(prefix string) (NewPublisherConfig, error) {
+	env := envReader{prefix: prefix}
+
+	p := NewPublisherConfig{
+		URL:             env.string("URL"),
+		ExchangeName:    env.string("EXCHANGE_NAME"),
+		ExchangeType:    env.exchangeType("EXCHANGE_TYPE"),
+		Confirmable:     env.bool("CONFIRMABLE"),
+		ChannelPoolSize: int(env.int("CHANNEL_POOL_SIZE", 0)),
+		ServiceName:     env.string("SERVICE_NAME"),
+		TopologyMode:    TopologyMode(env.string("TOPOLOGY_MODE")),
+		DelayMode:       DelayMode(env.string("DELAY_MODE")),
+		ConnectionName:  env.string("CONNECTION_NAME"),
+		Version:         env.string("VERSION"),
+		Credentials:     env.credentials("CREDENTIALS_FILE"),
+	}
+
+	if len(env.errs) > 0 {
+		return p, errors.Join(env.errs...)
+	}
+
+	return p, validatePublisher(p)
+}
+
+// ConfigFile holds named consumers and publishers, such as
+//
+//	{"consumers": {"orders": {"URL": "${AMQP_URL}", "ExchangeName": "orders", "ExchangeType": "topic", "ServiceName": "billing", "Prefetch": 10}},
+//	 "publishers": {"invoices": {"URL": "${AMQP_URL}", "ExchangeName": "invoices", "ExchangeType": "fanout"}}}
+//
+// The keys are the fields of NewConsumerConfig and NewPublisherConfig, except for Logger, Credentials, Naming and Outbox which are set in code after loading, the file is refused when it has them. Environment variables in the URLs are expanded, so the credentials can be kept out of the file.
+type ConfigFile struct {
+	Consumers  map[string]NewConsumerConfig  `json:"consumers"`
+	Publishers map[string]NewPublisherConfig `json:"publishers"`
+}
+
+// LoadConfigFile reads the consumers and publishers in the JSON file at path. The Loggers have to be set afterwards. It returns every problem with the file joined together, naming the consumer or publisher each is about.
+func LoadConfigFile(path string) (ConfigFile, error) {
+	var file ConfigFile
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return file, fmt.Errorf(`failed to read the config file "%s": %v`, path, err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&file); err != nil {
+		return file, fmt.Errorf(`failed to parse the config file "%s": %v`, path, err)
+	}
+
+	var errs []error
+
+	for name, c := range file.Consumers {
+		c.URL = os.ExpandEnv(c.URL)
+		file.Consumers[name] = c
+		if err := validateConsumer(c); err != nil {
+			errs = append(errs, fmt.Errorf(`the consumer "%s" is invalid: %w`, name, err))
+		}
+	}
+
+	for name, p := range file.Publishers {
+		p.URL = os.ExpandEnv(p.URL)
+		file.Publishers[name] = p
+		if err := validatePublisher(p); err != nil {
+			errs = append(errs, fmt.Errorf(`the publisher "%s" is invalid: %w`, name, err))
+		}
+	}
+
+	return file, errors.Join(errs...)
+}
+
+// String returns the config with the password of the URL masked, so the effective config can be printed
+func (p NewConsumerConfig) String() string {
+	p.URL = connection.MaskPassword(p.URL)
+	return printable(p)
+}
+
+// String returns the config with the password of the URL masked, so the effective config can be printed
+func (p NewPublisherConfig) String() string {
+	p.URL = connection.MaskPassword(p.URL)
+	return printable(p)
+}
+
+func printable(config interface{}) string {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Sprintf("unprintable config: %v", err)
+	}
+	return string(content)
+}
+
+// validateConsumer validates a copy of c with a silent Logger, as the loaded config has none yet
+func validateConsumer(c NewConsumerConfig) error {
+	c.Logger = &SimpleLogger{Out: io.Discard}
+	_, err := c.ValidConfig()
+	return err
+}
+
+func validatePublisher(p NewPublisherConfig) error {
+	p.Logger = &SimpleLogger{Out: io.Discard}
+	_, err := p.ValidConfig()
+	return err
+}
+
+// envReader reads environment variables named after its prefix, collecting the ones that can not be parsed
+type envReader struct {
+	prefix string
+	errs   []error
+}
+
+func (e *envReader) name(variable string) string {
+	if e.prefix == "" {
+		return variable
+	}
+	return e.prefix + "_" + variable
+}
+
+func (e *envReader) string(variable string) string {
+	return os.Getenv(e.name(variable))
+}
+
+func (e *envReader) list(variable string) []string {
+	var values []string
+	for _, value := range strings.Split(e.string(variable), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (e *envReader) int(variable string, bits int) int64 {
+	value := e.string(variable)
+	if value == "" {
+		return 0
+	}
+	parsed, err := strconv.ParseInt(value, 10, bits)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s is not a valid number: %v", e.name(variable), err))
+	}
+	return parsed
+}
+
+func (e *envReader) uint(variable string, bits int) uint64 {
+	value := e.string(variable)
+	if value == "" {
+		return 0
+	}
+	parsed, err := strconv.ParseUint(value, 10, bits)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s is not a valid number: %v", e.name(variable), err))
+	}
+	return parsed
+}
+
+func (e *envReader) bool(variable string) bool {
+	value := e.string(variable)
+	if value == "" {
+		return false
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s is not true or false: %v", e.name(variable), err))
+	}
+	return parsed
+}
+
+func (e *envReader) exchangeType(variable string) ExchangeType {
+	value := e.string(variable)
+	if value == "" {
+		return ""
+	}
+	exchangeType, err := NewExchangeType(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s is invalid: %v", e.name(variable), err))
+	}
+	return exchangeType
+}
+
+func (e *envReader) credentials(variable string) connection.CredentialsProvider {
+	path := e.string(variable)
+	if path == "" {
+		return nil
+	}
+	credentials := connection.NewManagedFileCredentials(path)
+	if _, _, err := credentials.Credentials(); err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s is invalid: %v", e.name(variable), err))
+	}
+	return credentials
+}
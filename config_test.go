@@ -1,6 +1,7 @@
 package runamqp
 
 import (
+	"os"
 	"testing"
 
 	"github.com/mergermarket/run-amqp/helpers"
@@ -146,3 +147,65 @@ func TestItSetsMaxPriority(t *testing.T) {
 		t.Error("Unexpected pattern, expected", pattern, "but got", consumerConfig.queue.Patterns[0])
 	}
 }
+
+func TestItNamesTheConnectionAfterTheServiceAndHost(t *testing.T) {
+	logger := helpers.NewTestLogger(t)
+	c := NewConsumerConfig{
+		URL:          testRabbitURI,
+		ExchangeName: "exchange",
+		ExchangeType: Fanout,
+		Logger:       logger,
+		ServiceName:  "service",
+		Prefetch:     defaultPrefetch,
+		Version:      "1.2.3",
+		ClientProperties: map[string]interface{}{
+			"team": "platform",
+		},
+	}
+	consumerConfig := c.Config()
+
+	hostname, _ := os.Hostname()
+	expectedName := "service@" + hostname
+
+	if consumerConfig.Properties["connection_name"] != expectedName {
+		t.Error("Expected connection name", expectedName, "but got", consumerConfig.Properties["connection_name"])
+	}
+
+	if consumerConfig.Properties["service_name"] != "service" {
+		t.Error("Expected the service name property but got", consumerConfig.Properties["service_name"])
+	}
+
+	if consumerConfig.Properties["service_version"] != "1.2.3" {
+		t.Error("Expected the service version property but got", consumerConfig.Properties["service_version"])
+	}
+
+	if consumerConfig.Properties["team"] != "platform" {
+		t.Error("Expected the client property to be sent but got", consumerConfig.Properties["team"])
+	}
+
+	if consumerConfig.Properties["product"] == nil {
+		t.Error("Expected the library's default properties to be kept")
+	}
+
+	publisherConfig := consumerConfig.NewPublisherConfig()
+
+	if publisherConfig.Properties["connection_name"] != expectedName {
+		t.Error("Expected the derived publisher config to have the same connection name but got", publisherConfig.Properties["connection_name"])
+	}
+}
+
+func TestItUsesTheSuppliedConnectionName(t *testing.T) {
+	c := NewPublisherConfig{
+		URL:            testRabbitURI,
+		ExchangeName:   "exchange",
+		ExchangeType:   Fanout,
+		Logger:         helpers.NewTestLogger(t),
+		ServiceName:    "service",
+		ConnectionName: "my connection",
+	}
+	publisherConfig := c.Config()
+
+	if publisherConfig.Properties["connection_name"] != "my connection" {
+		t.Error("Expected connection name to be my connection but got", publisherConfig.Properties["connection_name"])
+	}
+}
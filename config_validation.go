@@ -0,0 +1,157 @@
+package runamqp
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// orDefaultLogger returns l, or a SimpleLogger writing to stderr when there is none, so a missing Logger does not panic the first time something is logged
+func orDefaultLogger(l logger) logger {
+	if l == nil {
+		return &SimpleLogger{Out: os.Stderr}
+	}
+	return l
+}
+
+// ValidConfig returns the PublisherConfig along with every problem found with the settings joined together, before anything connects to rabbit
+func (p *NewPublisherConfig) ValidConfig() (PublisherConfig, error) {
+	config := p.Config()
+
+	errs := []error{
+		validURL(p.URL),
+		validExchange(p.ExchangeName, p.ExchangeType),
+		validTopologyMode(p.TopologyMode),
+	}
+
+	if p.ChannelPoolSize < 0 {
+		errs = append(errs, fmt.Errorf("the ChannelPoolSize %d can not be negative", p.ChannelPoolSize))
+	}
+
+	if p.OutboxSize < 0 {
+		errs = append(errs, fmt.Errorf("the OutboxSize %d can not be negative", p.OutboxSize))
+	}
+
+	if p.OutboxFlushTimeout < 0 {
+		errs = append(errs, fmt.Errorf("the OutboxFlushTimeout %s can not be negative", p.OutboxFlushTimeout))
+	}
+
+	errs = append(errs, validConfigTopology(config))
+
+	return config, errors.Join(errs...)
+}
+
+// ValidConfig returns the ConsumerConfig along with every problem found with the settings joined together, before anything connects to rabbit
+func (p *NewConsumerConfig) ValidConfig() (ConsumerConfig, error) {
+	config := p.Config()
+
+	errs := []error{
+		validURL(p.URL),
+		validExchange(p.ExchangeName, p.ExchangeType),
+		validTopologyMode(p.TopologyMode),
+	}
+
+	if p.ServiceName == "" {
+		errs = append(errs, errors.New("the ServiceName is required, the queues and retry exchanges are named after it"))
+	}
+
+	if p.Prefetch < 0 {
+		errs = append(errs, fmt.Errorf("the Prefetch %d can not be negative", p.Prefetch))
+	}
+
+	if p.RequeueTTL < 0 {
+		errs = append(errs, fmt.Errorf("the RequeueTTL %dms can not be negative, it may have overflowed as it is at most %dms", p.RequeueTTL, int16(^uint16(0)>>1)))
+	}
+
+	if p.RequeueLimit < 0 {
+		errs = append(errs, fmt.Errorf("the RequeueLimit %d can not be negative", p.RequeueLimit))
+	}
+
+	if p.Partitions < 0 {
+		errs = append(errs, fmt.Errorf("the Partitions %d can not be negative", p.Partitions))
+	}
+
+	if p.Partitions > 0 {
+		errs = append(errs, config.validatePartitions())
+	}
+
+	errs = append(errs, validConfigTopology(config))
+
+	return config, errors.Join(errs...)
+}
+
+// ValidConfig returns the StreamConsumerConfig along with every problem found with the settings joined together, before anything connects to rabbit
+func (p *NewStreamConsumerConfig) ValidConfig() (StreamConsumerConfig, error) {
+	config := p.Config()
+
+	errs := []error{
+		validURL(p.URL),
+		validExchange(p.ExchangeName, p.ExchangeType),
+		validTopologyMode(p.TopologyMode),
+		config.validate(),
+	}
+
+	if p.ServiceName == "" {
+		errs = append(errs, errors.New("the ServiceName is required, the offsets are stored under it"))
+	}
+
+	if p.OffsetCommitEvery < 0 || p.OffsetCommitInterval < 0 {
+		errs = append(errs, errors.New("the OffsetCommitEvery and OffsetCommitInterval can not be negative"))
+	}
+
+	if p.MaxLengthBytes < 0 || p.MaxSegmentSizeBytes < 0 {
+		errs = append(errs, errors.New("the MaxLengthBytes and MaxSegmentSizeBytes of the stream can not be negative"))
+	}
+
+	errs = append(errs, validConfigTopology(config))
+
+	return config, errors.Join(errs...)
+}
+
+func validURL(uri string) error {
+	if uri == "" {
+		return errors.New("the URL is required")
+	}
+	if _, err := amqp.ParseURI(uri); err != nil {
+		// a URL which does not parse can not have its password masked, and the parse error quotes all of it
+		var parseErr *url.Error
+		if errors.As(err, &parseErr) {
+			return errors.New("the URL is malformed, check it is escaped properly")
+		}
+		return fmt.Errorf("the URL is invalid: %v", err)
+	}
+	return nil
+}
+
+func validExchange(name string, exchangeType ExchangeType) error {
+	if name == "" {
+		return errors.New("the ExchangeName is required")
+	}
+
+	if recognised, err := NewExchangeType(string(exchangeType)); err != nil || recognised != exchangeType {
+		return fmt.Errorf(`the ExchangeType "%s" of the exchange "%s" is not recognised`, exchangeType, name)
+	}
+
+	return nil
+}
+
+func validTopologyMode(mode TopologyMode) error {
+	switch mode {
+	case "", DeclareTopology, VerifyTopology, SkipTopology:
+		return nil
+	default:
+		return fmt.Errorf("unrecognised topology mode %s", mode)
+	}
+}
+
+// validConfigTopology checks the topology a config declares, which covers the queue settings and the length of every name
+func validConfigTopology(config TopologyConfig) error {
+	topology, err := config.Topology()
+	if err != nil {
+		return err
+	}
+	return topology.Validate()
+}
@@ -3,38 +3,55 @@ package connection
 import (
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"math"
 	"strings"
+	"sync"
+	"time"
 )
 
 type channelConnection interface {
 	OpenChannel(connection *amqp.Connection)
 	NewChannel() chan *amqp.Channel
 	sendError(*amqp.Error)
+	close()
 }
 
+// cConnection is owned by its run goroutine, which is the only one that opens, listens to and closes the channel. Other goroutines talk to it through its channels.
 type cConnection struct {
 	channels           chan *amqp.Channel
-	connection         *amqp.Connection
-	openChannel        *amqp.Channel
+	connections        chan *amqp.Connection
 	errors             chan *amqp.Error
+	done               chan struct{}
+	closeOnce          sync.Once
 	logger             logger
 	channelDescription string
 }
 
+// stableChannelPeriod is how long a channel has to stay open before it is no longer considered to be failing, which resets the delay before it is re-opened
+const stableChannelPeriod = 10 * time.Second
+
+const maxReopenDelay = 30 * time.Second
+
 func newChannelConnection(logger logger, channelDescription string) channelConnection {
 	channel := cConnection{
 		logger:             logger,
 		channels:           make(chan *amqp.Channel),
+		connections:        make(chan *amqp.Connection),
 		channelDescription: channelDescription,
 		errors:             make(chan *amqp.Error),
+		done:               make(chan struct{}),
 	}
 
+	go channel.run()
+
 	return &channel
 }
 
 func (c *cConnection) OpenChannel(connection *amqp.Connection) {
-	c.connection = connection
-	go c.create()
+	select {
+	case c.connections <- connection:
+	case <-c.done:
+	}
 }
 
 func (c *cConnection) NewChannel() chan *amqp.Channel {
@@ -45,41 +62,105 @@ func (c *cConnection) sendError(err *amqp.Error) {
 	c.errors <- err
 }
 
-func (c *cConnection) create() {
+// close closes the open channel and stops re-opening it, after which the channel of channels is closed
+func (c *cConnection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *cConnection) run() {
+	defer close(c.channels)
+
+	var connection *amqp.Connection
+	var openChannel *amqp.Channel
+	var closed chan *amqp.Error
+	var channels chan *amqp.Channel
+	var reopen <-chan time.Time
+	var openedAt time.Time
+	failures := 0
+
+	var open func()
+	var reopenLater func()
+	open = func() {
+		openChannel, closed, channels = nil, nil, nil
+		if connection == nil {
+			return
+		}
+		openChannel = c.create(connection)
+		if openChannel == nil {
+			if !connection.IsClosed() {
+				reopenLater()
+			}
+			return
+		}
+		closed = openChannel.NotifyClose(make(chan *amqp.Error, 1))
+		channels = c.channels
+		openedAt = time.Now()
+	}
+
+	reopenLater = func() {
+		if time.Since(openedAt) > stableChannelPeriod {
+			failures = 0
+		}
+		delay := time.Duration(math.Min(float64(maxReopenDelay), float64(100*time.Millisecond)*math.Exp2(float64(failures))))
+		failures++
+		openChannel, closed, channels = nil, nil, nil
+		reopen = time.After(delay)
+	}
+
+	for {
+		select {
+		case connection = <-c.connections:
+			if openChannel != nil {
+				c.closeOpenChannel(openChannel)
+			}
+			failures, reopen = 0, nil
+			open()
+		case channels <- openChannel:
+			channels = nil
+		case err := <-closed:
+			if err == nil {
+				closed = nil
+				continue
+			}
+			c.logger.Error(fmt.Sprintf(`there was a channel error on channel for "%s" with error code: "%d" reason: "%s" - will try to re-open channel now.`, c.channelDescription, err.Code, err.Reason))
+			reopenLater()
+		case err := <-c.errors:
+			c.logger.Error(fmt.Sprintf(`there was a channel error on channel for "%s" with error code: "%d" reason: "%s" - will try to re-open channel now.`, c.channelDescription, err.Code, err.Reason))
+			if openChannel != nil {
+				c.closeOpenChannel(openChannel)
+			}
+			open()
+		case <-reopen:
+			reopen = nil
+			if !connection.IsClosed() {
+				open()
+			}
+		case <-c.done:
+			if openChannel != nil {
+				c.closeOpenChannel(openChannel)
+			}
+			return
+		}
+	}
+}
+
+func (c *cConnection) create(connection *amqp.Connection) *amqp.Channel {
 	c.logger.Debug(fmt.Sprintf(`opening a new channel for "%s"`, c.channelDescription))
 
-	openChannel, err := c.connection.Channel()
+	openChannel, err := connection.Channel()
 	if err != nil {
 		c.logger.Error(fmt.Sprintf(`failed to open a new channel for "%s"`, c.channelDescription), err)
-		return
+		return nil
 	}
 
 	c.logger.Debug(fmt.Sprintf(`successfully opened a new channel for "%s"`, c.channelDescription))
-	c.openChannel = openChannel
-	c.listenForChannelError()
-	func() {
-		c.channels <- openChannel
-	}()
+	return openChannel
 }
 
-func (c *cConnection) listenForChannelError() {
-
-	go func() {
-
-		c.errors = c.openChannel.NotifyClose(c.errors)
-
-		for {
-			err, ok := <-c.errors
-			if err != nil && ok {
-				c.logger.Error(fmt.Sprintf(`there was a channel error on channel for "%s" with error code: "%d" reason: "%s" - will try to re-open channel now.`, c.channelDescription, err.Code, err.Reason))
-				c.closeOpenChannel()
-				c.create()
-			}
-		}
-	}()
-}
-func (c *cConnection) closeOpenChannel() {
-	err := c.openChannel.Close()
+func (c *cConnection) closeOpenChannel(openChannel *amqp.Channel) {
+	err := openChannel.Close()
 	if err != nil {
 		if strings.Contains(err.Error(), "channel/connection is not open") {
 			c.logger.Info(fmt.Sprintf(`could not close channel for "%s" because it's no longer open`, c.channelDescription), err)
@@ -10,7 +10,7 @@ import (
 func TestChannelConnection_OpenChannel(t *testing.T) {
 	logger := helpers.NewTestLogger(t)
 	t.Run("should re-open a channel after an error has occured", func(t *testing.T) {
-		server := newServerConnection(testRabbitURI, logger)
+		server := newServerConnection(testRabbitURI, logger, Options{})
 
 		connections := server.GetConnections()
 
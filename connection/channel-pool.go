@@ -0,0 +1,127 @@
+package connection
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ChannelPool lends out channels of a managed connection so that several goroutines can use a channel each at the same time. Channels are opened lazily up to the size of the pool, and channels that have been closed, for example by a channel error or a reconnection, are replaced transparently.
+type ChannelPool interface {
+	// Get borrows a channel from the pool, blocking while all of them are in use
+	Get() (*amqp.Channel, error)
+	// Put returns a borrowed channel to the pool
+	Put(channel *amqp.Channel)
+	// Close closes the idle channels and the borrowed ones as they are put back
+	Close()
+}
+
+type cPool struct {
+	description string
+	logger      logger
+	connection  func() *amqp.Connection
+	setUp       func(*amqp.Channel) error
+	idle        chan *amqp.Channel
+	slots       chan struct{}
+	closed      atomic.Bool
+}
+
+func newChannelPool(description string, size int, connection func() *amqp.Connection, setUp func(*amqp.Channel) error, logger logger) ChannelPool {
+	if size < 1 {
+		size = 1
+	}
+
+	pool := cPool{
+		description: description,
+		logger:      logger,
+		connection:  connection,
+		setUp:       setUp,
+		idle:        make(chan *amqp.Channel, size),
+		slots:       make(chan struct{}, size),
+	}
+
+	for i := 0; i < size; i++ {
+		pool.slots <- struct{}{}
+	}
+
+	return &pool
+}
+
+func (p *cPool) Get() (*amqp.Channel, error) {
+	if p.closed.Load() {
+		return nil, fmt.Errorf(`the channel pool for "%s" is closed`, p.description)
+	}
+
+	select {
+	case channel := <-p.idle:
+		if !channel.IsClosed() {
+			return channel, nil
+		}
+		p.logger.Debug(fmt.Sprintf(`replacing a closed channel in the pool for "%s"`, p.description))
+		return p.open()
+	case <-p.slots:
+		return p.open()
+	}
+}
+
+func (p *cPool) Put(channel *amqp.Channel) {
+	if channel == nil || channel.IsClosed() {
+		p.slots <- struct{}{}
+		return
+	}
+	if p.closed.Load() {
+		_ = channel.Close()
+		p.slots <- struct{}{}
+		return
+	}
+	p.idle <- channel
+}
+
+func (p *cPool) Close() {
+	if p.closed.Swap(true) {
+		return
+	}
+
+	for {
+		select {
+		case channel := <-p.idle:
+			_ = channel.Close()
+			p.slots <- struct{}{}
+		default:
+			return
+		}
+	}
+}
+
+func (p *cPool) open() (*amqp.Channel, error) {
+	channel, err := p.openChannel()
+	if err != nil {
+		p.slots <- struct{}{}
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (p *cPool) openChannel() (*amqp.Channel, error) {
+	connection := p.connection()
+	if connection == nil || connection.IsClosed() {
+		return nil, fmt.Errorf(`there is no open connection to open a channel for "%s"`, p.description)
+	}
+
+	p.logger.Debug(fmt.Sprintf(`opening a new channel in the pool for "%s"`, p.description))
+
+	channel, err := connection.Channel()
+	if err != nil {
+		return nil, fmt.Errorf(`failed to open a new channel in the pool for "%s": %v`, p.description, err)
+	}
+
+	if p.setUp != nil {
+		if err := p.setUp(channel); err != nil {
+			_ = channel.Close()
+			return nil, fmt.Errorf(`failed to set up a new channel in the pool for "%s": %v`, p.description, err)
+		}
+	}
+
+	return channel, nil
+}
@@ -0,0 +1,95 @@
+package connection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mergermarket/run-amqp/helpers"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestChannelPool_Get(t *testing.T) {
+	logger := helpers.NewTestLogger(t)
+
+	newOpenPool := func(t *testing.T, size int, setUp func(*amqp.Channel) error) ChannelPool {
+		manager := NewConnectionManager(testRabbitURI, logger)
+
+		select {
+		case <-manager.OpenChannel("waiting for the connection"):
+		case <-time.After(2 * time.Second):
+			t.Fatal("failed to connect in time")
+		}
+
+		return manager.NewChannelPool("test pool", size, setUp)
+	}
+
+	t.Run("should lend out different channels up to the size of the pool", func(t *testing.T) {
+		setUpCalls := 0
+		pool := newOpenPool(t, 2, func(*amqp.Channel) error {
+			setUpCalls++
+			return nil
+		})
+
+		first, err := pool.Get()
+		if err != nil {
+			t.Fatal("failed to get the first channel", err)
+		}
+
+		second, err := pool.Get()
+		if err != nil {
+			t.Fatal("failed to get the second channel", err)
+		}
+
+		if first == second {
+			t.Fatal("expected two different channels")
+		}
+
+		if setUpCalls != 2 {
+			t.Error("expected the set up to be called for both channels but it was called", setUpCalls, "times")
+		}
+
+		borrowed := make(chan *amqp.Channel)
+		go func() {
+			ch, _ := pool.Get()
+			borrowed <- ch
+		}()
+
+		select {
+		case <-borrowed:
+			t.Fatal("should not get a third channel while both are in use")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		pool.Put(first)
+
+		select {
+		case ch := <-borrowed:
+			if ch != first {
+				t.Error("expected to get the channel that was put back")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("did not get the channel that was put back in time")
+		}
+	})
+
+	t.Run("should replace a channel that has been closed", func(t *testing.T) {
+		pool := newOpenPool(t, 1, nil)
+
+		first, err := pool.Get()
+		if err != nil {
+			t.Fatal("failed to get the first channel", err)
+		}
+
+		_ = first.Close()
+		pool.Put(first)
+
+		second, err := pool.Get()
+		if err != nil {
+			t.Fatal("failed to get a replacement channel", err)
+		}
+
+		if second == first || second.IsClosed() {
+			t.Fatal("expected a new open channel in place of the closed one")
+		}
+	})
+}
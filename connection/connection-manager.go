@@ -1,7 +1,11 @@
 package connection
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -16,29 +20,60 @@ type logger interface {
 //revive:disable
 type ConnectionManager interface {
 	OpenChannel(description string) chan *amqp.Channel
+	OpenChannelContext(ctx context.Context, description string) chan *amqp.Channel
+	NewChannelPool(description string, size int, setUp func(*amqp.Channel) error) ChannelPool
+	ConnectionError() error
+	Close()
 	sendConnectionError(err *amqp.Error)
 	sendChannelError(index uint8, err *amqp.Error) error
 }
 
 //revive:enable
 
+// ErrNotConnected is returned by ConnectionError while the first attempt to connect is still being made
+var ErrNotConnected = errors.New("not connected to rabbit yet")
+
 type manager struct {
+	sync.Mutex
 	openConnection     *amqp.Connection
 	connections        chan *amqp.Connection
 	logger             logger
 	channelConnections []channelConnection
 	server             serverConnection
+	done               chan struct{}
+	closeOnce          sync.Once
+	credentials        credentialsUser
 }
 
+// Options configures how a managed connection dials rabbit
+type Options struct {
+	// Properties are the client properties sent when connecting, connection_name is shown in the management UI. Optional
+	Properties amqp.Table
+	// Credentials replace the username and password of the URL every time it dials. A ManagedFileCredentials watches its file until the connection manager is closed. Optional
+	Credentials CredentialsProvider
+}
+
+// NewConnectionManager returns a ConnectionManager which keeps a connection to URL open
 func NewConnectionManager(URL string, logger logger) ConnectionManager {
+	return NewConnectionManagerWithOptions(URL, logger, Options{})
+}
 
-	server := newServerConnection(URL, logger)
+// NewConnectionManagerWithOptions is like NewConnectionManager, dialing with options
+func NewConnectionManagerWithOptions(URL string, logger logger, options Options) ConnectionManager {
+
+	server := newServerConnection(URL, logger, options)
 
 	newManager := manager{
 		connections:        server.GetConnections(),
 		logger:             logger,
 		channelConnections: make([]channelConnection, 0),
 		server:             server,
+		done:               make(chan struct{}),
+	}
+
+	if user, ok := options.Credentials.(credentialsUser); ok {
+		user.acquire()
+		newManager.credentials = user
 	}
 
 	go newManager.listenForNewOpenConnections()
@@ -46,27 +81,106 @@ func NewConnectionManager(URL string, logger logger) ConnectionManager {
 	return &newManager
 }
 
+// OpenChannel returns a channel of amqp channels, a new one is sent every time the channel is (re-)opened, for as long as the connection is managed
 func (m *manager) OpenChannel(description string) chan *amqp.Channel {
+	return m.OpenChannelContext(context.Background(), description)
+}
+
+// OpenChannelContext is like OpenChannel, but stops re-opening and closes the channel once ctx is done, after which the channel of amqp channels is closed
+func (m *manager) OpenChannelContext(ctx context.Context, description string) chan *amqp.Channel {
 
 	channelConnection := newChannelConnection(m.logger, description)
+
+	m.Lock()
+	defer m.Unlock()
+
+	select {
+	case <-m.done:
+		channelConnection.close()
+		return channelConnection.NewChannel()
+	default:
+	}
+
 	m.channelConnections = append(m.channelConnections, channelConnection)
+	if m.openConnection != nil {
+		channelConnection.OpenChannel(m.openConnection)
+	}
 
 	go func() {
-		if m.openConnection != nil {
-			channelConnection.OpenChannel(m.openConnection)
+		select {
+		case <-ctx.Done():
+			m.removeChannelConnection(channelConnection)
+			channelConnection.close()
+		case <-m.done:
 		}
 	}()
 
 	return channelConnection.NewChannel()
 }
 
+func (m *manager) removeChannelConnection(channelConnection channelConnection) {
+	m.Lock()
+	defer m.Unlock()
+
+	for i, c := range m.channelConnections {
+		if c == channelConnection {
+			m.channelConnections = append(m.channelConnections[:i], m.channelConnections[i+1:]...)
+			return
+		}
+	}
+}
+
+// NewChannelPool returns a pool of at most size channels on the managed connection, setUp is called on every channel the pool opens before it is lent out
+func (m *manager) NewChannelPool(description string, size int, setUp func(*amqp.Channel) error) ChannelPool {
+	return newChannelPool(description, size, m.currentConnection, setUp, m.logger)
+}
+
+func (m *manager) currentConnection() *amqp.Connection {
+	m.Lock()
+	defer m.Unlock()
+	return m.openConnection
+}
+
+// listenForNewOpenConnections hands every new connection to all the channel connections. The lock is held while doing so, so a channel connection added at the same time gets the new connection exactly once.
 func (m *manager) listenForNewOpenConnections() {
 	for conn := range m.connections {
+		m.Lock()
 		m.openConnection = conn
 		for _, channelConnection := range m.channelConnections {
 			channelConnection.OpenChannel(conn)
 		}
+		m.Unlock()
+	}
+}
+
+// ConnectionError returns nil when there is an open connection, otherwise the reason there is not
+func (m *manager) ConnectionError() error {
+	if conn := m.currentConnection(); conn != nil && !conn.IsClosed() {
+		return nil
 	}
+	if err := m.server.dialError(); err != nil {
+		return err
+	}
+	return ErrNotConnected
+}
+
+// Close closes the connection along with all the channels opened on it, and stops re-connecting
+func (m *manager) Close() {
+	m.closeOnce.Do(func() {
+		m.Lock()
+		close(m.done)
+		channelConnections := m.channelConnections
+		m.channelConnections = nil
+		m.Unlock()
+
+		for _, channelConnection := range channelConnections {
+			channelConnection.close()
+		}
+		m.server.close()
+		if m.credentials != nil {
+			m.credentials.release()
+		}
+	})
 }
 
 func (m *manager) sendConnectionError(err *amqp.Error) {
@@ -75,10 +189,15 @@ func (m *manager) sendConnectionError(err *amqp.Error) {
 
 func (m *manager) sendChannelError(index uint8, err *amqp.Error) error {
 
+	m.Lock()
 	if int(index) >= len(m.channelConnections) {
+		m.Unlock()
 		return fmt.Errorf("index %d is out of range of length %d", index, len(m.channelConnections))
 	}
-	m.channelConnections[index].sendError(err)
+	channelConnection := m.channelConnections[index]
+	m.Unlock()
+
+	channelConnection.sendError(err)
 
 	return nil
 }
@@ -1,8 +1,10 @@
 package connection
 
 import (
+	"fmt"
 	"github.com/mergermarket/run-amqp/helpers"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
 	"testing"
 	"time"
 )
@@ -98,3 +100,67 @@ func TestNewConnectionManager_OpenChannel(t *testing.T) {
 		}
 	})
 }
+
+func TestNewConnectionManager_ConcurrentUse(t *testing.T) {
+	logger := helpers.NewTestLogger(t)
+
+	t.Run("should hand out channels to channels opened concurrently while reconnecting", func(t *testing.T) {
+		manager := NewConnectionManager(testRabbitURI, logger)
+
+		const numberOfChannels = 20
+		channels := make(chan chan *amqp.Channel, numberOfChannels)
+
+		var wg sync.WaitGroup
+		wg.Add(numberOfChannels)
+		for i := 0; i < numberOfChannels; i++ {
+			go func(i int) {
+				defer wg.Done()
+				channels <- manager.OpenChannel(fmt.Sprintf("concurrent channel %d", i))
+			}(i)
+		}
+
+		go manager.sendConnectionError(amqp.ErrClosed)
+
+		wg.Wait()
+		close(channels)
+
+		for channel := range channels {
+			select {
+			case <-channel:
+			case <-time.After(5 * time.Second):
+				t.Fatal("failed to get a channel in time")
+			}
+		}
+	})
+
+	t.Run("should lend out pooled channels to many goroutines at once", func(t *testing.T) {
+		manager := NewConnectionManager(testRabbitURI, logger)
+
+		select {
+		case <-manager.OpenChannel("waiting for the connection"):
+		case <-time.After(2 * time.Second):
+			t.Fatal("failed to connect in time")
+		}
+
+		pool := manager.NewChannelPool("stressed pool", 3, nil)
+
+		const goroutines = 50
+		errs := make(chan error, goroutines)
+		for i := 0; i < goroutines; i++ {
+			go func() {
+				ch, err := pool.Get()
+				if err == nil {
+					err = ch.Publish("", "no-such-queue", false, false, amqp.Publishing{Body: []byte("stress")})
+					pool.Put(ch)
+				}
+				errs <- err
+			}()
+		}
+
+		for i := 0; i < goroutines; i++ {
+			if err := <-errs; err != nil {
+				t.Error("unexpected error using a pooled channel", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package connection
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CredentialsProvider supplies the username and password to connect with. It is consulted on every dial, so credentials that are rotated while running are used when reconnecting.
+type CredentialsProvider interface {
+	Credentials() (username, password string, err error)
+}
+
+// fileCredentialsWatchInterval is how often FileCredentials checks whether its file has changed
+const fileCredentialsWatchInterval = 5 * time.Second
+
+// FileCredentials is a CredentialsProvider reading a JSON file like {"username": "guest", "password": "guest"}, as written by secrets managers. The file is watched in the background and read again whenever it changes, so dialing never waits on the disk. Close stops watching it.
+type FileCredentials struct {
+	sync.Mutex
+	path      string
+	modTime   time.Time
+	size      int64
+	username  string
+	password  string
+	err       error
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFileCredentials returns a FileCredentials which has read the file at path, and watches it for changes until it is closed
+func NewFileCredentials(path string) *FileCredentials {
+	return newFileCredentials(path, fileCredentialsWatchInterval)
+}
+
+func newFileCredentials(path string, interval time.Duration) *FileCredentials {
+	f := &FileCredentials{path: path, stop: make(chan struct{})}
+	f.reload()
+	go f.watch(interval)
+	return f
+}
+
+type fileCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Credentials returns the username and password last read from the file, or the error reading it failed with when it has not been read since it changed
+func (f *FileCredentials) Credentials() (string, string, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.err != nil {
+		return "", "", f.err
+	}
+
+	return f.username, f.password, nil
+}
+
+// Close stops watching the file, the credentials last read from it are still returned
+func (f *FileCredentials) Close() {
+	f.closeOnce.Do(func() {
+		close(f.stop)
+	})
+}
+
+// watch reloads the file every interval until the FileCredentials is closed
+func (f *FileCredentials) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.reload()
+		}
+	}
+}
+
+// reload reads the file again if it has changed since it was last read. When that fails the error is kept until the file is read successfully, and the file is tried again on the next check.
+func (f *FileCredentials) reload() {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		f.failed(fmt.Errorf(`failed to find the credentials file "%s": %v`, f.path, err))
+		return
+	}
+
+	f.Lock()
+	unchanged := f.err == nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.Unlock()
+
+	// after a failure the file is read again even when it looks unchanged, as the failure may have been a passing one
+	if unchanged {
+		return
+	}
+
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		f.failed(fmt.Errorf(`failed to read the credentials file "%s": %v`, f.path, err))
+		return
+	}
+
+	var credentials fileCredentials
+	if err := json.Unmarshal(content, &credentials); err != nil {
+		f.failed(fmt.Errorf(`failed to parse the credentials file "%s": %v`, f.path, err))
+		return
+	}
+
+	if credentials.Username == "" {
+		f.failed(fmt.Errorf(`the credentials file "%s" has no username`, f.path))
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.modTime, f.size, f.err = info.ModTime(), info.Size(), nil
+	f.username, f.password = credentials.Username, credentials.Password
+}
+
+func (f *FileCredentials) failed(err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.err = err
+}
+
+// ManagedFileCredentials is a CredentialsProvider reading the file like FileCredentials, but which only watches it while a connection manager uses it. Every connection manager given it watches the file until it is closed, and it is read once whenever the credentials are asked for otherwise.
+type ManagedFileCredentials struct {
+	sync.Mutex
+	path  string
+	users int
+	file  *FileCredentials
+}
+
+// credentialsUser is a CredentialsProvider told when a connection manager starts and stops using it
+type credentialsUser interface {
+	acquire()
+	release()
+}
+
+// NewManagedFileCredentials returns a ManagedFileCredentials reading the file at path
+func NewManagedFileCredentials(path string) *ManagedFileCredentials {
+	return &ManagedFileCredentials{path: path}
+}
+
+// Credentials returns the username and password in the file, as last read by the watch while a connection manager uses it, otherwise as read now
+func (m *ManagedFileCredentials) Credentials() (string, string, error) {
+	m.Lock()
+	file := m.file
+	m.Unlock()
+
+	if file == nil {
+		file = &FileCredentials{path: m.path}
+		file.reload()
+	}
+
+	return file.Credentials()
+}
+
+func (m *ManagedFileCredentials) acquire() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.users++
+	if m.users == 1 {
+		m.file = NewFileCredentials(m.path)
+	}
+}
+
+func (m *ManagedFileCredentials) release() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.users--
+	if m.users == 0 {
+		m.file.Close()
+		m.file = nil
+	}
+}
+
+// withCredentials returns URL with the username and password replaced by the ones from credentials, URL is returned unchanged when there is no provider
+func withCredentials(URL string, credentials CredentialsProvider) (string, error) {
+	if credentials == nil {
+		return URL, nil
+	}
+
+	username, password, err := credentials.Credentials()
+	if err != nil {
+		return "", err
+	}
+
+	parsedURL, err := url.Parse(URL)
+	if err != nil {
+		return "", errors.New("failed to parse the URL to connect with")
+	}
+
+	parsedURL.User = url.UserPassword(username, password)
+
+	return parsedURL.String(), nil
+}
+
+// MaskPassword will mask password included in URL with * characters, so it can be logged or printed
+func MaskPassword(URL string) string {
+	parsedURL, err := url.Parse(URL)
+	if err != nil || parsedURL.User == nil {
+		return URL
+	}
+	username := parsedURL.User.Username()
+	password, _ := parsedURL.User.Password()
+	if len(password) < 1 {
+		return URL
+	}
+	hiddenPassword := strings.Repeat("*", len(password))
+	return parsedURL.Scheme + "://" + username + ":" + hiddenPassword + "@" + parsedURL.Host + parsedURL.Path
+}
+
+// maskPasswordIn will mask the password of URL wherever it appears in text, such as the message of an error returned when dialing URL
+func maskPasswordIn(text, URL string) string {
+	parsedURL, err := url.Parse(URL)
+	if err != nil || parsedURL.User == nil {
+		return text
+	}
+	password, _ := parsedURL.User.Password()
+	if len(password) < 1 {
+		return text
+	}
+	text = strings.ReplaceAll(text, URL, MaskPassword(URL))
+	text = strings.ReplaceAll(text, url.QueryEscape(password), strings.Repeat("*", len(password)))
+	return strings.ReplaceAll(text, password, strings.Repeat("*", len(password)))
+}
+
+// maskedError hides the password in the message of the error it wraps
+type maskedError struct {
+	message string
+	err     error
+}
+
+func (e *maskedError) Error() string {
+	return e.message
+}
+
+func (e *maskedError) Unwrap() error {
+	return e.err
+}
+
+// maskPasswordsInError masks the passwords of the URLs in the message of err
+func maskPasswordsInError(err error, URLs ...string) error {
+	message := err.Error()
+	for _, URL := range URLs {
+		message = maskPasswordIn(message, URL)
+	}
+	return &maskedError{message: message, err: err}
+}
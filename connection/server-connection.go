@@ -4,8 +4,8 @@ import (
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"math"
-	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,29 +13,36 @@ type serverConnection interface {
 	GetConnections() chan *amqp.Connection
 	GetConnectionStatus() chan bool
 	sendError(err *amqp.Error)
+	dialError() error
+	close()
 }
 
+// sConnection is owned by its run goroutine, which is the only one that dials, listens for notifications and closes the connection. Other goroutines talk to it through its channels.
 type sConnection struct {
+	sync.Mutex
 	logger              logger
 	URL                 string
-	openConnection      *amqp.Connection
+	options             Options
 	connections         chan *amqp.Connection
 	isConnectionBlocked chan bool
 	errors              chan *amqp.Error
-	blockings           chan amqp.Blocking
+	done                chan struct{}
+	closeOnce           sync.Once
+	lastDialError       error
 }
 
-func newServerConnection(URL string, logger logger) serverConnection {
+func newServerConnection(URL string, logger logger, options Options) serverConnection {
 	newConnection := sConnection{
 		URL:                 URL,
+		options:             options,
 		logger:              logger,
 		connections:         make(chan *amqp.Connection),
 		isConnectionBlocked: make(chan bool),
 		errors:              make(chan *amqp.Error),
-		blockings:           make(chan amqp.Blocking),
+		done:                make(chan struct{}),
 	}
 
-	go newConnection.connect()
+	go newConnection.run()
 
 	return &newConnection
 }
@@ -52,91 +59,136 @@ func (c *sConnection) sendError(err *amqp.Error) {
 	c.errors <- err
 }
 
-// maskPassword will mask password included in URL with * characters
-func maskPassword(URL string) string {
-	parsedURL, err := url.Parse(URL)
-	if err != nil || parsedURL.User == nil {
-		return URL
-	}
-	username := parsedURL.User.Username()
-	password, _ := parsedURL.User.Password()
-	if len(password) < 1 {
-		return URL
-	}
-	hiddenPassword := strings.Repeat("*", len(password))
-	return parsedURL.Scheme + "://" + username + ":" + hiddenPassword + "@" + parsedURL.Host + parsedURL.Path
+// dialError returns the error of the last failed attempt to connect, it is reset once connected
+func (c *sConnection) dialError() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.lastDialError
+}
+
+func (c *sConnection) setDialError(err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.lastDialError = err
+}
+
+// close stops connecting and closes the open connection, after which the channel of connections is closed
+func (c *sConnection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
 }
 
 const takeHeartbeatFromServer = 900 * time.Millisecond // less than 1s uses the server's interval
 
-func (c *sConnection) connect() {
-	safeURL := maskPassword(c.URL)
+func (c *sConnection) run() {
+	defer close(c.connections)
+
+	for {
+		openConnection := c.connect()
+		if openConnection == nil {
+			return
+		}
+		if closed := c.serve(openConnection); closed {
+			return
+		}
+	}
+}
+
+// connect dials until it is connected, it returns nil when the connection is closed before that
+func (c *sConnection) connect() *amqp.Connection {
+	safeURL := MaskPassword(c.URL)
 	attempts := 0
 	for {
+		select {
+		case <-c.done:
+			return nil
+		default:
+		}
+
 		c.logger.Info("Connecting to", safeURL)
 		attempts++
-		openConnection, err := amqp.DialConfig(c.URL, amqp.Config{
-			Heartbeat: takeHeartbeatFromServer,
-		})
+		openConnection, err := c.dial()
 
 		if err != nil {
+			c.setDialError(err)
 			c.logger.Error(fmt.Errorf("problem connecting to %s, %v", safeURL, err))
 			millis := math.Exp2(float64(attempts))
 			sleepDuration := time.Duration(int(millis)) * time.Second
 			c.logger.Info("Trying to reconnect to RabbitMQ at", safeURL, "after", sleepDuration)
-			time.Sleep(sleepDuration)
+			select {
+			case <-time.After(sleepDuration):
+			case <-c.done:
+				return nil
+			}
 			continue
 		}
 
+		c.setDialError(nil)
 		c.logger.Info("Connected to", safeURL)
 
-		c.listenForConnectionError()
-		c.listenForConnectionBlocked()
-		c.openConnection = openConnection
-		go func() {
-			c.connections <- openConnection
-		}()
-
-		return
-
+		return openConnection
 	}
 }
 
-func (c *sConnection) listenForConnectionError() {
+// dial connects with the credentials from the provider, if there is one. The password is masked in the error returned.
+func (c *sConnection) dial() (*amqp.Connection, error) {
+	URL, err := withCredentials(c.URL, c.options.Credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the credentials to connect with: %v", err)
+	}
 
-	go func() {
+	openConnection, err := amqp.DialConfig(URL, amqp.Config{
+		Heartbeat:  takeHeartbeatFromServer,
+		Properties: c.options.Properties,
+	})
 
-		c.errors = c.openConnection.NotifyClose(c.errors)
+	if err != nil {
+		return nil, maskPasswordsInError(err, URL, c.URL)
+	}
 
-		for {
-			err, ok := <-c.errors
-			if err != nil && ok {
-				c.logger.Error(fmt.Sprintf(`there was a connection error with Code: "%d" Reason: "%s" - will try to re-connect now.`, err.Code, err.Reason))
-				c.closeOpenConnection()
-				c.connect()
-			}
-		}
-	}()
+	return openConnection, nil
 }
 
-func (c *sConnection) listenForConnectionBlocked() {
-
-	go func() {
+// serve hands out the open connection and waits until it is closed, either by the server or by an error sent to the connection. It returns true when the connection was closed on purpose.
+func (c *sConnection) serve(openConnection *amqp.Connection) bool {
+	closed := openConnection.NotifyClose(make(chan *amqp.Error, 1))
+	blockings := openConnection.NotifyBlocked(make(chan amqp.Blocking, 1))
 
-		c.blockings = c.openConnection.NotifyBlocked(c.blockings)
+	connections := c.connections
+	var isConnectionBlocked chan bool
+	var blocked bool
 
-		for {
-			if blocking, ok := <-c.blockings; ok {
-				c.logger.Info(fmt.Sprintf("connection blocking received with TCP %t ready, with reason: %s", blocking.Active, blocking.Reason))
-				c.isConnectionBlocked <- blocking.Active
+	for {
+		select {
+		case connections <- openConnection:
+			connections = nil
+		case err := <-closed:
+			if err != nil {
+				c.logger.Error(fmt.Sprintf(`there was a connection error with Code: "%d" Reason: "%s" - will try to re-connect now.`, err.Code, err.Reason))
 			}
+			return false
+		case err := <-c.errors:
+			c.logger.Error(fmt.Sprintf(`there was a connection error with Code: "%d" Reason: "%s" - will try to re-connect now.`, err.Code, err.Reason))
+			c.closeOpenConnection(openConnection)
+			return false
+		case blocking := <-blockings:
+			c.logger.Info(fmt.Sprintf("connection blocking received with TCP %t ready, with reason: %s", blocking.Active, blocking.Reason))
+			blocked = blocking.Active
+			isConnectionBlocked = c.isConnectionBlocked
+		case isConnectionBlocked <- blocked:
+			isConnectionBlocked = nil
+		case <-c.done:
+			c.logger.Info("Closing the connection to", MaskPassword(c.URL))
+			c.closeOpenConnection(openConnection)
+			return true
 		}
-	}()
+	}
 }
 
-func (c *sConnection) closeOpenConnection() {
+func (c *sConnection) closeOpenConnection(openConnection *amqp.Connection) {
 
-	err := c.openConnection.Close()
+	err := openConnection.Close()
 	if err != nil {
 		if strings.Contains(err.Error(), "channel/connection is not open") {
 			c.logger.Info("could not close connection because it's no longer open", err)
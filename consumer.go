@@ -1,25 +1,102 @@
 package runamqp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/mergermarket/run-amqp/connection"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// consumerChannels holds the latest channel set up for each part of the consumer's topology, they are replaced whenever the channels are re-opened
 type consumerChannels struct {
-	mainChannel  *amqp.Channel
-	dleChannel   *amqp.Channel
-	retryChannel *amqp.Channel
+	sync.RWMutex
+	mainChannel      *amqp.Channel
+	dleChannel       *amqp.Channel
+	retryChannel     *amqp.Channel
+	consumingChannel *amqp.Channel
+	ephemeralQueue   string
+}
+
+// startConsuming returns false when ch is already being consumed from, so a channel is never consumed from twice
+func (c *consumerChannels) startConsuming(ch *amqp.Channel) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.consumingChannel == ch {
+		return false
+	}
+	c.consumingChannel = ch
+	return true
+}
+
+// isConsuming returns whether ch is the channel currently consumed from
+func (c *consumerChannels) isConsuming(ch *amqp.Channel) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.consumingChannel == ch
+}
+
+func (c *consumerChannels) setMain(ch *amqp.Channel) {
+	c.Lock()
+	defer c.Unlock()
+	c.mainChannel = ch
+}
+
+func (c *consumerChannels) setDLE(ch *amqp.Channel) {
+	c.Lock()
+	defer c.Unlock()
+	c.dleChannel = ch
+}
+
+func (c *consumerChannels) setRetry(ch *amqp.Channel) {
+	c.Lock()
+	defer c.Unlock()
+	c.retryChannel = ch
+}
+
+func (c *consumerChannels) setEphemeralQueue(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.ephemeralQueue = name
+}
+
+// queueName is the name of the ephemeral queue of the main channel when there is one, otherwise name
+func (c *consumerChannels) queueName(name string) string {
+	c.RLock()
+	defer c.RUnlock()
+	if c.ephemeralQueue != "" {
+		return c.ephemeralQueue
+	}
+	return name
+}
+
+func (c *consumerChannels) get() (mainChannel, dleChannel, retryChannel *amqp.Channel) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.mainChannel, c.dleChannel, c.retryChannel
 }
 
 // Consumer has a channel for receiving messages
 type Consumer struct {
-	Messages         chan Message
-	QueuesBound      chan bool
-	config           ConsumerConfig
-	consumerChannels *consumerChannels
+	Messages    chan Message
+	QueuesBound chan bool
+	// ActiveChanges receives true when an exclusive or single active consumer becomes the active one, and false when it stops being it. Only the latest change is kept when it is not read.
+	ActiveChanges     chan bool
+	active            bool
+	activeMutex       sync.Mutex
+	config            ConsumerConfig
+	consumerChannels  *consumerChannels
+	consuming         atomic.Bool
+	connectionManager connection.ConnectionManager
+	ownsConnection    bool
+	setUpResult       chan error
+	progress          *setUpProgress
+	ctx               context.Context
+	cancel            context.CancelFunc
 }
 
 // MessageHandler is something that can process a Message, calling Ack, nackCalls when appropriate for your domain
@@ -36,14 +113,56 @@ func (c *Consumer) Process(handler MessageHandler, numberOfWorkers int) {
 	startWorkers(c.Messages, handler, numberOfWorkers, c.config.Logger)
 }
 
-// NewConsumer returns a Consumer
+// NewConsumer returns a Consumer, QueuesBound will receive whether its queues were set up. This will create a managed connection to rabbit, use a Client to share one connection between several consumers and publishers.
 func NewConsumer(config ConsumerConfig) *Consumer {
+	return newConsumer(config, config.newConnectionManager(), true)
+}
+
+// NewConsumerContext returns a Consumer once its queues are set up and it is consuming. If that fails, or ctx is done before then, it returns a *SetupError describing the step that failed and closes everything it opened.
+func NewConsumerContext(ctx context.Context, config ConsumerConfig) (*Consumer, error) {
+	return newConsumerContext(ctx, config, config.newConnectionManager(), true)
+}
+
+func newConsumerContext(ctx context.Context, config ConsumerConfig, connectionManager connection.ConnectionManager, ownsConnection bool) (*Consumer, error) {
+	if err := validTopology(config.Topology()); err != nil {
+		if ownsConnection {
+			connectionManager.Close()
+		}
+		return nil, err
+	}
+
+	consumer := newConsumer(config, connectionManager, ownsConnection)
+
+	select {
+	case err := <-consumer.setUpResult:
+		if err != nil {
+			consumer.Close()
+			return nil, err
+		}
+		return consumer, nil
+	case <-ctx.Done():
+		err := consumer.progress.timedOut(connectionManager, ctx.Err())
+		consumer.Close()
+		return nil, err
+	}
+}
+
+func newConsumer(config ConsumerConfig, connectionManager connection.ConnectionManager, ownsConnection bool) *Consumer {
+
+	ctx, cancel := context.WithCancel(context.Background())
 
 	consumer := Consumer{
-		Messages:         make(chan Message),
-		QueuesBound:      make(chan bool),
-		config:           config,
-		consumerChannels: new(consumerChannels),
+		Messages:          make(chan Message),
+		QueuesBound:       make(chan bool, 1),
+		ActiveChanges:     make(chan bool, 1),
+		config:            config,
+		consumerChannels:  new(consumerChannels),
+		connectionManager: connectionManager,
+		ownsConnection:    ownsConnection,
+		setUpResult:       make(chan error, 1),
+		progress:          new(setUpProgress),
+		ctx:               ctx,
+		cancel:            cancel,
 	}
 
 	go consumer.setUpConnection()
@@ -51,88 +170,140 @@ func NewConsumer(config ConsumerConfig) *Consumer {
 	return &consumer
 }
 
-func (c *Consumer) setUpConnection() {
+// Close stops consuming and closes the consumer's channels, as well as its connection unless it was made by a Client
+func (c *Consumer) Close() {
+	c.deleteEphemeralQueue()
+	c.cancel()
+	if c.ownsConnection {
+		c.connectionManager.Close()
+	}
+}
 
-	connectionManager := connection.NewConnectionManager(c.config.URL, c.config.Logger)
+// deleteEphemeralQueue deletes the ephemeral queue of the consumer, as rabbit only auto-deletes it once it has had a consumer, and a Client's connection outlives the consumer
+func (c *Consumer) deleteEphemeralQueue() {
+	name := c.consumerChannels.queueName("")
+	mainChannel, _, _ := c.consumerChannels.get()
 
-	mainQueueReady := make(chan bool)
-	dleQueueReady := make(chan bool)
-	retryQueueReady := make(chan bool)
+	if !c.config.queue.Ephemeral || name == "" || mainChannel == nil {
+		return
+	}
 
-	go c.isExchangeWithQueueReady(connectionManager, mainQueueReady, c.setUpMainExchangeWithQueue, c.config.queue.Name)
-	go c.isExchangeWithQueueReady(connectionManager, dleQueueReady, c.setUpDeadLetterExchangeWithQueue, c.config.queue.DLQ)
-	go c.isExchangeWithQueueReady(connectionManager, retryQueueReady, c.setUpRetryExchangeWithQueue, c.config.queue.RetryLater)
+	if _, err := mainChannel.QueueDelete(name, false, false, nowait); err != nil {
+		c.config.Logger.Debug(fmt.Sprintf(`the ephemeral queue "%s" was not deleted, rabbit deletes it with the connection: %v`, name, err))
+	}
+}
 
-	isReady := allQueuesReady(mainQueueReady, dleQueueReady, retryQueueReady)
+// IsActive returns whether an exclusive or single active consumer is the active one. An exclusive consumer is active as soon as it consumes, but rabbit does not tell a single active consumer, so it only finds out when it gets its first message.
+func (c *Consumer) IsActive() bool {
+	c.activeMutex.Lock()
+	defer c.activeMutex.Unlock()
+	return c.active
+}
 
-	if !isReady {
-		c.QueuesBound <- false
+// setActive notifies ActiveChanges when active changes, replacing a change which was not read yet
+func (c *Consumer) setActive(active bool) {
+	if !c.config.queue.Exclusive && !c.config.queue.SingleActive {
 		return
 	}
 
-	err := c.consumeQueue()
+	c.activeMutex.Lock()
+	defer c.activeMutex.Unlock()
 
-	if err != nil {
-		c.QueuesBound <- false
+	if c.active == active {
 		return
 	}
+	c.active = active
+
+	select {
+	case <-c.ActiveChanges:
+	default:
+	}
+	c.ActiveChanges <- active
 
-	c.QueuesBound <- true
+	if active {
+		c.config.Logger.Info(fmt.Sprintf(`became the active consumer of "%s"`, c.config.queue.Name))
+	} else {
+		c.config.Logger.Info(fmt.Sprintf(`stopped being the active consumer of "%s"`, c.config.queue.Name))
+	}
 }
 
-func allQueuesReady(signals ...<-chan bool) bool {
-	var wg sync.WaitGroup
-	isAnyUnSuccessful := false
-	wg.Add(len(signals))
+func (c *Consumer) setUpConnection() {
 
-	for _, s := range signals {
-		go func(signal <-chan bool) {
-			defer wg.Done()
-			if success := <-signal; !success {
-				isAnyUnSuccessful = true
-			}
-		}(s)
-	}
+	mainQueueReady := make(chan error, 1)
+	dleQueueReady := make(chan error, 1)
+	retryQueueReady := make(chan error, 1)
 
-	wg.Wait()
+	go c.keepExchangeWithQueueSetUp(mainQueueReady, c.setUpMainExchangeWithQueue, c.config.queue.Name)
 
-	return !isAnyUnSuccessful
+	var err error
+	if c.config.queue.Ephemeral {
+		err = allQueuesReady(c.ctx, mainQueueReady)
+	} else {
+		go c.keepExchangeWithQueueSetUp(dleQueueReady, c.setUpDeadLetterExchangeWithQueue, c.config.queue.DLQ)
+		go c.keepExchangeWithQueueSetUp(retryQueueReady, c.setUpRetryExchangeWithQueue, c.config.queue.RetryLater)
 
-}
+		err = allQueuesReady(c.ctx, mainQueueReady, dleQueueReady, retryQueueReady)
+	}
 
-func (c *Consumer) isExchangeWithQueueReady(connectionManager connection.ConnectionManager, isReady chan bool, setUpExchangeWithQueue func(*amqp.Channel) error, description string) {
+	if err == nil {
+		c.consuming.Store(true)
+		mainChannel, _, _ := c.consumerChannels.get()
+		err = c.consumeQueue(mainChannel)
+	}
 
-	go func() {
-		for channel := range connectionManager.OpenChannel(description) {
-			err := setUpExchangeWithQueue(channel)
-			if err != nil {
-				c.config.Logger.Error(err)
+	c.setUpResult <- err
+	c.QueuesBound <- err == nil
+}
+
+// allQueuesReady waits for the first signal of each of the queues and returns the first error any of them had, or the error of ctx when it is done before they are all ready
+func allQueuesReady(ctx context.Context, signals ...<-chan error) error {
+	var firstErr error
+	for _, signal := range signals {
+		select {
+		case err := <-signal:
+			if err != nil && firstErr == nil {
+				firstErr = err
 			}
-			isReady <- err == nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-	}()
+	}
+	return firstErr
+}
 
+// keepExchangeWithQueueSetUp sets up the exchange with its queue on every channel opened for it, until the consumer is closed. Only the first outcome is signalled on isReady, which has to be buffered.
+func (c *Consumer) keepExchangeWithQueueSetUp(isReady chan<- error, setUpExchangeWithQueue func(*amqp.Channel) error, description string) {
+	for channel := range c.connectionManager.OpenChannelContext(c.ctx, description) {
+		err := setUpExchangeWithQueue(channel)
+		if err != nil {
+			c.config.Logger.Error(err)
+			c.progress.failed(err)
+		}
+		select {
+		case isReady <- err:
+		default:
+		}
+	}
 }
 
 func (c *Consumer) setUpMainExchangeWithQueue(amqpChannel *amqp.Channel) error {
 
-	c.consumerChannels.mainChannel = amqpChannel
+	c.consumerChannels.setMain(amqpChannel)
 
 	c.config.Logger.Debug(fmt.Sprintf(`asserting the exchange: "%s" of type: "%s" and binding the queue: "%s" to it.`, c.config.exchange.Name, c.config.exchange.Type, c.config.queue.Name))
 
-	err := makeExchange(amqpChannel, c.config.exchange.Name, c.config.exchange.Type)
+	topology, err := c.config.mainTopology()
 
 	if err != nil {
 		return err
 	}
 
-	args := make(map[string]interface{})
-	if c.config.queue.MaxPriority > 0 {
-		args["x-max-priority"] = c.config.queue.MaxPriority
+	if c.config.queue.Ephemeral {
+		err = c.setUpEphemeralQueue(amqpChannel, topology)
+	} else {
+		err = topology.applyWith(amqpChannel, c.config.topologyMode, c.connectionManager)
 	}
 
-	err = assertAndBindQueue(amqpChannel, c.config.queue.Name, c.config.exchange.Name, c.config.queue.Patterns, args)
-
 	if err != nil {
 		return err
 	}
@@ -141,137 +312,167 @@ func (c *Consumer) setUpMainExchangeWithQueue(amqpChannel *amqp.Channel) error {
 
 	if err := amqpChannel.Qos(prefetchCount, 0, false); err != nil {
 		c.config.Logger.Error(fmt.Sprintf("problem setting quality of service when consuming %v", err))
-		return err
+		return newSetupError(StepConsume, c.config.queue.Name, err)
 	}
 
-	return err
-}
+	// the channel was re-opened after the consumer started, so it has to start consuming again
+	if c.consuming.Load() {
+		return c.consumeQueue(amqpChannel)
+	}
 
-func (c *Consumer) setUpDeadLetterExchangeWithQueue(amqpChannel *amqp.Channel) error {
+	return nil
+}
 
-	c.consumerChannels.dleChannel = amqpChannel
+// setUpEphemeralQueue declares the exchange, then a queue named by rabbit and bound to the exchange, whatever the topology mode is as it can not have been provisioned beforehand. The queue is exclusive to the connection, so rabbit deletes it with the connection, and auto-deleted once its consumer is cancelled. A queue declared on a previous channel of the same connection, such as a Client's, which never got a consumer is deleted first so it does not linger until the connection closes.
+func (c *Consumer) setUpEphemeralQueue(amqpChannel *amqp.Channel, topology Topology) error {
+	if err := topology.without(c.config.queue.Name).applyWith(amqpChannel, c.config.topologyMode, c.connectionManager); err != nil {
+		return err
+	}
 
-	c.config.Logger.Debug(fmt.Sprintf(`making DLE exchange: "%s" of type: "%s" with queue: "%s" bounds to it.`, c.config.exchange.DLE, c.config.exchange.Type, c.config.queue.DLQ))
+	args, err := c.config.mainQueueArguments()
+	if err != nil {
+		return newSetupError(StepDeclare, c.config.queue.Name, err)
+	}
 
-	// make dle/dlq
-	err := makeExchange(amqpChannel, c.config.exchange.DLE, c.config.exchange.Type)
+	if previous := c.consumerChannels.queueName(""); previous != "" {
+		c.consumerChannels.setEphemeralQueue("")
+		if _, err := amqpChannel.QueueDelete(previous, false, false, nowait); err != nil {
+			return newSetupError(StepDeclare, previous, fmt.Errorf("failed to delete the previous ephemeral queue: %w", err))
+		}
+	}
 
+	q, err := amqpChannel.QueueDeclare("", false, true, true, nowait, args)
 	if err != nil {
-		return err
+		return newSetupError(StepDeclare, c.config.queue.Name, err)
 	}
 
-	err = assertAndBindQueue(amqpChannel, c.config.queue.DLQ, c.config.exchange.DLE, []string{"#"}, nil)
+	// remembered straight away, so the queue is deleted on the next channel when binding it fails
+	c.consumerChannels.setEphemeralQueue(q.Name)
 
-	return err
-}
+	for _, b := range topology.Bindings {
+		if b.ToExchange || b.Destination != c.config.queue.Name {
+			continue
+		}
+		if err := amqpChannel.QueueBind(q.Name, b.Pattern, b.Source, nowait, b.Arguments); err != nil {
+			return newSetupError(StepBind, q.Name, fmt.Errorf(`failed to bind to "%s": %w`, b.Source, err))
+		}
+	}
 
-const matchAllPattern = "#"
+	c.config.Logger.Info(fmt.Sprintf(`consuming the ephemeral queue "%s" bound to "%s"`, q.Name, c.config.exchange.Name))
 
-func (c *Consumer) setUpRetryExchangeWithQueue(amqpChannel *amqp.Channel) error {
+	return nil
+}
 
-	c.consumerChannels.retryChannel = amqpChannel
+func (c *Consumer) setUpDeadLetterExchangeWithQueue(amqpChannel *amqp.Channel) error {
 
-	retryNowExchangeName := c.config.exchange.RetryNow
-	retryLaterExchangeName := c.config.exchange.RetryLater
+	c.consumerChannels.setDLE(amqpChannel)
 
-	c.config.Logger.Debug(fmt.Sprintf(`making RETRY-LATER exchange: "%s" of type: "%s" bound to RETRY-NOW exchage: "%s" with queue: "%s" bounds to it.`, retryLaterExchangeName, c.config.exchange.Type, retryLaterExchangeName, c.config.queue.Name))
+	c.config.Logger.Debug(fmt.Sprintf(`making DLE exchange: "%s" of type: "%s" with queue: "%s" bounds to it.`, c.config.exchange.DLE, c.config.exchange.deadLetterType(), c.config.queue.DLQ))
 
-	// make dle/dlq
-	err := makeExchange(amqpChannel, retryNowExchangeName, c.config.exchange.Type)
+	topology, err := c.config.deadLetterTopology()
 
 	if err != nil {
 		return err
 	}
 
-	c.config.Logger.Info("Created retryNow exchange", retryNowExchangeName, "type of exchange:", c.config.exchange.Type)
+	return topology.applyWith(amqpChannel, c.config.topologyMode, c.connectionManager)
+}
 
-	// make dle/dlq
-	err = makeExchange(amqpChannel, retryLaterExchangeName, c.config.exchange.Type)
+const matchAllPattern = "#"
 
-	if err != nil {
-		return err
-	}
+func (c *Consumer) setUpRetryExchangeWithQueue(amqpChannel *amqp.Channel) error {
 
-	c.config.Logger.Info("Created retryLater exchange", retryLaterExchangeName, "type of exchange:", c.config.exchange.Type)
+	c.consumerChannels.setRetry(amqpChannel)
 
-	requeueArgs := make(map[string]interface{})
-	requeueArgs["x-dead-letter-exchange"] = retryNowExchangeName
-	requeueArgs["x-message-ttl"] = c.config.queue.RequeueTTL
-	requeueArgs["x-dead-letter-routing-key"] = matchAllPattern
-	retryNowPatterns := []string{matchAllPattern}
+	c.config.Logger.Debug(fmt.Sprintf(`making RETRY-LATER exchange: "%s" of type: "%s" bound to RETRY-NOW exchage: "%s" with queue: "%s" bounds to it.`, c.config.exchange.RetryLater, c.config.exchange.deadLetterType(), c.config.exchange.RetryNow, c.config.queue.RetryLater))
 
-	err = assertAndBindQueue(amqpChannel, c.config.queue.RetryLater, retryLaterExchangeName, retryNowPatterns, requeueArgs)
+	topology, err := c.config.retryTopology()
 
 	if err != nil {
 		return err
 	}
 
-	c.config.Logger.Info("Created retry later queue and bound", c.config.queue.RetryLater, "to exchange", retryNowExchangeName, "with type", c.config.exchange.Type, "and with routing keys", retryNowPatterns)
-
-	err = amqpChannel.QueueBind(c.config.queue.Name, matchAllPattern, retryNowExchangeName, false, nil)
-
-	if err != nil {
+	if err := topology.applyWith(amqpChannel, c.config.topologyMode, c.connectionManager); err != nil {
 		return err
 	}
 
-	c.config.Logger.Info("Created the bindings for queue ", c.config.queue.Name, "to exchange", retryNowExchangeName, "with type", c.config.exchange.Type, "and with routing keys", retryNowPatterns)
+	c.config.Logger.Info("Created the retry exchanges", c.config.exchange.RetryLater, "and", c.config.exchange.RetryNow, "with the retry queue", c.config.queue.RetryLater, "bound to the queue", c.config.queue.Name)
 
 	return nil
 }
 
-func (c *Consumer) consumeQueue() error {
+func (c *Consumer) consumeQueue(mainChannel *amqp.Channel) error {
+
+	if !c.consumerChannels.startConsuming(mainChannel) {
+		return nil
+	}
+
+	queueName := c.consumerChannels.queueName(c.config.queue.Name)
 
-	msgs, err := c.consumerChannels.mainChannel.Consume(
-		c.config.queue.Name, // queue
-		"",                  // consumer
-		false,               // auto-ack
-		false,               // exclusive
-		false,               // no-local
-		false,               // no-wait
-		nil,                 // args
+	msgs, err := mainChannel.Consume(
+		queueName,                // queue
+		"",                       // consumer
+		false,                    // auto-ack
+		c.config.queue.Exclusive, // exclusive
+		false,                    // no-local
+		false,                    // no-wait
+		nil,                      // args
 	)
 
+	var amqpErr *amqp.Error
+	if c.config.queue.Exclusive && errors.As(err, &amqpErr) && amqpErr.Code == amqp.AccessRefused {
+		// another consumer has the queue, rabbit closes the channel and consuming is tried again on the re-opened one
+		c.config.Logger.Info(fmt.Sprintf(`another consumer is consuming "%s" exclusively, standing by`, c.config.queue.Name))
+		return nil
+	}
+
 	if err != nil {
-		return err
+		return newSetupError(StepConsume, queueName, err)
 	}
 
 	c.config.Logger.Info("Queues bound, good to go")
 
+	if c.config.queue.Exclusive {
+		c.setActive(true)
+	}
+
 	go func() {
+		defer func() {
+			// a consumer that already moved on to a re-opened channel is not affected by the old one closing
+			if c.consumerChannels.isConsuming(mainChannel) {
+				c.setActive(false)
+			}
+		}()
+
 		for d := range msgs {
-			c.Messages <- &amqpMessage{
+			if c.config.queue.SingleActive {
+				c.setActive(true)
+			}
+
+			_, dleChannel, retryChannel := c.consumerChannels.get()
+			message := &amqpMessage{
 				delivery:          d,
-				dleChannel:        c.consumerChannels.dleChannel,
-				retryChannel:      c.consumerChannels.retryChannel,
+				dleChannel:        dleChannel,
+				retryChannel:      retryChannel,
 				retryLimit:        c.config.queue.RetryLimit,
 				retryExchangeName: c.config.exchange.RetryLater,
 				dleExchangeName:   c.config.exchange.DLE,
+				queueType:         c.config.queue.Type,
+				discardOnNack:     c.config.queue.Ephemeral,
+			}
+			if c.config.queue.Ephemeral {
+				message.retryLimit = 0
+			}
+			if c.config.queue.RetryTTLPerMessage {
+				message.retryExpiration = strconv.Itoa(int(c.config.queue.RequeueTTL))
+			}
+			select {
+			case c.Messages <- message:
+			case <-c.ctx.Done():
+				return
 			}
 		}
 	}()
 
 	return nil
 }
-
-func assertAndBindQueue(ch *amqp.Channel, queueName, exchangeName string, patterns []string, arguments map[string]interface{}) error {
-	q, err := ch.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		false,     // delete when usused
-		false,     // exclusive
-		false,     // no-wait
-		arguments, // arguments
-	)
-
-	if err != nil {
-		return err
-	}
-
-	for _, pattern := range patterns {
-		if err := ch.QueueBind(q.Name, pattern, exchangeName, false, nil); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
@@ -0,0 +1,125 @@
+package runamqp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestAllQueuesReady(t *testing.T) {
+	signal := func(err error) <-chan error {
+		ch := make(chan error, 1)
+		ch <- err
+		return ch
+	}
+
+	if err := allQueuesReady(context.Background(), signal(nil), signal(nil), signal(nil)); err != nil {
+		t.Error("expected all queues to be ready but got", err)
+	}
+
+	declareErr := newSetupError(StepDeclare, "a queue", errors.New("oops"))
+
+	if err := allQueuesReady(context.Background(), signal(nil), signal(declareErr), signal(nil)); err != declareErr {
+		t.Error("expected the error of the queue that failed but got", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := allQueuesReady(ctx, signal(nil), make(chan error)); !errors.Is(err, context.Canceled) {
+		t.Error("expected to stop waiting when the context is done but got", err)
+	}
+}
+
+func TestConsumerChannelsConcurrentAccess(t *testing.T) {
+	channels := new(consumerChannels)
+	ch := new(amqp.Channel)
+
+	const goroutines = 50
+	var wg sync.WaitGroup
+	wg.Add(goroutines * 2)
+
+	started := make(chan bool, goroutines)
+
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			channels.setMain(ch)
+			channels.setDLE(ch)
+			channels.setRetry(ch)
+		}()
+		go func() {
+			defer wg.Done()
+			channels.get()
+			started <- channels.startConsuming(ch)
+		}()
+	}
+
+	wg.Wait()
+	close(started)
+
+	numberOfStarts := 0
+	for s := range started {
+		if s {
+			numberOfStarts++
+		}
+	}
+
+	if numberOfStarts != 1 {
+		t.Error("expected to start consuming from the channel exactly once but it was", numberOfStarts)
+	}
+}
+
+func TestPublisherReadinessConcurrentAccess(t *testing.T) {
+	publisher := new(Publisher)
+
+	const goroutines = 50
+	var wg sync.WaitGroup
+	wg.Add(goroutines * 2)
+
+	for i := 0; i < goroutines; i++ {
+		go func(ready bool) {
+			defer wg.Done()
+			publisher.publishReady.Store(ready)
+		}(i%2 == 0)
+		go func() {
+			defer wg.Done()
+			publisher.IsReady()
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestActiveChangesKeepsTheLatestChange(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{SingleActiveConsumer: true})
+	consumer := &Consumer{config: config, ActiveChanges: make(chan bool, 1)}
+
+	const goroutines = 50
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+
+	for i := 0; i < goroutines; i++ {
+		go func(active bool) {
+			defer wg.Done()
+			consumer.setActive(active)
+		}(i%2 == 0)
+	}
+
+	wg.Wait()
+
+	if latest := <-consumer.ActiveChanges; latest != consumer.IsActive() {
+		t.Error("expected the unread change to be the latest one")
+	}
+
+	consumer.setActive(consumer.IsActive())
+
+	select {
+	case change := <-consumer.ActiveChanges:
+		t.Error("did not expect a change when the consumer stays as it is", change)
+	default:
+	}
+}
@@ -1,12 +1,14 @@
 package runamqp
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"testing"
 	"time"
 
 	"github.com/mergermarket/run-amqp/helpers"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 var (
@@ -416,6 +418,236 @@ func TestPublishToASpecificQueue(t *testing.T) {
 	}
 }
 
+func TestQuorumQueueConsumer(t *testing.T) {
+	t.Parallel()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{
+		QueueType: Quorum,
+		Retries:   1,
+	})
+
+	consumer := NewConsumer(consumerConfig)
+	assertReady(t, consumer.QueuesBound)
+
+	dlqConsumer := NewConsumer(newTestConsumerConfig(t, consumerConfigOptions{
+		ExchangeName: consumerConfig.exchange.DLE,
+	}))
+	assertReady(t, dlqConsumer.QueuesBound)
+
+	publisher, err := NewPublisher(consumerConfig.NewPublisherConfig())
+	assertNoError(t, err)
+
+	assertNoError(t, publisher.Publish(payload, nil))
+
+	message := getMessage(t, consumer.Messages)
+	assertNoError(t, message.Requeue("try again"))
+
+	message = getMessage(t, consumer.Messages)
+	assertNoError(t, message.Requeue("give up"))
+
+	dlqMessage := getMessage(t, dlqConsumer.Messages)
+	if string(dlqMessage.Body()) != string(payload) {
+		t.Fatal("failed to get the dlq'd message from the quorum queue")
+	}
+	assertNoError(t, dlqMessage.Ack())
+}
+
+func TestExclusiveConsumerTakesOver(t *testing.T) {
+	t.Parallel()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+	consumerConfig.queue.Exclusive = true
+
+	active := NewConsumer(consumerConfig)
+	assertReady(t, active.QueuesBound)
+	assertActiveChange(t, active.ActiveChanges, true)
+
+	standby := NewConsumer(consumerConfig)
+	assertReady(t, standby.QueuesBound)
+
+	if standby.IsActive() {
+		t.Fatal("did not expect the standby consumer to be active")
+	}
+
+	active.Close()
+
+	assertActiveChange(t, standby.ActiveChanges, true)
+	standby.Close()
+}
+
+func assertActiveChange(t *testing.T, ch <-chan bool, expected bool) {
+	t.Helper()
+	select {
+	case active := <-ch:
+		if active != expected {
+			t.Fatal("expected the consumer to change to active", expected)
+		}
+	case <-time.After(45 * time.Second):
+		t.Fatal("timed out waiting for the consumer to change to active", expected)
+	}
+}
+
+func TestHeadersExchangeRoutesOnHeaders(t *testing.T) {
+	t.Parallel()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{ExchangeType: Headers})
+	consumerConfig.queue.HeaderBindings = []HeaderBinding{{Match: MatchAny, Headers: map[string]interface{}{"format": "pdf", "type": "report"}}}
+
+	consumer := NewConsumer(consumerConfig)
+	assertReady(t, consumer.QueuesBound)
+
+	publisher, err := NewPublisher(consumerConfig.NewPublisherConfig())
+	assertNoError(t, err)
+
+	assertNoError(t, publisher.Publish([]byte("ignored"), &PublishOptions{Headers: map[string]interface{}{"format": "csv"}}))
+	assertNoError(t, publisher.Publish(payload, &PublishOptions{Headers: map[string]interface{}{"format": "pdf"}}))
+
+	message := getMessage(t, consumer.Messages)
+	if string(message.Body()) != string(payload) {
+		t.Fatal("expected only the message with matching headers, got", string(message.Body()))
+	}
+
+	assertNoError(t, message.Requeue("try again"))
+
+	message = getMessage(t, consumer.Messages)
+	if string(message.Body()) != string(payload) {
+		t.Fatal("expected the requeued message to be routed back to the queue")
+	}
+	assertNoError(t, message.Ack())
+}
+
+func TestExchangeToExchangeBindings(t *testing.T) {
+	t.Parallel()
+
+	upstream := "test-upstream-" + randomString(5)
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+	consumerConfig.exchange.Bindings = []ExchangeBinding{{Source: upstream, Type: Fanout}}
+
+	consumer := NewConsumer(consumerConfig)
+	assertReady(t, consumer.QueuesBound)
+
+	publisherConfig := NewPublisherConfig{URL: testRabbitURI, ExchangeName: upstream, ExchangeType: Fanout, Logger: helpers.NewTestLogger(t)}
+	publisher, err := NewPublisher(publisherConfig.Config())
+	assertNoError(t, err)
+
+	assertNoError(t, publisher.Publish(payload, nil))
+
+	message := getMessage(t, consumer.Messages)
+	if string(message.Body()) != string(payload) {
+		t.Fatal("expected the message published upstream to reach the queue")
+	}
+	assertNoError(t, message.Ack())
+}
+
+func TestAlternateExchangeKeepsUnroutableMessages(t *testing.T) {
+	t.Parallel()
+
+	alternateExchange := "test-unroutable-" + randomString(5)
+
+	publisherConfig := NewPublisherConfig{
+		URL:               testRabbitURI,
+		ExchangeName:      "test-routed-" + randomString(5),
+		ExchangeType:      Direct,
+		Logger:            helpers.NewTestLogger(t),
+		AlternateExchange: alternateExchange,
+	}
+	publisher, err := NewPublisher(publisherConfig.Config())
+	assertNoError(t, err)
+
+	assertNoError(t, publisher.Publish(payload, &PublishOptions{Pattern: "nobody-listens"}))
+
+	conn, err := amqp.Dial(testRabbitURI)
+	assertNoError(t, err)
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	assertNoError(t, err)
+
+	delivery, ok, err := ch.Get(alternateExchange, true)
+	assertNoError(t, err)
+
+	if !ok || string(delivery.Body) != string(payload) {
+		t.Fatal("expected the unroutable message in the queue of the alternate exchange")
+	}
+}
+
+func TestEphemeralConsumersEachGetEveryMessage(t *testing.T) {
+	t.Parallel()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+	consumerConfig.queue.Ephemeral = true
+
+	first := NewConsumer(consumerConfig)
+	assertReady(t, first.QueuesBound)
+	defer first.Close()
+
+	second := NewConsumer(consumerConfig)
+	assertReady(t, second.QueuesBound)
+	defer second.Close()
+
+	publisher, err := NewPublisher(consumerConfig.NewPublisherConfig())
+	assertNoError(t, err)
+
+	assertNoError(t, publisher.Publish(payload, nil))
+
+	for _, consumer := range []*Consumer{first, second} {
+		message := getMessage(t, consumer.Messages)
+		if string(message.Body()) != string(payload) {
+			t.Error("expected every ephemeral consumer to get the message but got", string(message.Body()))
+		}
+		assertNoError(t, message.Ack())
+	}
+}
+
+func TestClosingAnEphemeralConsumerOfAClientDeletesItsQueue(t *testing.T) {
+	t.Parallel()
+
+	client := newTestClient(t, false)
+	defer client.Close()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+	consumerConfig.queue.Ephemeral = true
+
+	consumer := client.NewConsumer(consumerConfig)
+	assertReady(t, consumer.QueuesBound)
+
+	name := consumer.consumerChannels.queueName("")
+	consumer.Close()
+
+	conn, err := amqp.Dial(testRabbitURI)
+	assertNoError(t, err)
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	assertNoError(t, err)
+
+	_, err = ch.QueueDeclarePassive(name, false, true, true, nowait, nil)
+
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		t.Error("expected the ephemeral queue to be deleted while the connection of the client is still open, got", err)
+	}
+}
+
+func TestEphemeralConsumerOnlyDeclaresItsExchange(t *testing.T) {
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+	consumerConfig.queue.Ephemeral = true
+
+	topology, err := consumerConfig.Topology()
+	assertNoError(t, err)
+
+	if len(topology.Queues) != 0 || len(topology.Bindings) != 0 || len(topology.Exchanges) != 1 {
+		t.Error("expected only the exchange to be declared", topology)
+	}
+
+	consumerConfig.queue.Type = Quorum
+
+	if _, err := consumerConfig.mainQueueArguments(); err == nil {
+		t.Error("expected ephemeral quorum queues to be rejected")
+	}
+}
+
 func randomString(n int) string {
 	b := make([]rune, n)
 	for i := range b {
@@ -432,6 +664,7 @@ type consumerConfigOptions struct {
 	SetNoRetries bool
 	RequeueTTL   int16
 	ServiceName  string
+	QueueType    QueueType
 }
 
 func newTestConsumerConfig(t *testing.T, config consumerConfigOptions) ConsumerConfig {
@@ -478,6 +711,7 @@ func newTestConsumerConfig(t *testing.T, config consumerConfigOptions) ConsumerC
 			RequeueLimit: config.Retries,
 			ServiceName:  config.ServiceName,
 			Prefetch:     defaultPrefetch,
+			QueueType:    config.QueueType,
 		}
 	return c.Config()
 }
@@ -0,0 +1,450 @@
+package runamqp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Definitions is the part of the RabbitMQ definitions format about exchanges, queues and bindings, as exported and imported by the management plugin
+type Definitions struct {
+	Exchanges []ExchangeDefinition `json:"exchanges"`
+	Queues    []QueueDefinition    `json:"queues"`
+	Bindings  []BindingDefinition  `json:"bindings"`
+}
+
+// ExchangeDefinition is an exchange in the definitions format
+type ExchangeDefinition struct {
+	Name       string                 `json:"name"`
+	VHost      string                 `json:"vhost"`
+	Type       string                 `json:"type"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Internal   bool                   `json:"internal"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// QueueDefinition is a queue in the definitions format
+type QueueDefinition struct {
+	Name  string `json:"name"`
+	VHost string `json:"vhost"`
+	// Type is set by rabbit from the x-queue-type argument, or the default queue type of the vhost when there is none
+	Type       string                 `json:"type,omitempty"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// BindingDefinition is a binding in the definitions format
+type BindingDefinition struct {
+	Source          string                 `json:"source"`
+	VHost           string                 `json:"vhost"`
+	Destination     string                 `json:"destination"`
+	DestinationType string                 `json:"destination_type"`
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+}
+
+// TopologyConfig is a config which knows the topology it declares, such as a ConsumerConfig, a PublisherConfig or a StreamConsumerConfig
+type TopologyConfig interface {
+	Topology() (Topology, error)
+}
+
+// ExportDefinitions renders the exchanges, queues and bindings the configs declare as a RabbitMQ definitions file for vhost, which can be imported with the management plugin. External exchanges are left out, as they are declared by someone else.
+func ExportDefinitions(vhost string, configs ...TopologyConfig) ([]byte, error) {
+	var topology Topology
+
+	for _, config := range configs {
+		t, err := config.Topology()
+		if err != nil {
+			return nil, err
+		}
+		topology = topology.merge(t)
+	}
+
+	if err := topology.Validate(); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(topology.definitions(vhost), "", "  ")
+}
+
+func (t Topology) definitions(vhost string) Definitions {
+	definitions := Definitions{
+		Exchanges: []ExchangeDefinition{},
+		Queues:    []QueueDefinition{},
+		Bindings:  []BindingDefinition{},
+	}
+
+	for _, e := range t.Exchanges {
+		if e.External {
+			continue
+		}
+		definitions.Exchanges = append(definitions.Exchanges, ExchangeDefinition{
+			Name:       e.Name,
+			VHost:      vhost,
+			Type:       string(e.Type),
+			Durable:    durable,
+			AutoDelete: autoDelete,
+			Internal:   internal,
+			Arguments:  definitionArguments(e.Arguments),
+		})
+	}
+
+	for _, q := range t.Queues {
+		queueType, _ := q.Arguments["x-queue-type"].(string)
+		if queueType == "" {
+			queueType = string(Classic)
+		}
+
+		definitions.Queues = append(definitions.Queues, QueueDefinition{
+			Name:       q.Name,
+			VHost:      vhost,
+			Type:       queueType,
+			Durable:    durable,
+			AutoDelete: autoDelete,
+			Arguments:  definitionArguments(q.Arguments),
+		})
+	}
+
+	for _, b := range t.Bindings {
+		destinationType := "queue"
+		if b.ToExchange {
+			destinationType = "exchange"
+		}
+		definitions.Bindings = append(definitions.Bindings, BindingDefinition{
+			Source:          b.Source,
+			VHost:           vhost,
+			Destination:     b.Destination,
+			DestinationType: destinationType,
+			RoutingKey:      b.Pattern,
+			Arguments:       definitionArguments(b.Arguments),
+		})
+	}
+
+	return definitions
+}
+
+// definitionArguments is never nil, as the management plugin exports empty arguments as {}
+func definitionArguments(arguments amqp.Table) map[string]interface{} {
+	definition := map[string]interface{}{}
+	for key, value := range arguments {
+		definition[key] = value
+	}
+	return definition
+}
+
+// ImportedConfigs are the builders of the configs found in a definitions file. Only what is declared on the broker can be imported, so the URL, Logger, Prefetch and RequeueLimit still have to be filled in.
+type ImportedConfigs struct {
+	Consumers  []NewConsumerConfig
+	Publishers []NewPublisherConfig
+}
+
+// ImportDefinitions builds configs from a RabbitMQ definitions file. A consumer is found for every queue named after the "<exchange>-for-<service>" scheme of NewConsumerConfig which has its DLQ, and a publisher for every exchange which is not a DLE, retry or alternate exchange of a consumer. The retry queue of a consumer is the queue dead-lettering to an exchange bound to its queue, so it is found whatever it is named. When it has no TTL of its own the consumer is given StableRetryNaming, and its RequeueTTL has to be filled in as well.
+func ImportDefinitions(data []byte) (ImportedConfigs, error) {
+	var definitions Definitions
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&definitions); err != nil {
+		return ImportedConfigs{}, fmt.Errorf("failed to parse the definitions: %v", err)
+	}
+
+	exchanges := map[string]ExchangeDefinition{}
+	for _, e := range definitions.Exchanges {
+		exchanges[e.Name] = e
+	}
+
+	queues := map[string]QueueDefinition{}
+	for _, q := range definitions.Queues {
+		queues[q.Name] = q
+	}
+
+	var imported ImportedConfigs
+	generated := map[string]bool{}
+
+	for _, q := range definitions.Queues {
+		consumer, made, ok, err := importConsumer(q, definitions, exchanges, queues)
+		if err != nil {
+			return ImportedConfigs{}, err
+		}
+		if !ok {
+			continue
+		}
+
+		for _, name := range made {
+			generated[name] = true
+		}
+		if consumer.AlternateExchange != "" {
+			generated[consumer.AlternateExchange] = true
+		}
+
+		imported.Consumers = append(imported.Consumers, consumer)
+	}
+
+	for _, e := range definitions.Exchanges {
+		if generated[e.Name] || e.Name == "" || strings.HasPrefix(e.Name, "amq.") {
+			continue
+		}
+
+		arguments, alternateExchange := exchangeDefinitionArguments(e)
+
+		imported.Publishers = append(imported.Publishers, NewPublisherConfig{
+			ExchangeName:      e.Name,
+			ExchangeType:      ExchangeType(e.Type),
+			ExchangeArguments: arguments,
+			AlternateExchange: alternateExchange,
+			ExchangeBindings:  importExchangeBindings(e.Name, definitions),
+		})
+	}
+
+	return imported, nil
+}
+
+// importConsumer returns the consumer of q along with the names of the exchanges made for it, which are not imported as publishers
+func importConsumer(q QueueDefinition, definitions Definitions, exchanges map[string]ExchangeDefinition, queues map[string]QueueDefinition) (NewConsumerConfig, []string, bool, error) {
+	exchangeName, serviceName, found := strings.Cut(q.Name, "-for-")
+	if !found {
+		return NewConsumerConfig{}, nil, false, nil
+	}
+
+	e, exchangeFound := exchanges[exchangeName]
+	dlq, dlqFound := queues[q.Name+"-dlq"]
+	if !exchangeFound || !dlqFound {
+		return NewConsumerConfig{}, nil, false, nil
+	}
+
+	arguments, alternateExchange := exchangeDefinitionArguments(e)
+
+	consumer := NewConsumerConfig{
+		ExchangeName:      exchangeName,
+		ExchangeType:      ExchangeType(e.Type),
+		ServiceName:       serviceName,
+		ExchangeArguments: arguments,
+		AlternateExchange: alternateExchange,
+		ExchangeBindings:  importExchangeBindings(exchangeName, definitions),
+	}
+
+	for _, b := range definitions.Bindings {
+		if b.Source != exchangeName || b.Destination != q.Name || b.DestinationType != "queue" {
+			continue
+		}
+		if consumer.ExchangeType == Headers {
+			consumer.HeaderBindings = append(consumer.HeaderBindings, importHeaderBinding(b.Arguments))
+		} else {
+			consumer.Patterns = append(consumer.Patterns, b.RoutingKey)
+		}
+	}
+
+	made := sourcesBoundTo(dlq.Name, definitions)
+
+	retryQueues := retryQueuesOf(q.Name, exchangeName, definitions)
+	if len(retryQueues) > 1 {
+		names := make([]string, len(retryQueues))
+		for i, retryQueue := range retryQueues {
+			names[i] = retryQueue.Name
+		}
+		return NewConsumerConfig{}, nil, false, fmt.Errorf(`the queue "%s" has more than one retry queue, delete the ones no longer used: %s`, q.Name, strings.Join(names, ", "))
+	}
+
+	for _, retryQueue := range retryQueues {
+		retryNow, _ := retryQueue.Arguments["x-dead-letter-exchange"].(string)
+		made = append(append(made, retryNow), sourcesBoundTo(retryQueue.Name, definitions)...)
+
+		if ttl, ok := intArgument(retryQueue.Arguments["x-message-ttl"]); ok {
+			consumer.RequeueTTL = int16(ttl)
+		} else {
+			consumer.Naming = StableRetryNaming{}
+		}
+		consumer.RetryQueueLimits = importQueueLimits(retryQueue.Arguments)
+		consumer.RetryQueueLimits.MessageTTL = 0
+	}
+
+	consumer.DLQLimits = importQueueLimits(dlq.Arguments)
+
+	args := q.Arguments
+	consumer.QueueLimits = importQueueLimits(args)
+
+	if priority, ok := intArgument(args["x-max-priority"]); ok {
+		consumer.MaxPriority = uint8(priority)
+	}
+
+	queueType, _ := args["x-queue-type"].(string)
+	if queueType == "" {
+		queueType = q.Type
+	}
+	if QueueType(queueType) != Classic {
+		consumer.QueueType = QueueType(queueType)
+	}
+
+	if limit, ok := intArgument(args["x-delivery-limit"]); ok {
+		consumer.DeliveryLimit = int(limit)
+	}
+
+	if strategy, ok := args["x-dead-letter-strategy"].(string); ok {
+		consumer.DeadLetterStrategy = DeadLetterStrategy(strategy)
+	}
+
+	if singleActive, ok := args["x-single-active-consumer"].(bool); ok {
+		consumer.SingleActiveConsumer = singleActive
+	}
+
+	// the queue dead-letters to the DLE for a delivery limit or overflow, otherwise it only does so for expired messages
+	_, deadLetters := args["x-dead-letter-exchange"].(string)
+	consumer.DeadLetterExpired = deadLetters && consumer.DeliveryLimit == 0 && consumer.QueueLimits.Overflow != RejectPublishDLX
+
+	return consumer, made, true, nil
+}
+
+// retryQueuesOf returns the queues dead-lettering to an exchange bound to the queue named queue, other than the one it consumes
+func retryQueuesOf(queue, exchangeName string, definitions Definitions) []QueueDefinition {
+	boundTo := map[string]bool{}
+	for _, b := range definitions.Bindings {
+		if b.Destination == queue && b.DestinationType == "queue" && b.Source != exchangeName {
+			boundTo[b.Source] = true
+		}
+	}
+
+	var retryQueues []QueueDefinition
+	for _, candidate := range definitions.Queues {
+		if deadLetterExchange, _ := candidate.Arguments["x-dead-letter-exchange"].(string); candidate.Name != queue && boundTo[deadLetterExchange] {
+			retryQueues = append(retryQueues, candidate)
+		}
+	}
+	return retryQueues
+}
+
+// sourcesBoundTo returns the exchanges bound to the queue named queue
+func sourcesBoundTo(queue string, definitions Definitions) []string {
+	var sources []string
+	for _, b := range definitions.Bindings {
+		if b.Destination == queue && b.DestinationType == "queue" && b.Source != "" {
+			sources = append(sources, b.Source)
+		}
+	}
+	return sources
+}
+
+func exchangeDefinitionArguments(e ExchangeDefinition) (map[string]interface{}, string) {
+	var arguments map[string]interface{}
+	alternateExchange, _ := e.Arguments["alternate-exchange"].(string)
+
+	for key, value := range e.Arguments {
+		if key == "alternate-exchange" {
+			continue
+		}
+		if arguments == nil {
+			arguments = map[string]interface{}{}
+		}
+		arguments[key] = importedValue(value)
+	}
+
+	return arguments, alternateExchange
+}
+
+func importExchangeBindings(exchangeName string, definitions Definitions) []ExchangeBinding {
+	var bindings []ExchangeBinding
+	for _, b := range definitions.Bindings {
+		if b.DestinationType != "exchange" {
+			continue
+		}
+		switch exchangeName {
+		case b.Destination:
+			bindings = append(bindings, ExchangeBinding{Source: b.Source, Patterns: []string{b.RoutingKey}, Arguments: importedArguments(b.Arguments)})
+		case b.Source:
+			bindings = append(bindings, ExchangeBinding{Destination: b.Destination, Patterns: []string{b.RoutingKey}, Arguments: importedArguments(b.Arguments)})
+		}
+	}
+	return bindings
+}
+
+func importHeaderBinding(arguments map[string]interface{}) HeaderBinding {
+	binding := HeaderBinding{Headers: map[string]interface{}{}}
+
+	keys := make([]string, 0, len(arguments))
+	for key := range arguments {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == "x-match" {
+			binding.Match = HeaderMatch(fmt.Sprint(arguments[key]))
+			continue
+		}
+		binding.Headers[key] = importedValue(arguments[key])
+	}
+
+	return binding
+}
+
+func importQueueLimits(arguments map[string]interface{}) QueueLimits {
+	var limits QueueLimits
+
+	if maxLength, ok := intArgument(arguments["x-max-length"]); ok {
+		limits.MaxLength = int(maxLength)
+	}
+
+	if maxLengthBytes, ok := intArgument(arguments["x-max-length-bytes"]); ok {
+		limits.MaxLengthBytes = maxLengthBytes
+	}
+
+	// an unbounded queue only overflows for the at-least-once dead letter strategy, which sets it itself
+	if overflow, ok := arguments["x-overflow"].(string); ok && limits.bounded() {
+		limits.Overflow = Overflow(overflow)
+	}
+
+	if ttl, ok := intArgument(arguments["x-message-ttl"]); ok {
+		limits.MessageTTL = time.Duration(ttl) * time.Millisecond
+	}
+
+	if expires, ok := intArgument(arguments["x-expires"]); ok {
+		limits.Expires = time.Duration(expires) * time.Millisecond
+	}
+
+	return limits
+}
+
+func importedArguments(arguments map[string]interface{}) map[string]interface{} {
+	if len(arguments) == 0 {
+		return nil
+	}
+	imported := map[string]interface{}{}
+	for key, value := range arguments {
+		imported[key] = importedValue(value)
+	}
+	return imported
+}
+
+// importedValue turns the numbers of a definitions file into int64 or float64, so they can be sent to rabbit
+func importedValue(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	if i, err := number.Int64(); err == nil {
+		return i
+	}
+	f, _ := number.Float64()
+	return f
+}
+
+func intArgument(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,218 @@
+package runamqp
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/run-amqp/helpers"
+)
+
+func TestExportDefinitions(t *testing.T) {
+	consumerConfig := newQueueTestConfig(t, NewConsumerConfig{
+		Patterns:    []string{"a.*"},
+		MaxPriority: 5,
+	})
+
+	data, err := ExportDefinitions("/", consumerConfig, consumerConfig.NewPublisherConfig())
+	assertNoError(t, err)
+
+	var definitions Definitions
+	assertNoError(t, json.Unmarshal(data, &definitions))
+
+	if len(definitions.Exchanges) != 4 || len(definitions.Queues) != 3 || len(definitions.Bindings) != 4 {
+		t.Fatalf("expected the exchanges, queues and bindings of the consumer once each\n%s", data)
+	}
+
+	for _, q := range definitions.Queues {
+		if q.VHost != "/" || !q.Durable || q.Arguments == nil {
+			t.Error("expected a durable queue in the vhost with arguments", q)
+		}
+		if q.Name == consumerConfig.queue.Name && q.Arguments["x-max-priority"] != float64(5) {
+			t.Error("expected the arguments of the main queue", q.Arguments)
+		}
+	}
+}
+
+func TestImportDefinitionsRoundTrips(t *testing.T) {
+	original := NewConsumerConfig{
+		URL:                  testRabbitURI,
+		ExchangeName:         "orders",
+		ExchangeType:         Topic,
+		Patterns:             []string{"order.created", "order.cancelled"},
+		Logger:               helpers.NewTestLogger(t),
+		RequeueTTL:           500,
+		ServiceName:          "billing",
+		QueueType:            Quorum,
+		DeliveryLimit:        5,
+		DeadLetterStrategy:   AtLeastOnce,
+		SingleActiveConsumer: true,
+		DLQLimits:            QueueLimits{MaxLength: 1000, MessageTTL: 24 * time.Hour},
+		AlternateExchange:    "orders-unroutable",
+		ExchangeBindings:     []ExchangeBinding{{Source: "events", Type: Topic, Patterns: []string{"order.#"}}},
+	}
+
+	exported, err := ExportDefinitions("/", original.Config())
+	assertNoError(t, err)
+
+	imported, err := ImportDefinitions(exported)
+	assertNoError(t, err)
+
+	if len(imported.Consumers) != 1 {
+		t.Fatal("expected one consumer", imported.Consumers)
+	}
+
+	consumer := imported.Consumers[0]
+
+	if consumer.ExchangeName != "orders" || consumer.ServiceName != "billing" || consumer.RequeueTTL != 500 || consumer.DeliveryLimit != 5 {
+		t.Error("expected the consumer to be imported", consumer)
+	}
+
+	publishers := map[string]bool{}
+	for _, p := range imported.Publishers {
+		publishers[p.ExchangeName] = true
+	}
+
+	if !publishers["orders"] || !publishers["events"] || len(publishers) != 2 {
+		t.Error("expected publishers for the exchanges which were not made for the consumer", publishers)
+	}
+
+	consumer.URL = original.URL
+	consumer.Logger = original.Logger
+	consumer.ExchangeBindings[0].Type = Topic
+
+	reexported, err := ExportDefinitions("/", consumer.Config())
+	assertNoError(t, err)
+
+	var want, got Definitions
+	assertNoError(t, json.Unmarshal(exported, &want))
+	assertNoError(t, json.Unmarshal(reexported, &got))
+
+	if !sameDefinitions(want, got) {
+		t.Errorf("expected the imported consumer to export the same definitions\n%s\n%s", exported, reexported)
+	}
+}
+
+func TestImportDefinitionsRoundTripsTheRetryNamingAndExpiredMessages(t *testing.T) {
+	original := NewConsumerConfig{
+		URL:               testRabbitURI,
+		ExchangeName:      "orders",
+		ExchangeType:      Topic,
+		Patterns:          []string{"order.created"},
+		Logger:            helpers.NewTestLogger(t),
+		RequeueTTL:        500,
+		ServiceName:       "billing",
+		Naming:            StableRetryNaming{},
+		DeadLetterExpired: true,
+	}
+
+	exported, err := ExportDefinitions("/", original.Config())
+	assertNoError(t, err)
+
+	imported, err := ImportDefinitions(exported)
+	assertNoError(t, err)
+
+	if len(imported.Consumers) != 1 || len(imported.Publishers) != 1 {
+		t.Fatal("expected the consumer and the exchange it consumes only", imported)
+	}
+
+	consumer := imported.Consumers[0]
+
+	if !consumer.DeadLetterExpired || consumer.Naming != (StableRetryNaming{}) {
+		t.Error("expected the consumer to dead-letter expired messages with stable retry names", consumer)
+	}
+
+	consumer.URL = original.URL
+	consumer.Logger = original.Logger
+	consumer.RequeueTTL = original.RequeueTTL
+
+	reexported, err := ExportDefinitions("/", consumer.Config())
+	assertNoError(t, err)
+
+	var want, got Definitions
+	assertNoError(t, json.Unmarshal(exported, &want))
+	assertNoError(t, json.Unmarshal(reexported, &got))
+
+	if !sameDefinitions(want, got) {
+		t.Errorf("expected the imported consumer to export the same definitions\n%s\n%s", exported, reexported)
+	}
+}
+
+func TestImportDefinitionsUsesTheQueueType(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{})
+
+	exported, err := ExportDefinitions("/", config)
+	assertNoError(t, err)
+
+	var definitions Definitions
+	assertNoError(t, json.Unmarshal(exported, &definitions))
+
+	// a vhost with quorum as its default queue type declares quorum queues without the argument
+	for i := range definitions.Queues {
+		definitions.Queues[i].Type = string(Quorum)
+	}
+
+	data, err := json.Marshal(definitions)
+	assertNoError(t, err)
+
+	imported, err := ImportDefinitions(data)
+	assertNoError(t, err)
+
+	if len(imported.Consumers) != 1 || imported.Consumers[0].QueueType != Quorum {
+		t.Error("expected a quorum queue consumer", imported.Consumers)
+	}
+}
+
+func TestImportDefinitionsFailsWithSeveralRetryQueues(t *testing.T) {
+	consumer := func(requeueTTL int16) ConsumerConfig {
+		c := NewConsumerConfig{URL: testRabbitURI, ExchangeName: "orders", ExchangeType: Topic, ServiceName: "billing", Patterns: []string{"#"}, Logger: helpers.NewTestLogger(t), RequeueTTL: requeueTTL}
+		return c.Config()
+	}
+
+	// the retry queue of the old RequeueTTL was left behind
+	current, old := consumer(500), consumer(1000)
+
+	exported, err := ExportDefinitions("/", current, old)
+	assertNoError(t, err)
+
+	if _, err := ImportDefinitions(exported); err == nil || !strings.Contains(err.Error(), old.queue.RetryLater) {
+		t.Error("expected an error naming the retry queues but got", err)
+	}
+}
+
+func TestImportDefinitionsFailsOnInvalidJSON(t *testing.T) {
+	if _, err := ImportDefinitions([]byte("{")); err == nil {
+		t.Error("expected an error for definitions which can not be parsed")
+	}
+}
+
+func sameDefinitions(a, b Definitions) bool {
+	index := func(d Definitions) map[string]string {
+		m := map[string]string{}
+		for _, e := range d.Exchanges {
+			j, _ := json.Marshal(e)
+			m["exchange "+e.Name] = string(j)
+		}
+		for _, q := range d.Queues {
+			j, _ := json.Marshal(q)
+			m["queue "+q.Name] = string(j)
+		}
+		for _, b := range d.Bindings {
+			j, _ := json.Marshal(b)
+			m["binding "+string(j)] = string(j)
+		}
+		return m
+	}
+
+	ai, bi := index(a), index(b)
+	if len(ai) != len(bi) {
+		return false
+	}
+	for key, value := range ai {
+		if bi[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package runamqp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DelayMode is how a publisher delays the messages published with PublishAfter and PublishAt
+type DelayMode string
+
+const (
+	// DelayedMessagePlugin publishes delayed messages to an x-delayed-message exchange bound to the exchange, which holds on to them until they are due. It needs the rabbitmq_delayed_message_exchange plugin.
+	DelayedMessagePlugin DelayMode = "plugin"
+
+	// DelayQueues publishes delayed messages to a queue for each delay, from which rabbit dead-letters them to the exchange once their TTL is up. So there are only so many queues, delays are rounded up to the whole second under a minute, the whole minute under an hour, the whole hour under a day and the whole day beyond. Rabbit deletes a queue once it has not been used for longer than its delay.
+	DelayQueues DelayMode = "queues"
+)
+
+// maxDelay is the longest delay the delayed message plugin supports, as x-delay is a 32 bit number of milliseconds
+const maxDelay = (1<<32 - 1) * time.Millisecond
+
+// delayQueueIdle is how long a delay queue is kept once its last message could have been published, it is declared again when it is used after half of that
+const delayQueueIdle = 10 * time.Minute
+
+// DelayedMessage is the type of the exchange provided by the rabbitmq_delayed_message_exchange plugin
+const DelayedMessage ExchangeType = "x-delayed-message"
+
+const delayHeader = "x-delay"
+
+// delayQueueHeader routes a message to the queue for its delay. It can not start with x- as headers exchanges ignore those headers when matching.
+const delayQueueHeader = "run-amqp-delay"
+
+var errNoDelayMode = errors.New("the publisher has no DelayMode to delay messages with")
+
+// PublishAfter publishes a message which is delivered once delay has passed, using the DelayMode of the publisher. Messages with no delay are published straight away. With an Outbox a message which can not be published is stored with the time it is due, and published with what is left of its delay once rabbit is back.
+func (p *Publisher) PublishAfter(msg []byte, delay time.Duration, options *PublishOptions) error {
+	if delay <= 0 {
+		return p.Publish(msg, options)
+	}
+	if p.outbox != nil {
+		return p.publishThroughOutbox(msg, options, delay)
+	}
+	return p.publish(msg, options, delay)
+}
+
+// PublishAt publishes a message which is delivered at the time at, see PublishAfter
+func (p *Publisher) PublishAt(msg []byte, at time.Time, options *PublishOptions) error {
+	return p.PublishAfter(msg, time.Until(at), options)
+}
+
+func (e exchange) delayExchange() string {
+	return e.Name + "-delayed"
+}
+
+// delayTopology is the exchange delayed messages are published to, which is bound to the exchange by the plugin, or routes to the delay queues on the run-amqp-delay header
+func (c PublisherConfig) delayTopology() (Topology, error) {
+	switch c.delay {
+	case "":
+		return Topology{}, nil
+	case DelayedMessagePlugin:
+		return Topology{
+			Exchanges: []ExchangeDeclaration{{Name: c.exchange.delayExchange(), Type: DelayedMessage, Arguments: amqp.Table{"x-delayed-type": string(Topic)}}},
+			Bindings:  []BindingDeclaration{{Source: c.exchange.delayExchange(), Destination: c.exchange.Name, ToExchange: true, Pattern: matchAllPattern}},
+		}, nil
+	case DelayQueues:
+		return Topology{
+			Exchanges: []ExchangeDeclaration{{Name: c.exchange.delayExchange(), Type: Headers}},
+		}, nil
+	default:
+		return Topology{}, newSetupError(StepDeclare, c.exchange.delayExchange(), fmt.Errorf("unrecognised delay mode %s", c.delay))
+	}
+}
+
+// delayQueueTopology is the queue holding the messages delayed by delay, which dead-letters them to the exchange with the routing key they were published with
+func (c PublisherConfig) delayQueueTopology(delay time.Duration) Topology {
+	name := fmt.Sprintf("%s-delay-%dms", c.exchange.Name, delay.Milliseconds())
+	return Topology{
+		Queues: []QueueDeclaration{{Name: name, Arguments: amqp.Table{
+			"x-message-ttl":          delay.Milliseconds(),
+			"x-dead-letter-exchange": c.exchange.Name,
+			// rabbit only counts declaring a queue as using it, so it has to outlive the messages published after the last declare
+			"x-expires": (delay + delayQueueIdle).Milliseconds(),
+		}}},
+		Bindings: []BindingDeclaration{{Source: c.exchange.delayExchange(), Destination: name, Arguments: amqp.Table{
+			"x-match":        string(MatchAll),
+			delayQueueHeader: delay.Milliseconds(),
+		}}},
+	}
+}
+
+// delayBucket rounds delay up to the step of the delay queue it is published to
+func delayBucket(delay time.Duration) time.Duration {
+	step := 24 * time.Hour
+	switch {
+	case delay <= time.Minute:
+		step = time.Second
+	case delay <= time.Hour:
+		step = time.Minute
+	case delay <= 24*time.Hour:
+		step = time.Hour
+	}
+	return (delay + step - 1).Truncate(step)
+}
+
+// delayQueues remembers when a publisher last declared each delay queue, so they are only declared again before rabbit would expire them
+type delayQueues struct {
+	sync.Mutex
+	declared map[time.Duration]time.Time
+}
+
+// declare declares the queue for delay on a channel of the publisher's pool, unless it was recently
+func (d *delayQueues) declare(p *Publisher, delay time.Duration) error {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	if declared, ok := d.declared[delay]; ok && now.Sub(declared) < delayQueueIdle/2 {
+		return nil
+	}
+
+	ch, err := p.channels.Get()
+	if err != nil {
+		return err
+	}
+	defer p.channels.Put(ch)
+
+	if err := p.config.delayQueueTopology(delay).applyWith(ch, p.config.topologyMode, p.connectionManager); err != nil {
+		return err
+	}
+
+	if d.declared == nil {
+		d.declared = map[time.Duration]time.Time{}
+	}
+	d.declared[delay] = now
+
+	// the queues not declared again for a while are redeclared on their next use anyway
+	for queue, declared := range d.declared {
+		if now.Sub(declared) >= delayQueueIdle/2 {
+			delete(d.declared, queue)
+		}
+	}
+
+	return nil
+}
+
+// validDelay returns why a message published to exchangeName with pattern and expiration can not be delayed by delay
+func (p *Publisher) validDelay(delay time.Duration, exchangeName, pattern, expiration string) error {
+	if p.config.delay == "" {
+		return errNoDelayMode
+	}
+
+	if delay > maxDelay {
+		return fmt.Errorf("messages can be delayed by up to %s, not %s", maxDelay, delay)
+	}
+
+	if exchangeName == "" {
+		return fmt.Errorf("messages published to the queue %s can not be delayed", pattern)
+	}
+
+	// rabbit drops the expiration of messages it dead-letters, so they would be delivered early and never expire
+	if expiration != "" && p.config.delay == DelayQueues {
+		return errors.New("messages delayed with DelayQueues can not have a TTL")
+	}
+
+	return nil
+}
+
+// delayed returns where to publish a message delayed by delay, with the headers it is published with
+func (p *Publisher) delayed(delay time.Duration, headers amqp.Table) (string, amqp.Table, error) {
+	if p.config.delay == DelayQueues {
+		delay = delayBucket(delay)
+		if err := p.delayQueues.declare(p, delay); err != nil {
+			return "", nil, fmt.Errorf("failed to declare the queue for messages delayed by %s: %v", delay, err)
+		}
+	}
+
+	withDelay := amqp.Table{}
+	for key, value := range headers {
+		withDelay[key] = value
+	}
+
+	if p.config.delay == DelayQueues {
+		withDelay[delayQueueHeader] = delay.Milliseconds()
+	} else {
+		withDelay[delayHeader] = delay.Milliseconds()
+	}
+
+	return p.config.exchange.delayExchange(), withDelay, nil
+}
@@ -0,0 +1,154 @@
+package runamqp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/run-amqp/helpers"
+)
+
+func newDelayTestConfig(t *testing.T, exchangeName string, mode DelayMode) PublisherConfig {
+	c := NewPublisherConfig{
+		URL:          testRabbitURI,
+		ExchangeName: exchangeName,
+		ExchangeType: Fanout,
+		Logger:       helpers.NewTestLogger(t),
+		DelayMode:    mode,
+	}
+	return c.Config()
+}
+
+func TestDelayedMessagePluginBindsTheDelayedExchange(t *testing.T) {
+	topology, err := newDelayTestConfig(t, "orders", DelayedMessagePlugin).Topology()
+	assertNoError(t, err)
+	assertNoError(t, topology.Validate())
+
+	if len(topology.Exchanges) != 2 || topology.Exchanges[1].Name != "orders-delayed" || topology.Exchanges[1].Type != DelayedMessage {
+		t.Fatal("expected the delayed exchange to be declared", topology.Exchanges)
+	}
+
+	if len(topology.Bindings) != 1 || topology.Bindings[0].Destination != "orders" || !topology.Bindings[0].ToExchange {
+		t.Error("expected the delayed exchange to be bound to the exchange", topology.Bindings)
+	}
+}
+
+func TestDelayQueuesDeadLetterToTheExchange(t *testing.T) {
+	config := newDelayTestConfig(t, "orders", DelayQueues)
+
+	queue := config.delayQueueTopology(5 * time.Second)
+
+	if queue.Queues[0].Name != "orders-delay-5000ms" {
+		t.Error("unexpected delay queue", queue.Queues[0].Name)
+	}
+
+	if queue.Queues[0].Arguments["x-dead-letter-exchange"] != "orders" || queue.Queues[0].Arguments["x-message-ttl"] != int64(5000) {
+		t.Error("expected the queue to dead-letter to the exchange after the delay", queue.Queues[0].Arguments)
+	}
+
+	if queue.Bindings[0].Source != "orders-delayed" || queue.Bindings[0].Arguments[delayQueueHeader] != int64(5000) {
+		t.Error("expected the queue to be bound on the delay", queue.Bindings[0])
+	}
+
+	if queue.Queues[0].Arguments["x-expires"] != (5*time.Second + delayQueueIdle).Milliseconds() {
+		t.Error("expected the queue to expire once it is no longer used", queue.Queues[0].Arguments)
+	}
+}
+
+func TestDelaysAreBucketedSoThereAreFewDelayQueues(t *testing.T) {
+	cases := map[time.Duration]time.Duration{
+		1500 * time.Millisecond:      2 * time.Second,
+		time.Minute:                  time.Minute,
+		61 * time.Second:             2 * time.Minute,
+		59*time.Minute + time.Second: time.Hour,
+		90 * time.Minute:             2 * time.Hour,
+		25 * time.Hour:               48 * time.Hour,
+	}
+
+	for delay, expected := range cases {
+		if bucket := delayBucket(delay); bucket != expected {
+			t.Errorf("expected %s to be delayed by %s but got %s", delay, expected, bucket)
+		}
+	}
+
+	buckets := map[time.Duration]bool{}
+	for delay := time.Duration(0); delay <= maxDelay; delay += 17 * time.Second {
+		buckets[delayBucket(delay)] = true
+	}
+
+	if len(buckets) > 60+60+24+50 {
+		t.Error("expected a bounded number of delay queues but got", len(buckets))
+	}
+}
+
+func TestDelaysLongerThanTheMaximumAreInvalid(t *testing.T) {
+	publisher := &Publisher{config: newDelayTestConfig(t, "orders", DelayQueues)}
+	publisher.publishReady.Store(true)
+
+	if err := publisher.PublishAfter(payload, maxDelay+time.Millisecond, nil); err == nil || !strings.Contains(err.Error(), "delayed by up to") {
+		t.Error("expected the delay to be too long but got", err)
+	}
+}
+
+func TestUnrecognisedDelayModeIsInvalid(t *testing.T) {
+	_, err := newDelayTestConfig(t, "orders", "later").Topology()
+
+	assertSetupError(t, err, StepDeclare)
+}
+
+func TestPublishAfterDelaysTheMessage(t *testing.T) {
+	t.Parallel()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+
+	consumer := NewConsumer(consumerConfig)
+	assertReady(t, consumer.QueuesBound)
+	defer consumer.Close()
+
+	publisherConfig := consumerConfig.NewPublisherConfig()
+	publisherConfig.delay = DelayQueues
+
+	publisher, err := NewPublisher(publisherConfig)
+	assertNoError(t, err)
+	defer publisher.Close()
+
+	published := time.Now()
+	assertNoError(t, publisher.PublishAfter(payload, time.Second, nil))
+
+	message := getMessage(t, consumer.Messages)
+
+	if time.Since(published) < time.Second {
+		t.Error("expected the message to be delayed")
+	}
+	assertNoError(t, message.Ack())
+}
+
+func TestMessagesWithDifferentDelaysAreEachDeliveredOnce(t *testing.T) {
+	t.Parallel()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+
+	consumer := NewConsumer(consumerConfig)
+	assertReady(t, consumer.QueuesBound)
+	defer consumer.Close()
+
+	publisherConfig := consumerConfig.NewPublisherConfig()
+	publisherConfig.delay = DelayQueues
+
+	publisher, err := NewPublisher(publisherConfig)
+	assertNoError(t, err)
+	defer publisher.Close()
+
+	assertNoError(t, publisher.PublishAfter([]byte("sooner"), time.Second, nil))
+	assertNoError(t, publisher.PublishAfter([]byte("later"), 2*time.Second, nil))
+
+	for _, expected := range []string{"sooner", "later"} {
+		message := getMessage(t, consumer.Messages)
+		if string(message.Body()) != expected {
+			t.Error("expected", expected, "but got", string(message.Body()))
+		}
+		assertNoError(t, message.Ack())
+	}
+
+	shouldNotGetMessage(t, consumer.Messages)
+}
@@ -6,11 +6,19 @@ When you create a consumer you will recieve a read-only channel of *Messages whi
 
 Producers allow you to publish content to an exchange with a routing key
 
+Every consumer and publisher made with NewConsumer and NewPublisher has its own connection to rabbit. Use a Client to make them instead so they share a connection, each using their own channels, optionally with a separate connection for publishing.
+
 In addition the library will create dead-letter-exchanges (DLE) and dead-letter-queues according to your configuration.
 
 To get around buffer limits there is also an exchange made to put content into at high load, this is handled for you automatically.
 
+A StreamConsumer reads a stream bound to an exchange instead, a log which keeps its messages so they can be replayed from an offset. Give it an OffsetStore to resume after the last processed message when it restarts.
+
 When you retry you can specify a delay and exchanges are made to facilitate this.
 
+Publishers can also schedule messages with PublishAfter and PublishAt, given a DelayMode to delay them with either the delayed message plugin or a queue for each delay.
+
+Give a publisher an Outbox, such as a FileOutboxStore, and Publish, PublishAfter, PublishAt and PublishBatch store the messages it can not publish while rabbit is unreachable instead of returning an error. They are published once rabbit is back, and Close publishes what is left before closing.
+
 In theory though you shouldn't have to "care" about these details, just use the API provided.
 */
@@ -130,6 +130,14 @@ const entryForm = `
             <legend><span class="number">4</span> Priority (optional)</legend>
             <input type="number" min="0" max="9" name="priority" placeholder="Optional message priority 1-9">
         </fieldset>
+        <fieldset>
+            <legend><span class="number">5</span> Headers (optional)</legend>
+            <input type="text" name="headers" placeholder="key=value,another=value">
+        </fieldset>
+        <fieldset>
+            <legend><span class="number">6</span> TTL (optional)</legend>
+            <input type="text" name="ttl" placeholder="How long the message lasts, such as 30s">
+        </fieldset>
         <input type="submit" value="Send" />
     </form>
 </div>
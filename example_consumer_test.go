@@ -9,17 +9,17 @@ import (
 
 // Example handler is the sort of thing you'll make for your application to process amqp messages
 type ExampleHandler struct {
-	calledWith string
+	calledWith chan string
 }
 
 // Handle is how you implement the MessageHandler interface, what you do with it is up to you
 func (e *ExampleHandler) Handle(msg Message) {
-	e.calledWith = string(msg.Body())
 	err := msg.Ack()
 	if err != nil {
 		// Handle error.
 		return
 	}
+	e.calledWith <- string(msg.Body())
 }
 
 func (e *ExampleHandler) Name() string {
@@ -53,7 +53,7 @@ func ExampleConsumer() {
 	}
 
 	// Create a handler for messages
-	handler := &ExampleHandler{}
+	handler := &ExampleHandler{calledWith: make(chan string, 1)}
 
 	// Tell the consumer to process messages using your handler
 	numberOfWorkers := 10
@@ -80,9 +80,7 @@ func ExampleConsumer() {
 		log.Fatal("Error when Publishing the message")
 	}
 
-	// Wait a little bit!
-	time.Sleep(5 * time.Millisecond)
-
-	fmt.Print(handler.calledWith)
+	// Wait for the handler to get it
+	fmt.Print(<-handler.calledWith)
 	// Output: Hello, world
 }
@@ -19,14 +19,24 @@ const (
 	// Direct should have an explanation from Baktash
 	Direct ExchangeType = "direct"
 
+	// Headers routes on the headers of a message rather than its routing key, queues are bound with HeaderBindings
+	Headers ExchangeType = "headers"
+
+	// ConsistentHash routes messages to the queues by the hash of their routing key, it needs the rabbitmq_consistent_hash_exchange plugin. Use it with Partitions to shard a consumer.
+	ConsistentHash ExchangeType = "x-consistent-hash"
+
 	// Unrecognised is a catch all for exchanges that arent supported
 	Unrecognised ExchangeType = "unrecognised"
 )
 
-// NewExchangeType returns an Exchange type for a given string if it is a valid
+// NewExchangeType returns an Exchange type for a given string if it is a valid. Types starting with x- are provided by plugins, such as x-consistent-hash, and are passed on to rabbit as they are.
 func NewExchangeType(typ string) (ExchangeType, error) {
 	lowercaseType := strings.ToLower(typ)
 
+	if ExchangeType(lowercaseType).isPlugin() {
+		return ExchangeType(lowercaseType), nil
+	}
+
 	switch lowercaseType {
 	case "topic":
 		return Topic, nil
@@ -34,11 +44,91 @@ func NewExchangeType(typ string) (ExchangeType, error) {
 		return Fanout, nil
 	case "direct":
 		return Direct, nil
+	case "headers":
+		return Headers, nil
 	default:
 		return Unrecognised, fmt.Errorf("unrecognised exchange type %s", typ)
 	}
 }
 
+func (t ExchangeType) isPlugin() bool {
+	return len(t) > len("x-") && strings.HasPrefix(string(t), "x-")
+}
+
+// deadLetterType is the type of the DLE and retry exchanges, which route everything with the match all pattern. Headers and plugin exchanges would route them differently to the match all pattern, so those are topic exchanges instead.
+func (e exchange) deadLetterType() ExchangeType {
+	if e.Type == Headers || e.Type.isPlugin() {
+		return Topic
+	}
+	return e.Type
+}
+
+// HeaderMatch is whether a message has to have all or any of the headers of a HeaderBinding
+type HeaderMatch string
+
+const (
+	// MatchAll routes messages which have all the headers of the binding
+	MatchAll HeaderMatch = "all"
+
+	// MatchAny routes messages which have at least one of the headers of the binding
+	MatchAny HeaderMatch = "any"
+)
+
+// HeaderBinding binds a queue to a headers exchange, routing the messages whose headers match
+type HeaderBinding struct {
+	// Match defaults to MatchAll
+	Match   HeaderMatch
+	Headers map[string]interface{}
+}
+
+func (b HeaderBinding) arguments() (amqp.Table, error) {
+	args := amqp.Table{}
+	for key, value := range b.Headers {
+		args[key] = value
+	}
+
+	switch b.Match {
+	case "", MatchAll:
+		args["x-match"] = string(MatchAll)
+	case MatchAny:
+		args["x-match"] = string(MatchAny)
+	default:
+		return nil, fmt.Errorf("unrecognised header match %s", b.Match)
+	}
+
+	if err := args.Validate(); err != nil {
+		return nil, fmt.Errorf("the headers of the binding can not be sent to rabbit: %v", err)
+	}
+
+	return args, nil
+}
+
+// ExchangeBinding binds the exchange to another exchange, either as the destination of a Source, to fan messages in from it, or as the source of a Destination, to fan messages out to it
+type ExchangeBinding struct {
+	// Source is the exchange the messages come from, the exchange being configured is the destination
+	Source string
+	// Destination is the exchange the messages go to, the exchange being configured is the source
+	Destination string
+	// Type declares the other exchange of the binding when it is set, otherwise it has to exist already. Optional
+	Type ExchangeType
+	// Patterns are the routing keys to bind with, defaults to the match all pattern. Optional
+	Patterns []string
+	// Arguments of the binding, such as the x-match when the source is a headers exchange. Optional
+	Arguments map[string]interface{}
+}
+
+// ends returns the source and destination of the binding for exchangeName, the exchange it was configured on
+func (b ExchangeBinding) ends(exchangeName string) (source, destination, other string, err error) {
+	switch {
+	case b.Source != "" && b.Destination == "":
+		return b.Source, exchangeName, b.Source, nil
+	case b.Destination != "" && b.Source == "":
+		return exchangeName, b.Destination, b.Destination, nil
+	default:
+		return "", "", "", fmt.Errorf("a binding of the exchange %s needs either a source or a destination", exchangeName)
+	}
+}
+
 const (
 	durable    = true
 	autoDelete = false
@@ -46,37 +136,21 @@ const (
 	nowait     = false
 )
 
-func makeExchange(ch *amqp.Channel, exchangeName string, exchangeType ExchangeType) error {
+func makeExchange(ch *amqp.Channel, exchangeName string, exchangeType ExchangeType, arguments amqp.Table) error {
 
 	if exchangeType == Unrecognised {
-		return fmt.Errorf("unrecognised exchange type, check config")
+		return newSetupError(StepDeclare, exchangeName, fmt.Errorf("unrecognised exchange type, check config"))
 	}
 
-	return ch.ExchangeDeclare(
+	err := ch.ExchangeDeclare(
 		exchangeName,
 		string(exchangeType),
 		durable,
 		autoDelete,
 		internal,
 		nowait,
-		nil,
+		arguments,
 	)
-}
 
-//
-//func makeExchangePassive(ch *amqp.Channel, exchangeName string, exchangeType ExchangeType) error {
-//
-//	if exchangeType == Unrecognised {
-//		return fmt.Errorf("Unrecognised exchange type, check config")
-//	}
-//
-//	return ch.ExchangeDeclarePassive(
-//		exchangeName,
-//		string(exchangeType),
-//		durable,
-//		autoDelete,
-//		internal,
-//		nowait,
-//		nil,
-//	)
-//}
+	return newSetupError(StepDeclare, exchangeName, err)
+}
@@ -25,3 +25,79 @@ func TestItsCaseInsensitiveWhenCheckingExchangeTypes(t *testing.T) {
 		t.Error("Unexpected type, expected Fanout but got", typ)
 	}
 }
+
+func TestHeadersExchanges(t *testing.T) {
+	typ, err := NewExchangeType("headers")
+
+	if err != nil || typ != Headers {
+		t.Fatal("expected a headers exchange type", typ, err)
+	}
+
+	if (exchange{Type: Headers}).deadLetterType() != Topic {
+		t.Error("expected the dead letter exchanges of a headers exchange to be topic exchanges")
+	}
+
+	if (exchange{Type: Fanout}).deadLetterType() != Fanout {
+		t.Error("expected the dead letter exchanges to have the type of the exchange")
+	}
+}
+
+func TestHeaderBindingArguments(t *testing.T) {
+	args, err := HeaderBinding{Headers: map[string]interface{}{"format": "pdf"}}.arguments()
+
+	if err != nil || args["x-match"] != "all" || args["format"] != "pdf" {
+		t.Error("expected the binding to match all of its headers by default", args, err)
+	}
+
+	args, err = HeaderBinding{Match: MatchAny, Headers: map[string]interface{}{"format": "pdf"}}.arguments()
+
+	if err != nil || args["x-match"] != "any" {
+		t.Error("expected the binding to match any of its headers", args, err)
+	}
+
+	if _, err := (HeaderBinding{Match: "some"}).arguments(); err == nil {
+		t.Error("expected an error for an unrecognised match")
+	}
+
+	if _, err := (HeaderBinding{Headers: map[string]interface{}{"format": struct{}{}}}).arguments(); err == nil {
+		t.Error("expected an error for a header which can not be sent")
+	}
+}
+
+func TestPluginExchangeTypes(t *testing.T) {
+	typ, err := NewExchangeType("X-Consistent-Hash")
+
+	if err != nil || typ != ConsistentHash {
+		t.Fatal("expected a consistent hash exchange type", typ, err)
+	}
+
+	if (exchange{Type: ConsistentHash}).deadLetterType() != Topic {
+		t.Error("expected the dead letter exchanges of a plugin exchange to be topic exchanges")
+	}
+
+	if _, err := NewExchangeType("x-"); err == nil {
+		t.Error("expected an error for a plugin exchange without a name")
+	}
+}
+
+func TestExchangeBindingEnds(t *testing.T) {
+	source, destination, other, err := ExchangeBinding{Source: "upstream"}.ends("exchange")
+
+	if err != nil || source != "upstream" || destination != "exchange" || other != "upstream" {
+		t.Error("expected the exchange to be bound to its source", source, destination, other, err)
+	}
+
+	source, destination, other, err = ExchangeBinding{Destination: "downstream"}.ends("exchange")
+
+	if err != nil || source != "exchange" || destination != "downstream" || other != "downstream" {
+		t.Error("expected the destination to be bound to the exchange", source, destination, other, err)
+	}
+
+	if _, _, _, err := (ExchangeBinding{Source: "upstream", Destination: "downstream"}).ends("exchange"); err == nil {
+		t.Error("expected an error for a binding with both a source and a destination")
+	}
+
+	if _, _, _, err := (ExchangeBinding{}).ends("exchange"); err == nil {
+		t.Error("expected an error for a binding without a source or a destination")
+	}
+}
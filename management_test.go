@@ -0,0 +1,117 @@
+package runamqp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/mergermarket/run-amqp/helpers"
+)
+
+func TestManagementClientListsTheQueueBindings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/queues/%2F/orders-for-billing/bindings" {
+			t.Error("unexpected path", r.URL.EscapedPath())
+		}
+		if username, password, _ := r.BasicAuth(); username != "guest" || password != "secret" {
+			t.Error("expected the credentials of the URL but got", username, password)
+		}
+		w.Write([]byte(`[
+			{"source": "", "destination": "orders-for-billing", "destination_type": "queue", "routing_key": "orders-for-billing", "arguments": {}},
+			{"source": "orders", "destination": "orders-for-billing", "destination_type": "queue", "routing_key": "created", "arguments": {}}
+		]`))
+	}))
+	defer server.Close()
+
+	client, err := NewManagementClient("http://guest:secret@"+server.Listener.Addr().String(), "")
+	assertNoError(t, err)
+
+	bindings, err := client.QueueBindings(context.Background(), "orders-for-billing")
+	assertNoError(t, err)
+
+	if len(bindings) != 1 || bindings[0].Source != "orders" || bindings[0].Pattern != "created" {
+		t.Error("expected the binding to the orders exchange only but got", bindings)
+	}
+}
+
+func TestManagementClientReportsFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	client, err := NewManagementClient(server.URL, "/")
+	assertNoError(t, err)
+
+	if _, err := client.QueueBindings(context.Background(), "orders-for-billing"); err == nil {
+		t.Error("expected an error when the management API refuses")
+	}
+}
+
+// fakeManagementAPI lists the bindings of a queue and deletes them by their properties key, as the management plugin does
+type fakeManagementAPI struct {
+	sync.Mutex
+	bindings []managementBinding
+}
+
+func (f *fakeManagementAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(f.bindings)
+	case http.MethodDelete:
+		kept := f.bindings[:0]
+		for _, b := range f.bindings {
+			if r.URL.EscapedPath() != "/api/bindings/%2F/e/"+b.Source+"/q/"+b.Destination+"/"+b.PropertiesKey {
+				kept = append(kept, b)
+			}
+		}
+		if len(kept) == len(f.bindings) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.bindings = kept
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestReconcileBindingsRemovesHeaderBindingsThroughTheManagementAPI(t *testing.T) {
+	topology := Topology{
+		Queues:   []QueueDeclaration{{Name: "orders-for-billing"}},
+		Bindings: []BindingDeclaration{{Source: "orders", Destination: "orders-for-billing", Pattern: "created"}},
+	}
+
+	// the arguments were declared as integers, which the API returns as JSON numbers
+	api := &fakeManagementAPI{bindings: []managementBinding{
+		{Source: "orders", Destination: "orders-for-billing", DestinationType: "queue", RoutingKey: "created", Arguments: map[string]interface{}{}, PropertiesKey: "created"},
+		{Source: "headers", Destination: "orders-for-billing", DestinationType: "queue", Arguments: map[string]interface{}{"x-match": "all", "priority": float64(1)}, PropertiesKey: "~p1"},
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	management, err := NewManagementClient(server.URL, "/")
+	assertNoError(t, err)
+
+	clientConfig := NewClientConfig{URL: unreachableRabbitURI, Logger: helpers.NewTestLogger(t)}
+	client := NewClient(clientConfig.Config())
+	defer client.Close()
+
+	removed, err := client.ReconcileBindings(context.Background(), topology, management, false)
+	assertNoError(t, err)
+
+	if len(removed) != 1 || removed[0].Source != "headers" {
+		t.Error("expected the header binding to be removed but got", removed)
+	}
+
+	bindings, err := management.QueueBindings(context.Background(), "orders-for-billing")
+	assertNoError(t, err)
+
+	if len(bindings) != 1 || bindings[0].Source != "orders" {
+		t.Error("expected the header binding to be gone from the broker but got", bindings)
+	}
+}
@@ -21,6 +21,9 @@ type amqpMessage struct {
 	retryLimit        int
 	retryExchangeName string
 	dleExchangeName   string
+	queueType         QueueType
+	retryExpiration   string
+	discardOnNack     bool
 }
 
 // Body returns the body of the AMQP message
@@ -36,13 +39,17 @@ func (m *amqpMessage) Ack() error {
 // nackCalls is used when you cant process a message. The "reason" will appear in the rabbit console under the message headers which is useful for debugging
 func (m *amqpMessage) Nack(reason string) error {
 
+	if m.discardOnNack {
+		return m.delivery.Reject(false)
+	}
+
 	err := m.Ack()
 
 	if err != nil {
 		return err
 	}
 
-	headers := make(map[string]interface{})
+	headers := m.originalHeaders()
 	headers["x-dle-reason"] = reason
 	headers["x-dle-timestamp"] = time.Now().Format(time.RFC3339)
 
@@ -58,26 +65,25 @@ func (m *amqpMessage) Nack(reason string) error {
 	return err
 }
 
-// requeueCalls requeues a message, which is useful for when you have transient problems
+// requeueCalls requeues a message, which is useful for when you have transient problems. Quorum queues count the deliveries of a message themselves, so the message is returned to the queue and redelivered straight away, without the RequeueTTL delay of the retry queue.
 func (m *amqpMessage) Requeue(reason string) error {
 
 	if m.retryLimit > 0 {
-		retryCount := 1
-		if headerRetryCount, found := m.delivery.Headers["x-retry-count"]; found {
-
-			if temp, ok := headerRetryCount.(int64); ok {
-				retryCount = int(temp) + 1
-			} else {
-				return fmt.Errorf("the message %+v retry count could not be parsed correctly, this is probably a bug in run-amqp", m)
-			}
-
+		previousRetries, err := m.retryCount()
+		if err != nil {
+			return err
 		}
+		retryCount := previousRetries + 1
 
 		if retryCount > m.retryLimit {
 			return m.Nack(fmt.Sprintf("%s - Reached the max %d number of retries.", reason, m.retryLimit))
 		}
 
-		headers := make(map[string]interface{})
+		if m.queueType == Quorum {
+			return m.delivery.Reject(true)
+		}
+
+		headers := m.originalHeaders()
 		headers["x-retry-count"] = int64(retryCount)
 
 		payload := amqp.Publishing{
@@ -85,9 +91,10 @@ func (m *amqpMessage) Requeue(reason string) error {
 			Headers:      headers,
 			Timestamp:    time.Now(),
 			DeliveryMode: amqp.Persistent,
+			Expiration:   m.retryExpiration,
 		}
 
-		err := m.Ack()
+		err = m.Ack()
 
 		if err != nil {
 			return err
@@ -99,3 +106,42 @@ func (m *amqpMessage) Requeue(reason string) error {
 	return m.delivery.Reject(true)
 
 }
+
+// originalHeaders returns a copy of the headers the message was published with, so they are kept when it is dead-lettered or retried. The delivery count of quorum queues is left out, as rabbit sets it on every delivery.
+func (m *amqpMessage) originalHeaders() amqp.Table {
+	headers := amqp.Table{}
+	for key, value := range m.delivery.Headers {
+		if key != "x-delivery-count" {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+// retryCount is how many times the message has been retried. Quorum queues count how many times they delivered the message in x-delivery-count, which is the retry count as retries are returned to the queue, otherwise it is the x-retry-count set when retrying through the retry exchange.
+func (m *amqpMessage) retryCount() (int, error) {
+	if m.queueType == Quorum {
+		switch deliveryCount := m.delivery.Headers["x-delivery-count"].(type) {
+		case int64:
+			return int(deliveryCount), nil
+		case int32:
+			return int(deliveryCount), nil
+		case nil:
+			return 0, nil
+		default:
+			return 0, fmt.Errorf("the message %+v delivery count could not be parsed correctly, this is probably a bug in run-amqp", m)
+		}
+	}
+
+	retryCount := 0
+
+	if headerRetryCount, found := m.delivery.Headers["x-retry-count"]; found {
+		temp, ok := headerRetryCount.(int64)
+		if !ok {
+			return 0, fmt.Errorf("the message %+v retry count could not be parsed correctly, this is probably a bug in run-amqp", m)
+		}
+		retryCount = int(temp)
+	}
+
+	return retryCount, nil
+}
@@ -0,0 +1,92 @@
+package runamqp
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryCount(t *testing.T) {
+	headers := amqp.Table{
+		"x-retry-count":    int64(2),
+		"x-delivery-count": int64(3),
+	}
+
+	message := &amqpMessage{delivery: amqp.Delivery{Headers: headers}}
+
+	if count, err := message.retryCount(); err != nil || count != 2 {
+		t.Error("expected classic queues to count the retries, got", count, err)
+	}
+
+	quorum := &amqpMessage{delivery: amqp.Delivery{Headers: headers}, queueType: Quorum}
+
+	if count, err := quorum.retryCount(); err != nil || count != 3 {
+		t.Error("expected quorum queues to count their deliveries instead of the retries, got", count, err)
+	}
+
+	firstDelivery := &amqpMessage{delivery: amqp.Delivery{}, queueType: Quorum}
+
+	if count, err := firstDelivery.retryCount(); err != nil || count != 0 {
+		t.Error("expected no retries on the first delivery from a quorum queue, got", count, err)
+	}
+
+	broken := &amqpMessage{delivery: amqp.Delivery{Headers: amqp.Table{"x-retry-count": "two"}}}
+
+	if _, err := broken.retryCount(); err == nil {
+		t.Error("expected an error when the retry count can not be parsed")
+	}
+}
+
+func TestOriginalHeadersAreKeptWithoutTheDeliveryCount(t *testing.T) {
+	message := &amqpMessage{delivery: amqp.Delivery{Headers: amqp.Table{
+		"format":           "pdf",
+		"x-delivery-count": int64(1),
+	}}}
+
+	headers := message.originalHeaders()
+	headers["x-retry-count"] = int64(1)
+
+	if headers["format"] != "pdf" {
+		t.Error("expected the original headers to be kept", headers)
+	}
+
+	if _, found := headers["x-delivery-count"]; found {
+		t.Error("did not expect the delivery count to be kept", headers)
+	}
+
+	if _, found := message.delivery.Headers["x-retry-count"]; found {
+		t.Error("did not expect the headers of the delivery to change")
+	}
+}
+
+type fakeAcknowledger struct {
+	rejected, requeued bool
+}
+
+func (f *fakeAcknowledger) Ack(uint64, bool) error {
+	return nil
+}
+
+func (f *fakeAcknowledger) Nack(uint64, bool, bool) error {
+	return nil
+}
+
+func (f *fakeAcknowledger) Reject(_ uint64, requeue bool) error {
+	f.rejected, f.requeued = true, requeue
+	return nil
+}
+
+func TestRequeueReturnsMessagesToQuorumQueues(t *testing.T) {
+	acknowledger := &fakeAcknowledger{}
+	message := &amqpMessage{
+		delivery:   amqp.Delivery{Acknowledger: acknowledger, Headers: amqp.Table{"x-delivery-count": int64(2)}},
+		retryLimit: 5,
+		queueType:  Quorum,
+	}
+
+	assertNoError(t, message.Requeue("try again"))
+
+	if !acknowledger.rejected || !acknowledger.requeued {
+		t.Error("expected the message to be returned to the quorum queue")
+	}
+}
@@ -0,0 +1,249 @@
+package runamqp
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ConsumerNames are the names of the queues and exchanges made for a consumer of an exchange
+type ConsumerNames struct {
+	Queue              string
+	DeadLetterQueue    string
+	DeadLetterExchange string
+	RetryNowExchange   string
+	RetryLaterExchange string
+	RetryLaterQueue    string
+}
+
+// NamingStrategy names the exchange, and the queues and exchanges made for each service consuming it. When the names of the retry queue do not depend on the RequeueTTL, the TTL is set on each retried message instead of on the retry queue, so it can be changed without declaring a different queue.
+type NamingStrategy interface {
+	ExchangeName(exchange string) string
+	ConsumerNames(exchange, service string, requeueTTL int16) ConsumerNames
+}
+
+// DefaultNaming names the queue <exchange>-for-<service>, followed by -dlq, -dle, -retry-now and -retry-<ttl>ms-later for the others. Changing the RequeueTTL renames the retry exchange and queue.
+type DefaultNaming struct{}
+
+// ExchangeName returns the exchange as it is
+func (DefaultNaming) ExchangeName(exchange string) string {
+	return exchange
+}
+
+// ConsumerNames returns the names the consumers have always had
+func (DefaultNaming) ConsumerNames(exchange, service string, requeueTTL int16) ConsumerNames {
+	queue := fmt.Sprintf("%s-for-%s", exchange, service)
+	return ConsumerNames{
+		Queue:              queue,
+		DeadLetterQueue:    queue + "-dlq",
+		DeadLetterExchange: queue + "-dle",
+		RetryNowExchange:   queue + "-retry-now",
+		RetryLaterExchange: fmt.Sprintf("%s-retry-%dms-later", queue, requeueTTL),
+		RetryLaterQueue:    fmt.Sprintf("%s-retry-%dms-later", queue, requeueTTL),
+	}
+}
+
+// StableRetryNaming is like DefaultNaming, but names the retry exchange and queue <exchange>-for-<service>-retry-later whatever the RequeueTTL is
+type StableRetryNaming struct{}
+
+// ExchangeName returns the exchange as it is
+func (StableRetryNaming) ExchangeName(exchange string) string {
+	return exchange
+}
+
+// ConsumerNames returns the default names with the TTL left out of the retry names
+func (StableRetryNaming) ConsumerNames(exchange, service string, requeueTTL int16) ConsumerNames {
+	names := DefaultNaming{}.ConsumerNames(exchange, service, requeueTTL)
+	names.RetryLaterExchange = names.Queue + "-retry-later"
+	names.RetryLaterQueue = names.Queue + "-retry-later"
+	return names
+}
+
+// PrefixedNaming puts Prefix in front of every name given by Naming, such as staging. to keep environments sharing a broker apart. Naming defaults to DefaultNaming.
+type PrefixedNaming struct {
+	Prefix string
+	Naming NamingStrategy
+}
+
+// ExchangeName returns the exchange with the prefix
+func (p PrefixedNaming) ExchangeName(exchange string) string {
+	return p.Prefix + p.naming().ExchangeName(exchange)
+}
+
+// ConsumerNames returns the names given by Naming with the prefix
+func (p PrefixedNaming) ConsumerNames(exchange, service string, requeueTTL int16) ConsumerNames {
+	names := p.naming().ConsumerNames(exchange, service, requeueTTL)
+	return ConsumerNames{
+		Queue:              p.Prefix + names.Queue,
+		DeadLetterQueue:    p.Prefix + names.DeadLetterQueue,
+		DeadLetterExchange: p.Prefix + names.DeadLetterExchange,
+		RetryNowExchange:   p.Prefix + names.RetryNowExchange,
+		RetryLaterExchange: p.Prefix + names.RetryLaterExchange,
+		RetryLaterQueue:    p.Prefix + names.RetryLaterQueue,
+	}
+}
+
+func (p PrefixedNaming) naming() NamingStrategy {
+	return orDefaultNaming(p.Naming)
+}
+
+func orDefaultNaming(naming NamingStrategy) NamingStrategy {
+	if naming == nil {
+		return DefaultNaming{}
+	}
+	return naming
+}
+
+// retryTTLPerMessage is whether the retry names of naming are the same whatever the TTL is
+func retryTTLPerMessage(naming NamingStrategy, exchange, service string) bool {
+	short, long := naming.ConsumerNames(exchange, service, 1), naming.ConsumerNames(exchange, service, 2)
+	return short.RetryLaterQueue == long.RetryLaterQueue
+}
+
+// MigrateConsumer moves a consumer from the names of from to the names of to, such as after changing its NamingStrategy or RequeueTTL. It declares the topology of to, unbinds the old main queue, moves the messages of every renamed queue to its new counterpart, then deletes the renamed queues and exchanges. The exchange itself is left, as publishers may still use it.
+//
+// The consumers using the old names have to be closed first, a renamed queue which still has consumers is not deleted and an error is returned.
+func (c *Client) MigrateConsumer(ctx context.Context, from, to ConsumerConfig) error {
+	old, err := from.Topology()
+	if err != nil {
+		return err
+	}
+
+	topology, err := to.Topology()
+	if err != nil {
+		return err
+	}
+
+	if err := topology.Validate(); err != nil {
+		return newSetupError(StepDeclare, "", err)
+	}
+
+	pool, err := c.topologyChannels(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	ch, err := pool.Get()
+	if err != nil {
+		return newSetupError(StepChannel, "", err)
+	}
+	defer pool.Put(ch)
+
+	if err := topology.Apply(ch); err != nil {
+		return err
+	}
+
+	if from.queue.Name != to.queue.Name {
+		for _, b := range old.Bindings {
+			if b.Destination != from.queue.Name || b.ToExchange {
+				continue
+			}
+			if err := ch.QueueUnbind(b.Destination, b.Pattern, b.Source, b.Arguments); err != nil {
+				return fmt.Errorf(`failed to unbind "%s" from "%s": %w`, b.Destination, b.Source, err)
+			}
+		}
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("failed to put the channel in confirm mode: %w", err)
+	}
+
+	// messages moved to a retry queue without a TTL of its own need one, otherwise they would never be retried
+	retryExpiration := ""
+	if to.queue.RetryTTLPerMessage {
+		retryExpiration = strconv.Itoa(int(to.queue.RequeueTTL))
+	}
+
+	queues := []struct{ from, to, expiration string }{
+		{from.queue.Name, to.queue.Name, ""},
+		{from.queue.DLQ, to.queue.DLQ, ""},
+		{from.queue.RetryLater, to.queue.RetryLater, retryExpiration},
+	}
+
+	for _, q := range queues {
+		if q.from == q.to {
+			continue
+		}
+
+		moved, err := moveMessages(ctx, ch, q.from, q.to, q.expiration)
+		if err != nil {
+			return err
+		}
+
+		c.config.Logger.Info(fmt.Sprintf(`moved %d messages from "%s" to "%s"`, moved, q.from, q.to))
+
+		if _, err := ch.QueueDelete(q.from, true, true, nowait); err != nil {
+			return fmt.Errorf(`failed to delete the queue "%s", its consumers have to be closed first: %w`, q.from, err)
+		}
+	}
+
+	exchanges := []struct{ from, to string }{
+		{from.exchange.DLE, to.exchange.DLE},
+		{from.exchange.RetryNow, to.exchange.RetryNow},
+		{from.exchange.RetryLater, to.exchange.RetryLater},
+	}
+
+	for _, e := range exchanges {
+		if e.from == e.to {
+			continue
+		}
+		if err := ch.ExchangeDelete(e.from, false, nowait); err != nil {
+			return fmt.Errorf(`failed to delete the exchange "%s": %w`, e.from, err)
+		}
+	}
+
+	return nil
+}
+
+// moveMessages republishes the messages of the queue from to the queue to through the default exchange, acknowledging each once rabbit has confirmed it. Messages without an expiration are given expiration.
+func moveMessages(ctx context.Context, ch *amqp.Channel, from, to, expiration string) (int, error) {
+	moved := 0
+
+	for {
+		d, found, err := ch.Get(from, false)
+		if err != nil {
+			return moved, fmt.Errorf(`failed to get a message from "%s": %w`, from, err)
+		}
+		if !found {
+			return moved, nil
+		}
+
+		if d.Expiration == "" {
+			d.Expiration = expiration
+		}
+
+		confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", to, false, false, amqp.Publishing{
+			Headers:         d.Headers,
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			DeliveryMode:    d.DeliveryMode,
+			Priority:        d.Priority,
+			CorrelationId:   d.CorrelationId,
+			ReplyTo:         d.ReplyTo,
+			Expiration:      d.Expiration,
+			MessageId:       d.MessageId,
+			Timestamp:       d.Timestamp,
+			Type:            d.Type,
+			UserId:          d.UserId,
+			AppId:           d.AppId,
+			Body:            d.Body,
+		})
+		if err != nil {
+			return moved, fmt.Errorf(`failed to move a message to "%s": %w`, to, err)
+		}
+
+		acked, err := confirmation.WaitContext(ctx)
+		if err != nil || !acked {
+			return moved, fmt.Errorf(`rabbit did not confirm a message moved to "%s": %v`, to, err)
+		}
+
+		if err := d.Ack(false); err != nil {
+			return moved, fmt.Errorf(`failed to acknowledge a message moved from "%s": %w`, from, err)
+		}
+
+		moved++
+	}
+}
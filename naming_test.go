@@ -0,0 +1,104 @@
+package runamqp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/run-amqp/helpers"
+)
+
+func TestDefaultNamingKeepsTheNames(t *testing.T) {
+	names := DefaultNaming{}.ConsumerNames("orders", "billing", 200)
+
+	expected := ConsumerNames{
+		Queue:              "orders-for-billing",
+		DeadLetterQueue:    "orders-for-billing-dlq",
+		DeadLetterExchange: "orders-for-billing-dle",
+		RetryNowExchange:   "orders-for-billing-retry-now",
+		RetryLaterExchange: "orders-for-billing-retry-200ms-later",
+		RetryLaterQueue:    "orders-for-billing-retry-200ms-later",
+	}
+
+	if names != expected {
+		t.Error("expected", expected, "but got", names)
+	}
+}
+
+func TestPrefixedNaming(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{Naming: PrefixedNaming{Prefix: "staging."}})
+
+	if config.exchange.Name != "staging.exchange" || config.queue.Name != "staging.exchange-for-"+serviceName || config.exchange.DLE != "staging.exchange-for-"+serviceName+"-dle" {
+		t.Error("expected every name to be prefixed", config.exchange, config.queue.Name)
+	}
+
+	publisher := NewPublisherConfig{ExchangeName: "orders", Naming: PrefixedNaming{Prefix: "staging."}}
+
+	if name := publisher.Config().exchange.Name; name != "staging.orders" {
+		t.Error("expected the publisher to use the prefixed exchange but got", name)
+	}
+}
+
+func TestStableRetryNamingPutsTheTTLOnTheMessages(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{Naming: StableRetryNaming{}})
+
+	if config.queue.RetryLater != "exchange-for-"+serviceName+"-retry-later" || !config.queue.RetryTTLPerMessage {
+		t.Error("expected the retry queue to be named without the TTL", config.queue.RetryLater)
+	}
+
+	args, err := config.retryQueueArguments()
+	assertNoError(t, err)
+
+	if _, found := args["x-message-ttl"]; found {
+		t.Error("expected the retry queue to have no TTL of its own", args)
+	}
+
+	if defaultConfig := newQueueTestConfig(t, NewConsumerConfig{}); defaultConfig.queue.RetryTTLPerMessage {
+		t.Error("expected the default naming to keep the TTL on the retry queue")
+	}
+}
+
+func TestMigrateConsumerMovesTheMessagesToTheNewNames(t *testing.T) {
+	t.Parallel()
+
+	from := newTestConsumerConfig(t, consumerConfigOptions{})
+
+	c := NewConsumerConfig{
+		URL:          testRabbitURI,
+		ExchangeName: from.exchange.Name,
+		ExchangeType: from.exchange.Type,
+		Logger:       helpers.NewTestLogger(t),
+		RequeueTTL:   from.queue.RequeueTTL,
+		ServiceName:  serviceName,
+		Prefetch:     defaultPrefetch,
+		Naming:       StableRetryNaming{},
+	}
+	to := c.Config()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clientConfig := NewClientConfig{URL: testRabbitURI, Logger: helpers.NewTestLogger(t)}
+	client := NewClient(clientConfig.Config())
+	defer client.Close()
+
+	old, err := from.Topology()
+	assertNoError(t, err)
+	assertNoError(t, client.ApplyTopology(ctx, old))
+
+	publisher, err := client.NewPublisherContext(ctx, from.NewPublisherConfig())
+	assertNoError(t, err)
+	assertNoError(t, publisher.Publish([]byte("hello"), nil))
+
+	assertNoError(t, client.MigrateConsumer(ctx, from, to))
+
+	consumer, err := client.NewConsumerContext(ctx, to)
+	assertNoError(t, err)
+	defer consumer.Close()
+
+	message := getMessage(t, consumer.Messages)
+
+	if string(message.Body()) != "hello" {
+		t.Error("expected the message published before the migration but got", string(message.Body()))
+	}
+}
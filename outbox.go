@@ -0,0 +1,345 @@
+package runamqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOutboxFull is returned by Publish, PublishAfter and PublishAt, or for a message of PublishBatch, when the outbox already holds OutboxSize messages, the message is not published
+var ErrOutboxFull = errors.New("the outbox is full")
+
+const (
+	defaultOutboxSize         = 10000
+	defaultOutboxFlushTimeout = 5 * time.Second
+	outboxDrainBatch          = 100
+	outboxRetryInterval       = time.Second
+	outboxFlushPollInterval   = 100 * time.Millisecond
+)
+
+// OutboxMessage is a message kept in an OutboxStore until it has been published
+type OutboxMessage struct {
+	// ID is given by the store when the message is appended
+	ID       uint64
+	Body     []byte
+	Options  *PublishOptions
+	StoredAt time.Time
+	// DueAt is when a message published with PublishAfter or PublishAt is delivered, it is published without a delay when it is already due
+	DueAt time.Time `json:",omitempty"`
+}
+
+// delay is how much longer the message has to be delayed by when it is published from the outbox
+func (m OutboxMessage) delay() time.Duration {
+	if m.DueAt.IsZero() {
+		return 0
+	}
+	return time.Until(m.DueAt)
+}
+
+// OutboxStore keeps the messages a publisher could not publish yet, in the order they were appended, so they survive a restart of the service
+type OutboxStore interface {
+	// Append stores message and returns the ID it was stored with
+	Append(message OutboxMessage) (uint64, error)
+	// Pending returns up to limit of the stored messages, oldest first
+	Pending(limit int) ([]OutboxMessage, error)
+	// Remove forgets the messages with ids, as they have been published
+	Remove(ids []uint64) error
+	// Len returns how many messages are stored
+	Len() (int, error)
+}
+
+// OutboxStats are what a publisher's outbox has done since the publisher was made
+type OutboxStats struct {
+	// Pending is how many messages are waiting in the outbox to be published
+	Pending int
+	// Stored is how many messages were put in the outbox
+	Stored uint64
+	// Published is how many messages from the outbox were confirmed by rabbit
+	Published uint64
+	// Failed is how many attempts to publish a message from the outbox failed, the message is tried again later
+	Failed uint64
+	// Rejected is how many messages were turned away with ErrOutboxFull
+	Rejected uint64
+}
+
+// outbox is the state of a publisher's outbox. Publishing from it, or straight past it when it is empty, is done by one goroutine at a time holding draining.
+type outbox struct {
+	sync.Mutex
+	store        OutboxStore
+	size         int
+	flushTimeout time.Duration
+	wake         chan struct{}
+	draining     sync.Mutex
+	stored       atomic.Uint64
+	published    atomic.Uint64
+	failed       atomic.Uint64
+	rejected     atomic.Uint64
+}
+
+// newOutbox returns nil when the publisher has no outbox
+func newOutbox(config PublisherConfig) *outbox {
+	if config.outbox == nil {
+		return nil
+	}
+
+	o := &outbox{
+		store:        config.outbox,
+		size:         config.outboxSize,
+		flushTimeout: config.outboxFlushTimeout,
+		wake:         make(chan struct{}, 1),
+	}
+
+	if o.size == 0 {
+		o.size = defaultOutboxSize
+	}
+
+	if o.flushTimeout == 0 {
+		o.flushTimeout = defaultOutboxFlushTimeout
+	}
+
+	return o
+}
+
+// append stores msg unless the outbox is full, then wakes up the goroutine publishing from it
+func (o *outbox) append(msg []byte, options *PublishOptions, delay time.Duration) error {
+	o.Lock()
+	defer o.Unlock()
+
+	pending, err := o.store.Len()
+	if err != nil {
+		return fmt.Errorf("failed to count the messages in the outbox: %w", err)
+	}
+
+	if pending >= o.size {
+		o.rejected.Add(1)
+		return fmt.Errorf("unable to publish %s, %w with %d messages", string(msg), ErrOutboxFull, pending)
+	}
+
+	message := OutboxMessage{Body: msg, Options: options, StoredAt: time.Now()}
+	if delay > 0 {
+		message.DueAt = message.StoredAt.Add(delay)
+	}
+
+	if _, err := o.store.Append(message); err != nil {
+		return fmt.Errorf("failed to store %s in the outbox: %w", string(msg), err)
+	}
+
+	o.stored.Add(1)
+	o.wakeUp()
+
+	return nil
+}
+
+func (o *outbox) wakeUp() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// publishThroughOutbox publishes msg straight away when the publisher is ready and nothing is waiting in the outbox before it, otherwise it stores msg to be published once rabbit is back
+func (p *Publisher) publishThroughOutbox(msg []byte, options *PublishOptions, delay time.Duration) error {
+	if err := p.validForOutbox(msg, options, delay); err != nil {
+		return err
+	}
+
+	if p.holdEmptyOutbox() {
+		err := p.publish(msg, options, delay)
+		p.outbox.draining.Unlock()
+
+		if err == nil {
+			return nil
+		}
+		p.config.Logger.Info(fmt.Sprintf("putting the message in the outbox, as it could not be published: %v", err))
+	}
+
+	return p.outbox.append(msg, options, delay)
+}
+
+// publishBatchThroughOutbox publishes the batch straight away like publishThroughOutbox, storing the messages which were not published in the outbox instead of failing them
+func (p *Publisher) publishBatchThroughOutbox(ctx context.Context, messages []BatchMessage) (BatchResults, error) {
+	results := make(BatchResults, len(messages))
+
+	var valid []BatchMessage
+	var indexes []int
+
+	for i, message := range messages {
+		results[i].Message = message
+		if results[i].Err = p.validForOutbox(message.Body, message.Options, message.Delay); results[i].Err == nil {
+			valid = append(valid, message)
+			indexes = append(indexes, i)
+		}
+	}
+
+	var published BatchResults
+	if len(valid) > 0 && p.holdEmptyOutbox() {
+		published, _ = p.publishBatch(ctx, valid)
+		p.outbox.draining.Unlock()
+	}
+
+	for n, i := range indexes {
+		if published != nil && published[n].Err == nil {
+			continue
+		}
+		results[i].Err = p.outbox.append(messages[i].Body, messages[i].Options, messages[i].Delay)
+	}
+
+	return results, results.allFailed()
+}
+
+// validForOutbox returns the error publishing msg would always fail with, which is returned to the caller rather than stored to fail every time it is published
+func (p *Publisher) validForOutbox(msg []byte, options *PublishOptions, delay time.Duration) error {
+	exchangeName, pattern, publishing, err := p.prepare(msg, options, 0)
+	if err != nil || delay <= 0 {
+		return err
+	}
+	return p.validDelay(delay, exchangeName, pattern, publishing.Expiration)
+}
+
+// holdEmptyOutbox takes the outbox from the goroutine publishing from it when rabbit is reachable and nothing is waiting in it, so a message published straight away can not overtake the stored ones. It returns false when the outbox is busy or has messages in it, otherwise the caller has to release it with draining.Unlock.
+func (p *Publisher) holdEmptyOutbox() bool {
+	if !p.publishReady.Load() || !p.outbox.draining.TryLock() {
+		return false
+	}
+
+	if pending, err := p.outbox.store.Len(); err != nil || pending > 0 {
+		p.outbox.draining.Unlock()
+		return false
+	}
+
+	return true
+}
+
+// OutboxStats returns what the outbox has done, it is all zeros for a publisher without an Outbox
+func (p *Publisher) OutboxStats() (OutboxStats, error) {
+	if p.outbox == nil {
+		return OutboxStats{}, nil
+	}
+
+	pending, err := p.outbox.store.Len()
+	if err != nil {
+		return OutboxStats{}, fmt.Errorf("failed to count the messages in the outbox: %w", err)
+	}
+
+	return OutboxStats{
+		Pending:   pending,
+		Stored:    p.outbox.stored.Load(),
+		Published: p.outbox.published.Load(),
+		Failed:    p.outbox.failed.Load(),
+		Rejected:  p.outbox.rejected.Load(),
+	}, nil
+}
+
+// Flush publishes the messages in the outbox, waiting for rabbit to be reachable if it is not, until the outbox is empty or ctx is done. The messages not published are kept in the outbox.
+func (p *Publisher) Flush(ctx context.Context) error {
+	if p.outbox == nil {
+		return nil
+	}
+
+	for {
+		empty, err := p.drainOutbox(ctx)
+		if err != nil {
+			return err
+		}
+
+		if empty {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			pending, _ := p.outbox.store.Len()
+			return fmt.Errorf("stopped flushing the outbox with %d messages left in it: %w", pending, ctx.Err())
+		case <-time.After(outboxFlushPollInterval):
+		}
+	}
+}
+
+// publishFromOutbox publishes from the outbox whenever a message is stored, rabbit is back, or it is time to try the failed ones again, until the publisher is closed
+func (p *Publisher) publishFromOutbox() {
+	ticker := time.NewTicker(outboxRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.outbox.wake:
+		case <-ticker.C:
+		}
+
+		if _, err := p.drainOutbox(p.ctx); err != nil {
+			p.config.Logger.Error(err)
+		}
+	}
+}
+
+// drainOutbox publishes the messages in the outbox as batches, removing the ones rabbit confirmed up to the first which failed. It stops there, leaving that message and the ones after it to be tried again later in the same order, so they can be published more than once. It returns whether the outbox was emptied.
+func (p *Publisher) drainOutbox(ctx context.Context) (bool, error) {
+	p.outbox.draining.Lock()
+	defer p.outbox.draining.Unlock()
+
+	for p.publishReady.Load() {
+		pending, err := p.outbox.store.Pending(outboxDrainBatch)
+		if err != nil {
+			return false, fmt.Errorf("failed to read the outbox: %w", err)
+		}
+
+		if len(pending) == 0 {
+			return true, nil
+		}
+
+		batch := make([]BatchMessage, len(pending))
+		for i, message := range pending {
+			batch[i] = BatchMessage{Body: message.Body, Options: message.Options, Delay: message.delay()}
+		}
+
+		results, _ := p.publishBatch(ctx, batch)
+
+		published := publishedInOrder(pending, results)
+
+		if len(published) > 0 {
+			if err := p.outbox.store.Remove(published); err != nil {
+				return false, fmt.Errorf("failed to remove the published messages from the outbox, they will be published again: %w", err)
+			}
+			p.outbox.published.Add(uint64(len(published)))
+		}
+
+		if failed := len(pending) - len(published); failed > 0 {
+			p.outbox.failed.Add(uint64(failed))
+			p.config.Logger.Debug(fmt.Sprintf("%d messages were left in the outbox after one failed, they will be tried again: %v", failed, results.Err()))
+			return false, nil
+		}
+	}
+
+	return false, nil
+}
+
+// publishedInOrder returns the IDs of the messages published before the first which failed. The ones after it are published again behind it, to keep them in order.
+func publishedInOrder(pending []OutboxMessage, results BatchResults) []uint64 {
+	var published []uint64
+	for i, result := range results {
+		if result.Err != nil {
+			break
+		}
+		published = append(published, pending[i].ID)
+	}
+	return published
+}
+
+// flushOnClose publishes what is left in the outbox before the publisher closes, when it is connected to rabbit. Anything not published in time is kept in the store for the next publisher using it.
+func (p *Publisher) flushOnClose() {
+	if p.outbox == nil || !p.publishReady.Load() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.outbox.flushTimeout)
+	defer cancel()
+
+	if err := p.Flush(ctx); err != nil {
+		p.config.Logger.Error(fmt.Sprintf("closing the publisher before the outbox was flushed: %v", err))
+	}
+}
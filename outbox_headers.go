@@ -0,0 +1,176 @@
+package runamqp
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// typedValue is a header value written with its type, as JSON on its own turns every number into a float64, times into strings and bytes into base64 strings
+type typedValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// encodeHeaders writes headers with the type of every value, failing for the types rabbit does not support
+func encodeHeaders(headers map[string]interface{}) (map[string]typedValue, error) {
+	if headers == nil {
+		return nil, nil
+	}
+
+	encoded := make(map[string]typedValue, len(headers))
+	for key, value := range headers {
+		typed, err := encodeHeader(value)
+		if err != nil {
+			return nil, fmt.Errorf(`the header "%s" can not be stored: %w`, key, err)
+		}
+		encoded[key] = typed
+	}
+	return encoded, nil
+}
+
+func encodeHeader(value interface{}) (typedValue, error) {
+	var kind string
+	switch v := value.(type) {
+	case nil:
+		return typedValue{Type: "nil"}, nil
+	case bool:
+		kind = "bool"
+	case byte:
+		kind = "byte"
+	case int8:
+		kind = "int8"
+	case int16:
+		kind = "int16"
+	case int32:
+		kind = "int32"
+	case int64:
+		kind = "int64"
+	case int:
+		kind = "int"
+	case float32:
+		kind = "float32"
+	case float64:
+		kind = "float64"
+	case string:
+		kind = "string"
+	case []byte:
+		kind = "bytes"
+	case time.Time:
+		kind = "time"
+	case amqp.Decimal:
+		kind = "decimal"
+	case []interface{}:
+		values := make([]typedValue, len(v))
+		for i, item := range v {
+			typed, err := encodeHeader(item)
+			if err != nil {
+				return typedValue{}, err
+			}
+			values[i] = typed
+		}
+		return encodedValue("array", values)
+	case amqp.Table:
+		return encodeTable(v)
+	case map[string]interface{}:
+		return encodeTable(v)
+	default:
+		return typedValue{}, fmt.Errorf("the type %T is not supported", value)
+	}
+	return encodedValue(kind, value)
+}
+
+func encodeTable(table map[string]interface{}) (typedValue, error) {
+	values, err := encodeHeaders(table)
+	if err != nil {
+		return typedValue{}, err
+	}
+	return encodedValue("table", values)
+}
+
+func encodedValue(kind string, value interface{}) (typedValue, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return typedValue{}, err
+	}
+	return typedValue{Type: kind, Value: raw}, nil
+}
+
+// decodeHeaders reads back the headers written by encodeHeaders with the types they had
+func decodeHeaders(encoded map[string]typedValue) (map[string]interface{}, error) {
+	if encoded == nil {
+		return nil, nil
+	}
+
+	headers := make(map[string]interface{}, len(encoded))
+	for key, typed := range encoded {
+		value, err := typed.decode()
+		if err != nil {
+			return nil, fmt.Errorf(`the header "%s" can not be read: %w`, key, err)
+		}
+		headers[key] = value
+	}
+	return headers, nil
+}
+
+func (t typedValue) decode() (interface{}, error) {
+	switch t.Type {
+	case "nil":
+		return nil, nil
+	case "bool":
+		return decodeAs[bool](t.Value)
+	case "byte":
+		return decodeAs[byte](t.Value)
+	case "int8":
+		return decodeAs[int8](t.Value)
+	case "int16":
+		return decodeAs[int16](t.Value)
+	case "int32":
+		return decodeAs[int32](t.Value)
+	case "int64":
+		return decodeAs[int64](t.Value)
+	case "int":
+		return decodeAs[int](t.Value)
+	case "float32":
+		return decodeAs[float32](t.Value)
+	case "float64":
+		return decodeAs[float64](t.Value)
+	case "string":
+		return decodeAs[string](t.Value)
+	case "bytes":
+		return decodeAs[[]byte](t.Value)
+	case "time":
+		return decodeAs[time.Time](t.Value)
+	case "decimal":
+		return decodeAs[amqp.Decimal](t.Value)
+	case "array":
+		items, err := decodeAs[[]typedValue](t.Value)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(items))
+		for i, item := range items {
+			if values[i], err = item.decode(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case "table":
+		items, err := decodeAs[map[string]typedValue](t.Value)
+		if err != nil {
+			return nil, err
+		}
+		table, err := decodeHeaders(items)
+		return amqp.Table(table), err
+	default:
+		return nil, fmt.Errorf(`the type "%s" is not recognised`, t.Type)
+	}
+}
+
+func decodeAs[T any](raw json.RawMessage) (T, error) {
+	var value T
+	err := json.Unmarshal(raw, &value)
+	return value, err
+}
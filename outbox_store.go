@@ -0,0 +1,291 @@
+package runamqp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// compactOutboxAfter is how many removed messages are left in the file before it is rewritten with only the pending ones
+const compactOutboxAfter = 1000
+
+// FileOutboxStore is an OutboxStore writing every change to the end of a file as a line of JSON, which is synced to disk before the change returns. Headers are written with their types, so they are published the same after a restart. The pending messages are kept in memory as well, and read back from the file when it is opened again.
+type FileOutboxStore struct {
+	sync.Mutex
+	path    string
+	file    *os.File
+	pending []OutboxMessage
+	nextID  uint64
+	removed int
+}
+
+// outboxRecord is a line of the file, either a message appended or the IDs of the messages removed
+type outboxRecord struct {
+	Append *outboxEntry `json:"append,omitempty"`
+	Remove []uint64     `json:"remove,omitempty"`
+}
+
+// outboxEntry is a message as it is written to the file, with the headers of its options written along with their types so they are read back the same
+type outboxEntry struct {
+	OutboxMessage
+	Headers map[string]typedValue `json:"headers,omitempty"`
+}
+
+func newOutboxEntry(message OutboxMessage) (*outboxEntry, error) {
+	if message.Options == nil || message.Options.Headers == nil {
+		return &outboxEntry{OutboxMessage: message}, nil
+	}
+
+	headers, err := encodeHeaders(message.Options.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	options := *message.Options
+	options.Headers = nil
+	message.Options = &options
+
+	return &outboxEntry{OutboxMessage: message, Headers: headers}, nil
+}
+
+func (e outboxEntry) message() (OutboxMessage, error) {
+	message := e.OutboxMessage
+	if e.Headers == nil {
+		return message, nil
+	}
+
+	headers, err := decodeHeaders(e.Headers)
+	if err != nil {
+		return OutboxMessage{}, err
+	}
+
+	options := PublishOptions{}
+	if message.Options != nil {
+		options = *message.Options
+	}
+	options.Headers = headers
+	message.Options = &options
+
+	return message, nil
+}
+
+// NewFileOutboxStore opens the file at path, making it when it does not exist, and reads the messages still pending in it
+func NewFileOutboxStore(path string) (*FileOutboxStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to open the outbox file "%s": %v`, path, err)
+	}
+
+	f := &FileOutboxStore{path: path, file: file, nextID: 1}
+
+	if err := f.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Append writes message to the file with the next ID
+func (f *FileOutboxStore) Append(message OutboxMessage) (uint64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	message.ID = f.nextID
+
+	entry, err := newOutboxEntry(message)
+	if err != nil {
+		return 0, fmt.Errorf(`failed to encode a message for the outbox file "%s": %v`, f.path, err)
+	}
+
+	if err := f.write(outboxRecord{Append: entry}); err != nil {
+		return 0, err
+	}
+
+	f.nextID++
+	f.pending = append(f.pending, message)
+
+	return message.ID, nil
+}
+
+// Pending returns up to limit of the pending messages, oldest first
+func (f *FileOutboxStore) Pending(limit int) ([]OutboxMessage, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if limit > len(f.pending) {
+		limit = len(f.pending)
+	}
+
+	return append([]OutboxMessage(nil), f.pending[:limit]...), nil
+}
+
+// Remove writes the removal of ids to the file. The file is emptied once nothing is pending, or rewritten when many removed messages have built up in it.
+func (f *FileOutboxStore) Remove(ids []uint64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.write(outboxRecord{Remove: ids}); err != nil {
+		return err
+	}
+
+	f.pending = withoutIDs(f.pending, ids)
+	f.removed += len(ids)
+
+	switch {
+	case len(f.pending) == 0:
+		if err := f.file.Truncate(0); err != nil {
+			return fmt.Errorf(`failed to empty the outbox file "%s": %v`, f.path, err)
+		}
+		f.removed = 0
+	case f.removed >= compactOutboxAfter:
+		return f.compact()
+	}
+
+	return nil
+}
+
+// Len returns how many messages are pending
+func (f *FileOutboxStore) Len() (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.pending), nil
+}
+
+// Close closes the file, the store can not be used afterwards
+func (f *FileOutboxStore) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.file.Close()
+}
+
+func (f *FileOutboxStore) write(record outboxRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf(`failed to encode a message for the outbox file "%s": %v`, f.path, err)
+	}
+
+	if _, err := f.file.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf(`failed to write the outbox file "%s": %v`, f.path, err)
+	}
+
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf(`failed to write the outbox file "%s": %v`, f.path, err)
+	}
+
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf(`failed to sync the outbox file "%s": %v`, f.path, err)
+	}
+
+	return nil
+}
+
+// replay reads the file from the start, applying each record in turn. A last line which is cut short was being written when the service stopped, so it was never stored and is cut off the file.
+func (f *FileOutboxStore) replay() error {
+	content, err := io.ReadAll(f.file)
+	if err != nil {
+		return fmt.Errorf(`failed to read the outbox file "%s": %v`, f.path, err)
+	}
+
+	complete := bytes.LastIndexByte(content, '\n') + 1
+
+	for n, line := range bytes.Split(content[:complete], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		var record outboxRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf(`failed to parse line %d of the outbox file "%s": %v`, n+1, f.path, err)
+		}
+
+		switch {
+		case record.Append != nil:
+			message, err := record.Append.message()
+			if err != nil {
+				return fmt.Errorf(`failed to parse line %d of the outbox file "%s": %v`, n+1, f.path, err)
+			}
+			f.pending = append(f.pending, message)
+			if message.ID >= f.nextID {
+				f.nextID = message.ID + 1
+			}
+		case record.Remove != nil:
+			f.pending = withoutIDs(f.pending, record.Remove)
+			f.removed += len(record.Remove)
+		}
+	}
+
+	if complete < len(content) {
+		if err := f.file.Truncate(int64(complete)); err != nil {
+			return fmt.Errorf(`failed to cut the unfinished line off the outbox file "%s": %v`, f.path, err)
+		}
+	}
+
+	return nil
+}
+
+// compact replaces the file with one holding only the pending messages, writing a temporary file and renaming it so a crash never leaves a half written file behind
+func (f *FileOutboxStore) compact() error {
+	temporary, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf(`failed to compact the outbox file "%s": %v`, f.path, err)
+	}
+	defer os.Remove(temporary.Name())
+
+	writer := bufio.NewWriter(temporary)
+	for _, message := range f.pending {
+		entry, err := newOutboxEntry(message)
+		if err != nil {
+			temporary.Close()
+			return fmt.Errorf(`failed to compact the outbox file "%s": %v`, f.path, err)
+		}
+
+		line, err := json.Marshal(outboxRecord{Append: entry})
+		if err != nil {
+			temporary.Close()
+			return fmt.Errorf(`failed to compact the outbox file "%s": %v`, f.path, err)
+		}
+		writer.Write(append(line, '\n'))
+	}
+
+	if err := writer.Flush(); err != nil {
+		temporary.Close()
+		return fmt.Errorf(`failed to compact the outbox file "%s": %v`, f.path, err)
+	}
+
+	if err := temporary.Sync(); err != nil {
+		temporary.Close()
+		return fmt.Errorf(`failed to compact the outbox file "%s": %v`, f.path, err)
+	}
+
+	if err := os.Rename(temporary.Name(), f.path); err != nil {
+		temporary.Close()
+		return fmt.Errorf(`failed to compact the outbox file "%s": %v`, f.path, err)
+	}
+
+	f.file.Close()
+	f.file = temporary
+	f.removed = 0
+
+	return nil
+}
+
+func withoutIDs(messages []OutboxMessage, ids []uint64) []OutboxMessage {
+	removed := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		removed[id] = true
+	}
+
+	var kept []OutboxMessage
+	for _, message := range messages {
+		if !removed[message.ID] {
+			kept = append(kept, message)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,348 @@
+package runamqp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/run-amqp/helpers"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newOutboxTestStore(t *testing.T, path string) *FileOutboxStore {
+	store, err := NewFileOutboxStore(path)
+	assertNoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestFileOutboxStoreKeepsPendingMessagesWhenOpenedAgain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	store := newOutboxTestStore(t, path)
+
+	for _, body := range []string{"first", "second", "third"} {
+		_, err := store.Append(OutboxMessage{Body: []byte(body), Options: &PublishOptions{Pattern: "orders." + body}})
+		assertNoError(t, err)
+	}
+
+	assertNoError(t, store.Remove([]uint64{2}))
+	assertNoError(t, store.Close())
+
+	reopened := newOutboxTestStore(t, path)
+
+	pending, err := reopened.Pending(10)
+	assertNoError(t, err)
+
+	if len(pending) != 2 || string(pending[0].Body) != "first" || string(pending[1].Body) != "third" {
+		t.Fatal("expected the first and third messages to be pending but got", pending)
+	}
+
+	if pending[1].ID != 3 || pending[1].Options.Pattern != "orders.third" {
+		t.Error("expected the message to be read back as it was stored", pending[1])
+	}
+
+	id, err := reopened.Append(OutboxMessage{Body: []byte("fourth")})
+	assertNoError(t, err)
+
+	if id != 4 {
+		t.Error("expected the IDs to carry on from the ones in the file but got", id)
+	}
+}
+
+func TestFileOutboxStoreKeepsTheTypesOfHeaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	sent := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	headers := map[string]interface{}{
+		"attempt":  int64(3),
+		"priority": int32(2),
+		"ratio":    float32(0.5),
+		"sent":     sent,
+		"checksum": []byte{1, 2, 3},
+		"format":   "pdf",
+		"urgent":   true,
+		"nothing":  nil,
+		"tags":     []interface{}{"a", int16(1)},
+		"nested":   amqp.Table{"count": int64(1 << 40)},
+	}
+
+	store := newOutboxTestStore(t, path)
+	_, err := store.Append(OutboxMessage{Body: payload, Options: &PublishOptions{Pattern: "orders", Headers: headers}})
+	assertNoError(t, err)
+	assertNoError(t, store.Close())
+
+	reopened := newOutboxTestStore(t, path)
+	pending, err := reopened.Pending(1)
+	assertNoError(t, err)
+
+	if len(pending) != 1 || pending[0].Options.Pattern != "orders" {
+		t.Fatal("expected the message to be read back", pending)
+	}
+
+	if !reflect.DeepEqual(pending[0].Options.Headers, headers) {
+		t.Errorf("expected the headers to be read back with their types\n%#v\n%#v", headers, pending[0].Options.Headers)
+	}
+
+	if _, err := reopened.Append(OutboxMessage{Options: &PublishOptions{Headers: map[string]interface{}{"unsupported": struct{}{}}}}); err == nil {
+		t.Error("expected a header rabbit does not support to be refused")
+	}
+}
+
+func TestFileOutboxStoreEmptiesTheFileOnceNothingIsPending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	store := newOutboxTestStore(t, path)
+
+	id, err := store.Append(OutboxMessage{Body: payload})
+	assertNoError(t, err)
+	assertNoError(t, store.Remove([]uint64{id}))
+
+	info, err := os.Stat(path)
+	assertNoError(t, err)
+
+	if info.Size() != 0 {
+		t.Error("expected the file to be emptied but it has", info.Size(), "bytes")
+	}
+}
+
+func TestFileOutboxStoreCompactsRemovedMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	store := newOutboxTestStore(t, path)
+
+	_, err := store.Append(OutboxMessage{Body: []byte("kept")})
+	assertNoError(t, err)
+
+	for i := 0; i < compactOutboxAfter; i++ {
+		id, err := store.Append(OutboxMessage{Body: payload})
+		assertNoError(t, err)
+		assertNoError(t, store.Remove([]uint64{id}))
+	}
+
+	_, err = store.Append(OutboxMessage{Body: []byte("after")})
+	assertNoError(t, err)
+	assertNoError(t, store.Close())
+
+	reopened := newOutboxTestStore(t, path)
+
+	pending, err := reopened.Pending(10)
+	assertNoError(t, err)
+
+	if len(pending) != 2 || string(pending[0].Body) != "kept" || string(pending[1].Body) != "after" {
+		t.Error("expected only the pending messages to be left after compacting but got", pending)
+	}
+}
+
+func TestFileOutboxStoreIgnoresALineCutShort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	store := newOutboxTestStore(t, path)
+	_, err := store.Append(OutboxMessage{Body: payload})
+	assertNoError(t, err)
+	assertNoError(t, store.Close())
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	assertNoError(t, err)
+	_, err = file.WriteString(`{"append":{"ID":2,"Bo`)
+	assertNoError(t, err)
+	assertNoError(t, file.Close())
+
+	reopened := newOutboxTestStore(t, path)
+	_, err = reopened.Append(OutboxMessage{Body: []byte("next")})
+	assertNoError(t, err)
+	assertNoError(t, reopened.Close())
+
+	pending, err := newOutboxTestStore(t, path).Pending(10)
+	assertNoError(t, err)
+
+	if len(pending) != 2 || string(pending[1].Body) != "next" {
+		t.Error("expected the unfinished line to be dropped but got", pending)
+	}
+}
+
+func newOutboxTestPublisher(t *testing.T, size int) *Publisher {
+	c := NewPublisherConfig{
+		URL:          testRabbitURI,
+		ExchangeName: "exchange",
+		ExchangeType: Fanout,
+		Logger:       helpers.NewTestLogger(t),
+		Outbox:       newOutboxTestStore(t, filepath.Join(t.TempDir(), "outbox")),
+		OutboxSize:   size,
+	}
+	config := c.Config()
+
+	if !config.confirmable {
+		t.Error("expected a publisher with an outbox to be confirmable")
+	}
+
+	return &Publisher{config: config, outbox: newOutbox(config)}
+}
+
+func TestPublishStoresMessagesInTheOutboxWhenNotReady(t *testing.T) {
+	publisher := newOutboxTestPublisher(t, 2)
+
+	assertNoError(t, publisher.Publish([]byte("first"), nil))
+	assertNoError(t, publisher.Publish([]byte("second"), &PublishOptions{Pattern: "orders"}))
+
+	if err := publisher.Publish([]byte("third"), nil); !errors.Is(err, ErrOutboxFull) {
+		t.Error("expected the outbox to be full but got", err)
+	}
+
+	if err := publisher.Publish(payload, &PublishOptions{TTL: time.Microsecond}); err == nil || errors.Is(err, ErrOutboxFull) {
+		t.Error("expected invalid options to be returned rather than stored but got", err)
+	}
+
+	stats, err := publisher.OutboxStats()
+	assertNoError(t, err)
+
+	if stats != (OutboxStats{Pending: 2, Stored: 2, Rejected: 1}) {
+		t.Error("unexpected stats", stats)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := publisher.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected flushing to give up with the messages left but got", err)
+	}
+}
+
+func TestPublishAfterAndPublishBatchStoreMessagesInTheOutboxWhenNotReady(t *testing.T) {
+	publisher := newOutboxTestPublisher(t, 10)
+
+	if err := publisher.PublishAfter(payload, time.Minute, nil); !errors.Is(err, errNoDelayMode) {
+		t.Error("expected a message which can never be delayed to be returned rather than stored but got", err)
+	}
+
+	publisher.config.delay = DelayQueues
+
+	assertNoError(t, publisher.PublishAfter([]byte("delayed"), time.Minute, nil))
+
+	results, err := publisher.PublishBatch(context.Background(), []BatchMessage{
+		{Body: []byte("batched")},
+		{Body: payload, Options: &PublishOptions{TTL: time.Microsecond}},
+	})
+	assertNoError(t, err)
+
+	if failed := results.Failed(); len(failed) != 1 || string(failed[0].Body) != string(payload) {
+		t.Error("expected only the invalid message of the batch to fail but got", results.Err())
+	}
+
+	pending, err := publisher.outbox.store.Pending(10)
+	assertNoError(t, err)
+
+	if len(pending) != 2 || string(pending[0].Body) != "delayed" || string(pending[1].Body) != "batched" {
+		t.Fatal("expected the delayed and batched messages to be stored but got", pending)
+	}
+
+	if delay := pending[0].delay(); delay <= 50*time.Second || delay > time.Minute {
+		t.Error("expected the delayed message to be stored with the time it is due, but it is due in", delay)
+	}
+
+	if pending[1].delay() != 0 {
+		t.Error("did not expect the batched message to be delayed")
+	}
+}
+
+func TestPublishDoesNotOvertakeTheOutbox(t *testing.T) {
+	publisher := newOutboxTestPublisher(t, 10)
+	publisher.publishReady.Store(true)
+
+	if !publisher.holdEmptyOutbox() {
+		t.Fatal("expected to publish straight away when nothing is waiting in the outbox")
+	}
+	publisher.outbox.draining.Unlock()
+
+	// while the outbox is being published from the message has to wait its turn, even when the store looks empty
+	publisher.outbox.draining.Lock()
+	if publisher.holdEmptyOutbox() {
+		t.Error("expected the message to be stored while the outbox is being published from")
+	}
+	publisher.outbox.draining.Unlock()
+
+	assertNoError(t, publisher.outbox.append(payload, nil, 0))
+
+	if publisher.holdEmptyOutbox() {
+		t.Error("expected the message to be stored behind the one waiting in the outbox")
+	}
+}
+
+func TestOnlyTheMessagesBeforeAFailureAreRemovedFromTheOutbox(t *testing.T) {
+	pending := []OutboxMessage{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+	results := BatchResults{{}, {Err: errors.New("not confirmed")}, {}, {}}
+
+	if published := publishedInOrder(pending, results); len(published) != 1 || published[0] != 1 {
+		t.Error("expected only the message before the failed one to be removed, got", published)
+	}
+}
+
+func TestNewPublisherWithAnOutboxDoesNotWaitForRabbit(t *testing.T) {
+	c := NewPublisherConfig{
+		URL:          unreachableRabbitURI,
+		ExchangeName: "exchange",
+		ExchangeType: Fanout,
+		Logger:       helpers.NewTestLogger(t),
+		Outbox:       newOutboxTestStore(t, filepath.Join(t.TempDir(), "outbox")),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	publisher, err := NewPublisherContext(ctx, c.Config())
+	assertNoError(t, err)
+	defer publisher.Close()
+
+	assertNoError(t, publisher.Publish(payload, nil))
+
+	stats, err := publisher.OutboxStats()
+	assertNoError(t, err)
+
+	if stats.Pending != 1 {
+		t.Error("expected the message to wait in the outbox but got", stats)
+	}
+}
+
+func TestPublisherOutboxIsPublishedOnceReady(t *testing.T) {
+	t.Parallel()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{})
+
+	consumer := NewConsumer(consumerConfig)
+	assertReady(t, consumer.QueuesBound)
+	defer consumer.Close()
+
+	store := newOutboxTestStore(t, filepath.Join(t.TempDir(), "outbox"))
+	_, err := store.Append(OutboxMessage{Body: []byte("stored while rabbit was down")})
+	assertNoError(t, err)
+
+	publisherConfig := consumerConfig.NewPublisherConfig()
+	publisherConfig.confirmable = true
+	publisherConfig.outbox = store
+
+	publisher, err := NewPublisher(publisherConfig)
+	assertNoError(t, err)
+
+	message := getMessage(t, consumer.Messages)
+	if string(message.Body()) != "stored while rabbit was down" {
+		t.Error("expected the stored message to be published but got", string(message.Body()))
+	}
+	assertNoError(t, message.Ack())
+
+	assertNoError(t, publisher.Publish(payload, nil))
+	publisher.Close()
+
+	message = getMessage(t, consumer.Messages)
+	assertNoError(t, message.Ack())
+
+	stats, err := publisher.OutboxStats()
+	assertNoError(t, err)
+
+	if stats.Pending != 0 || stats.Published != 1 {
+		t.Error("expected the outbox to be empty but got", stats)
+	}
+}
@@ -7,12 +7,12 @@ import (
 )
 
 type alwaysAckingHandler struct {
-	messageRecieved string
+	messageRecieved chan string
 }
 
 func (a *alwaysAckingHandler) Handle(msg Message) {
-	a.messageRecieved = string(msg.Body())
 	_ = msg.Ack()
+	a.messageRecieved <- string(msg.Body())
 }
 
 func (a *alwaysAckingHandler) Name() string {
@@ -33,16 +33,19 @@ func TestConsumerProcessesMessages(t *testing.T) {
 		},
 	}
 
-	handler := &alwaysAckingHandler{}
+	handler := &alwaysAckingHandler{messageRecieved: make(chan string, 1)}
 
 	consumer.Process(handler, 5)
 
 	msg := NewStubMessage("hello, world")
 	messages <- msg
 
-	time.Sleep(10 * time.Millisecond)
-
-	if handler.messageRecieved != "hello, world" {
+	select {
+	case received := <-handler.messageRecieved:
+		if received != "hello, world" {
+			t.Error("Handler was called with", received)
+		}
+	case <-time.After(time.Second):
 		t.Error("Handler was not called")
 	}
 
@@ -1,6 +1,10 @@
 package runamqp
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
 
 // PublishOptions will enable options being sent with the message
 type PublishOptions struct {
@@ -10,8 +14,23 @@ type PublishOptions struct {
 	PublishToQueue string
 	// Pattern is the routing key between the exchange and queues
 	Pattern string
+	// Headers are sent with the message, a Headers exchange routes on them
+	Headers map[string]interface{}
+	// TTL is how long the message is kept in a queue before it expires, it is dropped then unless the queue dead-letters expired messages. Rounded down to the millisecond
+	TTL time.Duration
 }
 
 func (p PublishOptions) String() string {
-	return fmt.Sprintf(`Priority: "%d" Publish to queue: "%s" Pattern "%s"`, p.Priority, p.PublishToQueue, p.Pattern)
+	return fmt.Sprintf(`Priority: "%d" Publish to queue: "%s" Pattern "%s" Headers "%v" TTL "%s"`, p.Priority, p.PublishToQueue, p.Pattern, p.Headers, p.TTL)
+}
+
+// expiration is the TTL as the expiration property of a message, which is in milliseconds
+func (p PublishOptions) expiration() (string, error) {
+	if p.TTL == 0 {
+		return "", nil
+	}
+	if p.TTL < time.Millisecond {
+		return "", fmt.Errorf("the TTL %s of the message has to be at least a millisecond", p.TTL)
+	}
+	return strconv.FormatInt(p.TTL.Milliseconds(), 10), nil
 }
@@ -0,0 +1,23 @@
+package runamqp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishOptionsExpiration(t *testing.T) {
+	expiration, err := PublishOptions{TTL: 1500 * time.Millisecond}.expiration()
+	assertNoError(t, err)
+
+	if expiration != "1500" {
+		t.Error("expected the TTL in milliseconds but got", expiration)
+	}
+
+	if expiration, _ := (PublishOptions{}).expiration(); expiration != "" {
+		t.Error("expected no expiration without a TTL but got", expiration)
+	}
+
+	if _, err := (PublishOptions{TTL: time.Microsecond}).expiration(); err == nil {
+		t.Error("expected a TTL under a millisecond to be rejected")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type publisher interface {
@@ -80,6 +82,8 @@ func (p *publisherServer) entry(w http.ResponseWriter, r *http.Request) {
 	var body []byte
 	var priority uint8
 	var publishToQueue string
+	var headers map[string]interface{}
+	var ttl string
 
 	if contentTypes, ok := r.Header["Content-Type"]; ok && contentTypes[0] == "application/x-www-form-urlencoded" {
 
@@ -94,6 +98,8 @@ func (p *publisherServer) entry(w http.ResponseWriter, r *http.Request) {
 		body = []byte(r.Form.Get("message"))
 		priority = getMessagePriority(p, r.Form.Get("priority"))
 		publishToQueue = r.Form.Get("publishToQueue")
+		headers = getMessageHeaders(r.Form.Get("headers"))
+		ttl = r.Form.Get("ttl")
 
 	} else {
 
@@ -110,11 +116,20 @@ func (p *publisherServer) entry(w http.ResponseWriter, r *http.Request) {
 		pattern = r.URL.Query().Get("pattern")
 		priority = getMessagePriority(p, r.URL.Query().Get("priority"))
 		publishToQueue = r.URL.Query().Get("publishToQueue")
+		headers = getMessageHeaders(r.URL.Query().Get("headers"))
+		ttl = r.URL.Query().Get("ttl")
 	}
 
-	options := &PublishOptions{Priority: priority, Pattern: pattern, PublishToQueue: publishToQueue}
+	messageTTL, err := getMessageTTL(ttl)
 
-	err := p.publisher.Publish(body, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options := &PublishOptions{Priority: priority, Pattern: pattern, PublishToQueue: publishToQueue, Headers: headers, TTL: messageTTL}
+
+	err = p.publisher.Publish(body, options)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -133,6 +148,41 @@ func getMessagePriority(p *publisherServer, value string) uint8 {
 	return uint8(priorityUint64)
 }
 
+// getMessageTTL parses a TTL written as a duration such as "30s", or as a number of milliseconds
+func getMessageTTL(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	if milliseconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(milliseconds) * time.Millisecond, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf(`the ttl "%s" is not a duration such as 30s or a number of milliseconds`, value)
+	}
+
+	return ttl, nil
+}
+
+// getMessageHeaders parses headers written as key=value pairs separated by commas, such as "format=pdf,type=report"
+func getMessageHeaders(value string) map[string]interface{} {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	headers := make(map[string]interface{})
+	for _, pair := range strings.Split(value, ",") {
+		key, headerValue, _ := strings.Cut(pair, "=")
+		if key = strings.TrimSpace(key); key != "" {
+			headers[key] = strings.TrimSpace(headerValue)
+		}
+	}
+	return headers
+}
+
 func (p *publisherServer) rabbitup(w http.ResponseWriter, _ *http.Request) {
 	p.logger.Debug(p.exchangeName, "Rabbit up hit")
 	if p.publisher.IsReady() {
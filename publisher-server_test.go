@@ -5,9 +5,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mergermarket/run-amqp/helpers"
 )
@@ -183,7 +185,7 @@ func TestPublisherServerEntry_ServeHTTP(t *testing.T) {
 		}
 
 		expectedOptions := PublishOptions{Priority: priority, Pattern: pattern, PublishToQueue: publishToQueue}
-		if *publisher.publishCalledWithOptions != expectedOptions {
+		if !reflect.DeepEqual(*publisher.publishCalledWithOptions, expectedOptions) {
 			t.Error("publisher.PublishWithOptions should have been called with", expectedOptions, "but it was called with", publisher.publishCalledWithOptions)
 		}
 
@@ -209,6 +211,8 @@ func TestPublisherServerEntry_ServeHTTP(t *testing.T) {
 		q.Add("pattern", pattern)
 		q.Add("priority", strconv.Itoa(int(priority)))
 		q.Add("publishToQueue", publishToQueue)
+		q.Add("headers", "format=pdf, type = report")
+		q.Add("ttl", "30s")
 		r.URL.RawQuery = q.Encode()
 
 		publisherServer.ServeHTTP(w, r)
@@ -225,11 +229,32 @@ func TestPublisherServerEntry_ServeHTTP(t *testing.T) {
 			t.Error("publisher.PublishWithOptions should have been called with", message, "but it was called with", publisher.publishCalledWithMessage)
 		}
 
-		expectedOptions := PublishOptions{Priority: priority, Pattern: pattern, PublishToQueue: publishToQueue}
-		if *publisher.publishCalledWithOptions != expectedOptions {
+		expectedOptions := PublishOptions{Priority: priority, Pattern: pattern, PublishToQueue: publishToQueue, Headers: map[string]interface{}{"format": "pdf", "type": "report"}, TTL: 30 * time.Second}
+		if !reflect.DeepEqual(*publisher.publishCalledWithOptions, expectedOptions) {
 			t.Error("publisher.PublishWithOptions should have been called with", expectedOptions, "but it was called with", publisher.publishCalledWithOptions)
 		}
 
 	})
 
+	t.Run("/entry should return 400 on POST with an invalid ttl", func(t *testing.T) {
+
+		publisher := new(stubPublisher)
+		publisher.ready = true
+
+		publisherServer := newPublisherServer(publisher, testExchangeName, logger)
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(http.MethodPost, "/entry?ttl=soon", strings.NewReader("some string"))
+		publisherServer.ServeHTTP(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Error("expected", http.StatusBadRequest, "but got", w.Code)
+		}
+
+		if publisher.publishCalled {
+			t.Error("did not expect the message to be published")
+		}
+
+	})
+
 }
@@ -1,33 +1,86 @@
 package runamqp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mergermarket/run-amqp/connection"
 	amqp "github.com/rabbitmq/amqp091-go"
-	"time"
 )
 
 // Publisher provides a means of publishing to an exchange and is a http handler providing endpoints of GET /rabbitup, POST /entry
 type Publisher struct {
-	currentAmqpChannel *amqp.Channel
-	config             PublisherConfig
-	router             *publisherServer
-	publishReady       bool
+	channels          connection.ChannelPool
+	batchChannels     connection.ChannelPool
+	config            PublisherConfig
+	router            *publisherServer
+	publishReady      atomic.Bool
+	ready             chan struct{}
+	readyOnce         sync.Once
+	connectionManager connection.ConnectionManager
+	ownsConnection    bool
+	progress          *setUpProgress
+	delayQueues       delayQueues
+	outbox            *outbox
+	ctx               context.Context
+	cancel            context.CancelFunc
 }
 
-// Publish will publish a message to an exchange
+// Publish will publish a message to an exchange. It borrows a channel from the publisher's pool, so it can be called from many goroutines at once. When the publisher is confirmable it waits for the broker to confirm the message. With an Outbox the messages which can not be published are stored to be published later.
 func (p *Publisher) Publish(msg []byte, options *PublishOptions) error {
+	if p.outbox != nil {
+		return p.publishThroughOutbox(msg, options, 0)
+	}
+	return p.publish(msg, options, 0)
+}
+
+func (p *Publisher) publish(msg []byte, options *PublishOptions, delay time.Duration) error {
 
-	if !p.publishReady {
+	if !p.publishReady.Load() {
 		return fmt.Errorf("unable to publish %s, not ready to publish, try later", string(msg))
 	}
 
-	exchangeName := p.config.exchange.Name
+	exchangeName, pattern, publishing, err := p.prepare(msg, options, delay)
+
+	if err != nil {
+		return err
+	}
+
+	confirmation, err := p.publishOnPooledChannel(exchangeName, pattern, publishing)
+
+	if err != nil {
+		p.config.Logger.Error(err)
+		return fmt.Errorf("failed to publish message with error: %s", err.Error())
+	}
+
+	if confirmation != nil && !confirmation.Wait() {
+		return fmt.Errorf(`the message published to exchange "%s" was not confirmed by the broker`, exchangeName)
+	}
+
+	if pattern != "" || publishing.Headers != nil || publishing.Expiration != "" {
+		message := fmt.Sprintf(`Published "%s" to exchange "%s" with options: %s`, string(msg), exchangeName, options)
+		p.config.Logger.Debug(message)
+
+	} else {
+		message := fmt.Sprintf(`Published "%s"`, string(msg))
+		p.config.Logger.Debug(message)
+	}
+
+	return nil
+}
+
+// prepare returns the exchange and routing key to publish msg to with options, along with the message itself
+func (p *Publisher) prepare(msg []byte, options *PublishOptions, delay time.Duration) (exchangeName, pattern string, publishing amqp.Publishing, err error) {
+	exchangeName = p.config.exchange.Name
 
-	var pattern string
 	var priority uint8
+	var headers amqp.Table
+	var expiration string
 
 	if options != nil {
 		pattern = options.Pattern
@@ -38,57 +91,131 @@ func (p *Publisher) Publish(msg []byte, options *PublishOptions) error {
 		}
 
 		priority = options.Priority
-	}
 
-	err := p.currentAmqpChannel.Publish(
-		exchangeName,
-		pattern,
-		true,
-		false,
-		amqp.Publishing{
-			Body:         msg,
-			Priority:     priority,
-			DeliveryMode: amqp.Persistent,
-		},
-	)
+		if len(options.Headers) > 0 {
+			headers = amqp.Table(options.Headers)
+		}
 
-	if err != nil {
-		p.config.Logger.Error(err)
-		return fmt.Errorf("failed to publish message with error: %s", err.Error())
+		if expiration, err = options.expiration(); err != nil {
+			return "", "", amqp.Publishing{}, err
+		}
 	}
 
-	if pattern != "" {
-		message := fmt.Sprintf(`Published "%s" to exchange "%s" with options: %s`, string(msg), exchangeName, options)
-		p.config.Logger.Debug(message)
+	if delay > 0 {
+		if err = p.validDelay(delay, exchangeName, pattern, expiration); err != nil {
+			return "", "", amqp.Publishing{}, err
+		}
 
-	} else {
-		message := fmt.Sprintf(`Published "%s"`, string(msg))
-		p.config.Logger.Debug(message)
+		if exchangeName, headers, err = p.delayed(delay, headers); err != nil {
+			return "", "", amqp.Publishing{}, err
+		}
 	}
 
-	return nil
+	publishing = amqp.Publishing{
+		Body:         msg,
+		Headers:      headers,
+		Priority:     priority,
+		DeliveryMode: amqp.Persistent,
+		Expiration:   expiration,
+	}
+
+	return exchangeName, pattern, publishing, nil
+}
+
+// publishOnPooledChannel publishes on a borrowed channel, when the channel turns out to be closed the publish is tried once more on a fresh one
+func (p *Publisher) publishOnPooledChannel(exchangeName, pattern string, publishing amqp.Publishing) (*amqp.DeferredConfirmation, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var ch *amqp.Channel
+		ch, err = p.channels.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		var confirmation *amqp.DeferredConfirmation
+		confirmation, err = ch.PublishWithDeferredConfirm(exchangeName, pattern, true, false, publishing)
+		p.channels.Put(ch)
+
+		if !errors.Is(err, amqp.ErrClosed) {
+			return confirmation, err
+		}
+	}
+	return nil, err
 }
 
 // IsReady return true when the publisher is ready to Publish
 func (p *Publisher) IsReady() bool {
-	return p.publishReady
+	return p.publishReady.Load()
 }
 
-// NewPublisher returns a function to send messages to the exchange defined in your config. This will create a managed connection to rabbit, so you should only create this once in your application.
+// NewPublisher returns a function to send messages to the exchange defined in your config, waiting up to 30 seconds for it to be ready. This will create a managed connection to rabbit, so you should only create this once in your application, or use a Client to share the connection.
 func NewPublisher(config PublisherConfig) (*Publisher, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSetUpTimeout)
+	defer cancel()
+	return NewPublisherContext(ctx, config)
+}
+
+// NewPublisherContext returns a Publisher once it is ready to publish, or straight away when it has an Outbox. If ctx is done before then, it returns a *SetupError describing the step it got stuck on and closes everything it opened.
+func NewPublisherContext(ctx context.Context, config PublisherConfig) (*Publisher, error) {
+	return newPublisherContext(ctx, config, config.newConnectionManager(), true)
+}
+
+const defaultSetUpTimeout = 30 * time.Second
+
+func newPublisherContext(ctx context.Context, config PublisherConfig, connectionManager connection.ConnectionManager, ownsConnection bool) (*Publisher, error) {
+	if err := validTopology(config.Topology()); err != nil {
+		if ownsConnection {
+			connectionManager.Close()
+		}
+		return nil, err
+	}
+
 	p := new(Publisher)
 	p.config = config
+	p.connectionManager = connectionManager
+	p.ownsConnection = ownsConnection
+	p.ready = make(chan struct{})
+	p.progress = new(setUpProgress)
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 	p.router = newPublisherServer(p, config.exchange.Name, config.Logger)
+	p.channels = connectionManager.NewChannelPool(config.exchange.Name, config.channelPoolSize, p.setUpPooledChannel)
+	p.batchChannels = p.channels
+	if !config.confirmable {
+		// batches wait for the broker to confirm every message, so they are published on confirm channels of their own
+		p.batchChannels = connectionManager.NewChannelPool(config.exchange.Name+" batches", config.channelPoolSize, p.setUpConfirmChannel)
+	}
+	p.outbox = newOutbox(config)
 
 	go p.listenForOpenedAMQPChannel()
 
+	// with an outbox the messages are stored until rabbit is reachable, so there is no need to wait for it
+	if p.outbox != nil {
+		go p.publishFromOutbox()
+		return p, nil
+	}
+
 	select {
-	case <-p.waitForReady():
+	case <-p.ready:
 		return p, nil
-	case <-time.After(30 * time.Second):
-		return nil, fmt.Errorf("timed out waiting to create publisher %+v", config)
+	case <-ctx.Done():
+		err := p.progress.timedOut(connectionManager, ctx.Err())
+		p.Close()
+		return nil, err
 	}
+}
 
+// Close closes the publisher's channels, as well as its connection unless it was made by a Client. When connected, the messages in the Outbox are published first for up to the OutboxFlushTimeout.
+func (p *Publisher) Close() {
+	p.flushOnClose()
+	p.publishReady.Store(false)
+	p.cancel()
+	p.channels.Close()
+	if p.batchChannels != p.channels {
+		p.batchChannels.Close()
+	}
+	if p.ownsConnection {
+		p.connectionManager.Close()
+	}
 }
 
 func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -96,75 +223,61 @@ func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (p *Publisher) listenForOpenedAMQPChannel() {
-	connectionManager := connection.NewConnectionManager(p.config.URL, p.config.Logger)
-	for ch := range connectionManager.OpenChannel(p.config.exchange.Name) {
-		p.publishReady = false
+	for ch := range p.connectionManager.OpenChannelContext(p.ctx, p.config.exchange.Name) {
+		p.publishReady.Store(false)
 		setupCurrentChannel(p, ch)
 	}
 }
 
 func setupCurrentChannel(p *Publisher, ch *amqp.Channel) {
-	p.currentAmqpChannel = ch
+	topology, err := p.config.Topology()
 
-	err := makeExchange(p.currentAmqpChannel, p.config.exchange.Name, p.config.exchange.Type)
+	if err == nil {
+		err = topology.applyWith(ch, p.config.topologyMode, p.connectionManager)
+	}
 
 	if err != nil {
 		p.config.Logger.Error(fmt.Sprintf(`failed to create the exchange "%s" with error "%+v"`, p.config.exchange.Name, err))
-		p.publishReady = false
+		p.progress.failed(err)
 		return
 	}
 
-	p.listenForReturnedMessages()
-	if p.config.confirmable {
-		p.setupConfirmChannel()
+	p.publishReady.Store(true)
+	if p.outbox != nil {
+		p.outbox.wakeUp()
 	}
-	p.publishReady = true
+	p.readyOnce.Do(func() {
+		close(p.ready)
+	})
 	p.config.Logger.Info("Ready to publish")
 }
 
-func (p *Publisher) setupConfirmChannel() {
-	err := p.currentAmqpChannel.Confirm(false)
-	if err != nil {
-		p.config.Logger.Error(fmt.Sprintf(`failed to set up the channel for "%s" as confirm channel: %v`, p.config.exchange.Name, err))
-		return
+func (p *Publisher) setUpPooledChannel(ch *amqp.Channel) error {
+	if p.config.confirmable {
+		return p.setUpConfirmChannel(ch)
 	}
 
-	go func() {
-		confirm := make(chan amqp.Confirmation)
-		confirm = p.currentAmqpChannel.NotifyPublish(confirm)
-
-		for res := range confirm {
-			msg := fmt.Sprintf(`received a confirmation for a message that was published: "%+v" `, res)
-			p.config.Logger.Debug(msg)
-		}
-	}()
+	p.listenForReturnedMessages(ch)
+	return nil
 }
 
-func (p *Publisher) listenForReturnedMessages() {
-	if p.currentAmqpChannel != nil {
-		returnMessage := make(chan amqp.Return)
-		p.currentAmqpChannel.NotifyReturn(returnMessage)
-
-		go func() {
-			for msg := range returnMessage {
-				msg := fmt.Sprintf(`A message that was published but returned, Exchange name: "%s" Routing key: "%s" Reply text: "%s"`, msg.Exchange, msg.RoutingKey, msg.ReplyText)
-				p.config.Logger.Info(msg)
-			}
-		}()
+func (p *Publisher) setUpConfirmChannel(ch *amqp.Channel) error {
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf(`failed to set up the channel for "%s" as confirm channel: %v`, p.config.exchange.Name, err)
 	}
 
+	p.listenForReturnedMessages(ch)
+	return nil
 }
 
-func (p *Publisher) waitForReady() chan bool {
-	rdy := make(chan bool)
+func (p *Publisher) listenForReturnedMessages(ch *amqp.Channel) {
+	returnMessage := make(chan amqp.Return)
+	ch.NotifyReturn(returnMessage)
+
 	go func() {
-		for {
-			time.Sleep(10 * time.Millisecond)
-			if p.IsReady() {
-				rdy <- true
-				return
-			}
+		for msg := range returnMessage {
+			msg := fmt.Sprintf(`A message that was published but returned, Exchange name: "%s" Routing key: "%s" Reply text: "%s"`, msg.Exchange, msg.RoutingKey, msg.ReplyText)
+			p.config.Logger.Info(msg)
 		}
 	}()
-	return rdy
 }
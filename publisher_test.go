@@ -51,7 +51,7 @@ func TestNotReadyPublisherErrorsOnPublish(t *testing.T) {
 		t.Fatal("problem creating publisher", err)
 	}
 
-	publisher.publishReady = false
+	publisher.publishReady.Store(false)
 
 	err = publisher.Publish([]byte("whatever"), nil)
 
@@ -59,3 +59,37 @@ func TestNotReadyPublisherErrorsOnPublish(t *testing.T) {
 		t.Error("Should get an error")
 	}
 }
+
+func TestPublisherPublishesConcurrentlyOnItsChannelPool(t *testing.T) {
+	t.Parallel()
+
+	c := NewPublisherConfig{
+		URL:             testRabbitURI,
+		ExchangeName:    "chris-rulz" + randomString(5),
+		ExchangeType:    Fanout,
+		Confirmable:     true,
+		Logger:          helpers.NewTestLogger(t),
+		ChannelPoolSize: 4,
+	}
+
+	publisher, err := NewPublisher(c.Config())
+
+	if err != nil {
+		t.Fatal("problem creating publisher", err)
+	}
+
+	const numberOfPublishes = 50
+	errs := make(chan error, numberOfPublishes)
+
+	for i := 0; i < numberOfPublishes; i++ {
+		go func() {
+			errs <- publisher.Publish([]byte("whatever"), nil)
+		}()
+	}
+
+	for i := 0; i < numberOfPublishes; i++ {
+		if err := <-errs; err != nil {
+			t.Error("Should not get an error", err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package runamqp
+
+import (
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// QueueType is the type of the queues declared for a consumer, it applies to the main queue, the DLQ and the retry queue alike
+type QueueType string
+
+const (
+	// Classic queues are the default, they are declared without an x-queue-type so existing queues keep matching
+	Classic QueueType = "classic"
+
+	// Quorum queues are replicated across the cluster, they do not support MaxPriority
+	Quorum QueueType = "quorum"
+
+	// Stream queues are append-only logs, they are read with a StreamConsumer rather than a Consumer
+	Stream QueueType = "stream"
+)
+
+// DeadLetterStrategy is how a quorum queue dead-letters messages
+type DeadLetterStrategy string
+
+const (
+	// AtMostOnce dead-letters messages without confirming them, which is rabbit's default
+	AtMostOnce DeadLetterStrategy = "at-most-once"
+
+	// AtLeastOnce keeps messages in the queue until the dead-letter exchange confirms them, it needs the queue to reject publishes when it overflows
+	AtLeastOnce DeadLetterStrategy = "at-least-once"
+)
+
+// queueTypeArguments returns the arguments every queue of the consumer is declared with for its queue type, and whether the queue dead-letters
+func (q queue) queueTypeArguments(deadLetters bool) (amqp.Table, error) {
+	args := amqp.Table{}
+
+	switch q.Type {
+	case "", Classic:
+		if q.DeliveryLimit > 0 {
+			return nil, fmt.Errorf("a delivery limit can only be set on quorum queues")
+		}
+		if q.DeadLetterStrategy != "" {
+			return nil, fmt.Errorf("a dead letter strategy can only be set on quorum queues")
+		}
+	case Quorum:
+		args["x-queue-type"] = string(Quorum)
+
+		if q.MaxPriority > 0 {
+			return nil, fmt.Errorf("quorum queues do not support a max priority")
+		}
+
+		switch q.DeadLetterStrategy {
+		case "":
+		case AtMostOnce:
+			if deadLetters {
+				args["x-dead-letter-strategy"] = string(AtMostOnce)
+			}
+		case AtLeastOnce:
+			if deadLetters {
+				args["x-dead-letter-strategy"] = string(AtLeastOnce)
+				args["x-overflow"] = "reject-publish"
+			}
+		default:
+			return nil, fmt.Errorf("unrecognised dead letter strategy %s", q.DeadLetterStrategy)
+		}
+	case Stream:
+		return nil, fmt.Errorf("streams can not be consumed with a Consumer, use a StreamConsumer instead")
+	default:
+		return nil, fmt.Errorf("unrecognised queue type %s", q.Type)
+	}
+
+	return args, nil
+}
+
+// Overflow is what a queue does with new messages once it has reached its MaxLength or MaxLengthBytes
+type Overflow string
+
+const (
+	// DropHead discards the oldest messages in the queue to make room
+	DropHead Overflow = "drop-head"
+
+	// RejectPublish rejects new messages, publishers only find out when they are confirmable
+	RejectPublish Overflow = "reject-publish"
+
+	// RejectPublishDLX rejects new messages and dead-letters them, to the DLE for the main queue. It is not supported by quorum queues.
+	RejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// QueueLimits bound the size of a queue and how long its messages are kept. The zero value leaves the queue unbounded.
+type QueueLimits struct {
+	// MaxLength is the most messages the queue holds
+	MaxLength int
+	// MaxLengthBytes is the most bytes of message bodies the queue holds
+	MaxLengthBytes int64
+	// Overflow is what happens once either maximum is reached, it defaults to RejectPublish for the main and retry queues, so live messages are not lost silently, and to DropHead for the DLQ, so it keeps the latest failures
+	Overflow Overflow
+	// MessageTTL is how long a message is kept in the queue, it can not be set for the retry queue whose TTL is the RequeueTTL
+	MessageTTL time.Duration
+	// Expires deletes the queue once it has had no consumers for this long, so it can only be set for the main queue
+	Expires time.Duration
+}
+
+type queueRole string
+
+const (
+	mainQueueRole       queueRole = "main queue"
+	deadLetterQueueRole queueRole = "DLQ"
+	retryQueueRole      queueRole = "retry queue"
+)
+
+func (l QueueLimits) bounded() bool {
+	return l.MaxLength > 0 || l.MaxLengthBytes > 0
+}
+
+// addArguments adds the limits to args, checking they make sense for the role and type of the queue
+func (l QueueLimits) addArguments(args amqp.Table, role queueRole, queueType QueueType) error {
+	if l.MaxLength < 0 || l.MaxLengthBytes < 0 || l.MessageTTL < 0 || l.Expires < 0 {
+		return fmt.Errorf("the limits of the %s can not be negative", role)
+	}
+
+	if l.MaxLength > 0 {
+		args["x-max-length"] = l.MaxLength
+	}
+
+	if l.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = l.MaxLengthBytes
+	}
+
+	overflow := l.Overflow
+	if overflow == "" && l.bounded() {
+		overflow = RejectPublish
+		if role == deadLetterQueueRole {
+			overflow = DropHead
+		}
+	}
+
+	switch overflow {
+	case "":
+	case DropHead, RejectPublish, RejectPublishDLX:
+		if !l.bounded() {
+			return fmt.Errorf("an overflow for the %s needs a MaxLength or MaxLengthBytes", role)
+		}
+		if overflow == RejectPublishDLX && queueType == Quorum {
+			return fmt.Errorf("quorum queues do not support the overflow %s", overflow)
+		}
+		if overflow == RejectPublishDLX && role == deadLetterQueueRole {
+			return fmt.Errorf("the %s has no dead letter exchange to overflow to", role)
+		}
+		if existing, found := args["x-overflow"]; found && existing != string(overflow) {
+			return fmt.Errorf("the %s has to overflow with %s for its dead letter strategy", role, existing)
+		}
+		args["x-overflow"] = string(overflow)
+	default:
+		return fmt.Errorf("unrecognised overflow %s", overflow)
+	}
+
+	if l.MessageTTL > 0 {
+		if role == retryQueueRole {
+			return fmt.Errorf("the message TTL of the %s is the RequeueTTL", role)
+		}
+		if l.MessageTTL < time.Millisecond {
+			return fmt.Errorf("the message TTL of the %s has to be at least a millisecond", role)
+		}
+		args["x-message-ttl"] = l.MessageTTL.Milliseconds()
+	}
+
+	if l.Expires > 0 {
+		if role != mainQueueRole {
+			return fmt.Errorf("the %s has no consumers, so it would expire while it is in use", role)
+		}
+		if l.Expires < time.Millisecond {
+			return fmt.Errorf("the expiry of the %s has to be at least a millisecond", role)
+		}
+		args["x-expires"] = l.Expires.Milliseconds()
+	}
+
+	return nil
+}
+
+func (c ConsumerConfig) mainQueueArguments() (amqp.Table, error) {
+	deadLetters := c.queue.Type == Quorum && c.queue.DeliveryLimit > 0 || c.queue.MainLimits.Overflow == RejectPublishDLX || c.queue.DeadLetterExpired
+
+	args, err := c.queue.queueTypeArguments(deadLetters)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.queue.Ephemeral {
+		if c.queue.Type != "" && c.queue.Type != Classic {
+			return nil, fmt.Errorf("ephemeral queues are exclusive to their consumer, which only classic queues can be")
+		}
+		if c.queue.SingleActive {
+			return nil, fmt.Errorf("ephemeral queues have only one consumer, they can not have a single active consumer")
+		}
+		if deadLetters {
+			return nil, fmt.Errorf("ephemeral consumers have no DLE to dead-letter to")
+		}
+	}
+
+	if c.queue.MaxPriority > 0 {
+		args["x-max-priority"] = c.queue.MaxPriority
+	}
+
+	if c.queue.SingleActive {
+		if c.queue.Exclusive {
+			return nil, fmt.Errorf("a consumer can either be exclusive or single active, not both")
+		}
+		args["x-single-active-consumer"] = true
+	}
+
+	if deadLetters {
+		args["x-dead-letter-exchange"] = c.exchange.DLE
+	}
+
+	if c.queue.DeliveryLimit > 0 {
+		args["x-delivery-limit"] = c.queue.DeliveryLimit
+	}
+
+	if err := c.queue.MainLimits.addArguments(args, mainQueueRole, c.queue.Type); err != nil {
+		return nil, err
+	}
+
+	return args, nil
+}
+
+func (c ConsumerConfig) deadLetterQueueArguments() (amqp.Table, error) {
+	args, err := c.queue.queueTypeArguments(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.queue.DLQLimits.addArguments(args, deadLetterQueueRole, c.queue.Type); err != nil {
+		return nil, err
+	}
+
+	return args, nil
+}
+
+func (c ConsumerConfig) retryQueueArguments() (amqp.Table, error) {
+	args, err := c.queue.queueTypeArguments(true)
+	if err != nil {
+		return nil, err
+	}
+
+	args["x-dead-letter-exchange"] = c.exchange.RetryNow
+	if !c.queue.RetryTTLPerMessage {
+		args["x-message-ttl"] = c.queue.RequeueTTL
+	}
+	args["x-dead-letter-routing-key"] = matchAllPattern
+
+	if err := c.queue.RetryQueueLimits.addArguments(args, retryQueueRole, c.queue.Type); err != nil {
+		return nil, err
+	}
+
+	return args, nil
+}
+
+func (c StreamConsumerConfig) streamArguments() amqp.Table {
+	args := amqp.Table{"x-queue-type": string(Stream)}
+
+	if c.stream.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = c.stream.MaxLengthBytes
+	}
+
+	if c.stream.MaxAge != "" {
+		args["x-max-age"] = c.stream.MaxAge
+	}
+
+	if c.stream.MaxSegmentSizeBytes > 0 {
+		args["x-stream-max-segment-size-bytes"] = c.stream.MaxSegmentSizeBytes
+	}
+
+	return args
+}
@@ -0,0 +1,185 @@
+package runamqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mergermarket/run-amqp/helpers"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newQueueTestConfig(t *testing.T, c NewConsumerConfig) ConsumerConfig {
+	c.URL = testRabbitURI
+	c.ExchangeName = "exchange"
+	c.ExchangeType = Fanout
+	c.Logger = helpers.NewTestLogger(t)
+	c.RequeueTTL = testRequeueTTL
+	c.RequeueLimit = testRequeueLimit
+	c.ServiceName = serviceName
+	c.Prefetch = defaultPrefetch
+	return c.Config()
+}
+
+func TestClassicQueuesAreDeclaredWithoutAQueueType(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{MaxPriority: 5})
+
+	for role, arguments := range map[string]func() (amqp.Table, error){
+		"main":  config.mainQueueArguments,
+		"dlq":   config.deadLetterQueueArguments,
+		"retry": config.retryQueueArguments,
+	} {
+		args, err := arguments()
+		if err != nil {
+			t.Fatal("unexpected error for the", role, "queue", err)
+		}
+		if _, found := args["x-queue-type"]; found {
+			t.Error("did not expect a queue type on the", role, "queue", args)
+		}
+	}
+
+	args, _ := config.mainQueueArguments()
+	if args["x-max-priority"] != uint8(5) {
+		t.Error("expected the max priority on the main queue", args)
+	}
+
+	if _, found := args["x-single-active-consumer"]; found {
+		t.Error("did not expect a single active consumer by default", args)
+	}
+
+	config = newQueueTestConfig(t, NewConsumerConfig{SingleActiveConsumer: true})
+	args, _ = config.mainQueueArguments()
+	if args["x-single-active-consumer"] != true {
+		t.Error("expected the main queue to have a single active consumer", args)
+	}
+}
+
+func TestQuorumAppliesToEveryQueue(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{
+		QueueType:          Quorum,
+		DeliveryLimit:      3,
+		DeadLetterStrategy: AtLeastOnce,
+	})
+
+	main, err := config.mainQueueArguments()
+	assertNoError(t, err)
+
+	dlq, err := config.deadLetterQueueArguments()
+	assertNoError(t, err)
+
+	retry, err := config.retryQueueArguments()
+	assertNoError(t, err)
+
+	for role, args := range map[string]amqp.Table{"main": main, "dlq": dlq, "retry": retry} {
+		if args["x-queue-type"] != "quorum" {
+			t.Error("expected the", role, "queue to be a quorum queue", args)
+		}
+	}
+
+	if main["x-delivery-limit"] != 3 || main["x-dead-letter-exchange"] != config.exchange.DLE {
+		t.Error("expected the main queue to dead-letter to the DLE after the delivery limit", main)
+	}
+
+	if main["x-dead-letter-strategy"] != "at-least-once" || main["x-overflow"] != "reject-publish" {
+		t.Error("expected the main queue to dead-letter at least once", main)
+	}
+
+	if _, found := dlq["x-dead-letter-strategy"]; found {
+		t.Error("did not expect a dead letter strategy on the DLQ which does not dead-letter", dlq)
+	}
+
+	if retry["x-dead-letter-strategy"] != "at-least-once" || retry["x-dead-letter-exchange"] != config.exchange.RetryNow {
+		t.Error("expected the retry queue to dead-letter to the retry now exchange at least once", retry)
+	}
+}
+
+func TestInvalidQueueTypeSettings(t *testing.T) {
+	for name, c := range map[string]NewConsumerConfig{
+		"max priority on quorum":    {QueueType: Quorum, MaxPriority: 3},
+		"delivery limit on classic": {DeliveryLimit: 3},
+		"strategy on classic":       {DeadLetterStrategy: AtLeastOnce},
+		"unknown queue type":        {QueueType: "stream-ish"},
+		"unknown strategy":          {QueueType: Quorum, DeadLetterStrategy: "sometimes"},
+		"exclusive single active":   {SingleActiveConsumer: true, ExclusiveConsumer: true},
+	} {
+		config := newQueueTestConfig(t, c)
+		if _, err := config.mainQueueArguments(); err == nil {
+			t.Error("expected an error for", name)
+		}
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{
+		QueueLimits:      QueueLimits{MaxLength: 1000, Overflow: RejectPublishDLX, Expires: time.Hour},
+		DLQLimits:        QueueLimits{MaxLengthBytes: 1 << 20, MessageTTL: 24 * time.Hour},
+		RetryQueueLimits: QueueLimits{MaxLength: 100},
+	})
+
+	main, err := config.mainQueueArguments()
+	assertNoError(t, err)
+
+	if main["x-max-length"] != 1000 || main["x-overflow"] != "reject-publish-dlx" || main["x-expires"] != int64(3600000) {
+		t.Error("expected the limits on the main queue", main)
+	}
+
+	if main["x-dead-letter-exchange"] != config.exchange.DLE {
+		t.Error("expected the main queue to overflow to the DLE", main)
+	}
+
+	dlq, err := config.deadLetterQueueArguments()
+	assertNoError(t, err)
+
+	if dlq["x-max-length-bytes"] != int64(1<<20) || dlq["x-overflow"] != "drop-head" || dlq["x-message-ttl"] != int64(86400000) {
+		t.Error("expected the DLQ to drop its oldest messages by default", dlq)
+	}
+
+	retry, err := config.retryQueueArguments()
+	assertNoError(t, err)
+
+	if retry["x-max-length"] != 100 || retry["x-overflow"] != "reject-publish" {
+		t.Error("expected the retry queue to reject publishes by default", retry)
+	}
+}
+
+func TestInvalidQueueLimits(t *testing.T) {
+	for name, c := range map[string]NewConsumerConfig{
+		"overflow without a maximum":     {QueueLimits: QueueLimits{Overflow: DropHead}},
+		"negative maximum":               {QueueLimits: QueueLimits{MaxLength: -1}},
+		"unknown overflow":               {QueueLimits: QueueLimits{MaxLength: 1, Overflow: "explode"}},
+		"sub millisecond ttl":            {QueueLimits: QueueLimits{MessageTTL: time.Microsecond}},
+		"dlx overflow on quorum":         {QueueType: Quorum, QueueLimits: QueueLimits{MaxLength: 1, Overflow: RejectPublishDLX}},
+		"clashing at least once":         {QueueType: Quorum, DeadLetterStrategy: AtLeastOnce, DeliveryLimit: 1, QueueLimits: QueueLimits{MaxLength: 1, Overflow: DropHead}},
+		"dlx overflow on the dlq":        {DLQLimits: QueueLimits{MaxLength: 1, Overflow: RejectPublishDLX}},
+		"expiring dlq":                   {DLQLimits: QueueLimits{Expires: time.Hour}},
+		"message ttl on the retry queue": {RetryQueueLimits: QueueLimits{MessageTTL: time.Hour}},
+		"expiring retry queue":           {RetryQueueLimits: QueueLimits{Expires: time.Hour}},
+	} {
+		config := newQueueTestConfig(t, c)
+
+		_, mainErr := config.mainQueueArguments()
+		_, dlqErr := config.deadLetterQueueArguments()
+		_, retryErr := config.retryQueueArguments()
+
+		if mainErr == nil && dlqErr == nil && retryErr == nil {
+			t.Error("expected an error for", name)
+		}
+	}
+}
+
+func TestDeadLetterExpiredMessagesToTheDLE(t *testing.T) {
+	main, err := newQueueTestConfig(t, NewConsumerConfig{}).mainQueueArguments()
+	assertNoError(t, err)
+
+	if _, found := main["x-dead-letter-exchange"]; found {
+		t.Error("did not expect expired messages to be dead-lettered by default", main)
+	}
+
+	config := newQueueTestConfig(t, NewConsumerConfig{DeadLetterExpired: true})
+
+	main, err = config.mainQueueArguments()
+	assertNoError(t, err)
+
+	if main["x-dead-letter-exchange"] != config.exchange.DLE {
+		t.Error("expected expired messages to be dead-lettered to the DLE", main)
+	}
+}
@@ -0,0 +1,130 @@
+package runamqp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/mergermarket/run-amqp/connection"
+)
+
+// ReconcileBindings unbinds the queues of topology from everything they are no longer bound to in it, such as the patterns removed from a consumer's config, and returns the bindings it removed. The bindings on the broker are listed with lister. With dryRun the stale bindings are only returned, so they can be reviewed first. They are removed with lister when it is a BindingRemover, such as a ManagementClient, otherwise they are unbound over AMQP. Either way the bindings are listed again afterwards, and an error is returned when any stale one is still there.
+//
+// Only the queues in topology are reconciled, the bindings of other queues are left alone.
+func (c *Client) ReconcileBindings(ctx context.Context, topology Topology, lister BindingLister, dryRun bool) ([]BindingDeclaration, error) {
+	var stale []BindingDeclaration
+
+	for _, q := range topology.Queues {
+		existing, err := lister.QueueBindings(ctx, q.Name)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, staleBindings(topology, q.Name, existing)...)
+	}
+
+	if dryRun || len(stale) == 0 {
+		return stale, nil
+	}
+
+	remover, ok := lister.(BindingRemover)
+	if !ok {
+		unbinder := &amqpBindingRemover{client: c}
+		defer unbinder.close()
+		remover = unbinder
+	}
+
+	for i, b := range stale {
+		if err := remover.RemoveBinding(ctx, b); err != nil {
+			return stale[:i], newSetupError(StepBind, b.Destination, fmt.Errorf(`failed to unbind from "%s" with the pattern "%s": %w`, b.Source, b.Pattern, err))
+		}
+		c.config.Logger.Info(fmt.Sprintf(`unbound "%s" from "%s" with the pattern "%s" as it is no longer configured`, b.Destination, b.Source, b.Pattern))
+	}
+
+	// unbinding a binding which does not match exactly succeeds without removing anything, so the bindings are listed again to make sure they are gone
+	for _, q := range topology.Queues {
+		existing, err := lister.QueueBindings(ctx, q.Name)
+		if err != nil {
+			return stale, err
+		}
+		if left := staleBindings(topology, q.Name, existing); len(left) > 0 {
+			return stale, newSetupError(StepBind, q.Name, fmt.Errorf("%d stale bindings are still there after unbinding them, such as the one from \"%s\" with the pattern \"%s\"", len(left), left[0].Source, left[0].Pattern))
+		}
+	}
+
+	return stale, nil
+}
+
+// amqpBindingRemover unbinds over AMQP on a channel of the client, which only removes bindings whose arguments have the types they were declared with
+type amqpBindingRemover struct {
+	client *Client
+	pool   connection.ChannelPool
+}
+
+func (r *amqpBindingRemover) RemoveBinding(ctx context.Context, b BindingDeclaration) error {
+	if r.pool == nil {
+		pool, err := r.client.topologyChannels(ctx)
+		if err != nil {
+			return err
+		}
+		r.pool = pool
+	}
+
+	ch, err := r.pool.Get()
+	if err != nil {
+		return newSetupError(StepChannel, "", err)
+	}
+	defer r.pool.Put(ch)
+
+	return ch.QueueUnbind(b.Destination, b.Pattern, b.Source, b.Arguments)
+}
+
+func (r *amqpBindingRemover) close() {
+	if r.pool != nil {
+		r.pool.Close()
+	}
+}
+
+// staleBindings returns the existing bindings of queue which are not in topology
+func staleBindings(topology Topology, queue string, existing []BindingDeclaration) []BindingDeclaration {
+	var stale []BindingDeclaration
+
+	for _, b := range existing {
+		if b.ToExchange || b.Destination != queue {
+			continue
+		}
+
+		configured := false
+		for _, wanted := range topology.Bindings {
+			if !wanted.ToExchange && sameBinding(wanted, b) {
+				configured = true
+				break
+			}
+		}
+
+		if !configured {
+			stale = append(stale, b)
+		}
+	}
+
+	return stale
+}
+
+// sameBinding compares the arguments as JSON, which is how the management API returns them
+func sameBinding(a, b BindingDeclaration) bool {
+	return a.Source == b.Source && a.Destination == b.Destination && a.Pattern == b.Pattern && reflect.DeepEqual(asJSON(a.Arguments), asJSON(b.Arguments))
+}
+
+func asJSON(arguments map[string]interface{}) map[string]interface{} {
+	normalised := map[string]interface{}{}
+	// the API lists no arguments as an empty object, they are nil when declared
+	if len(arguments) == 0 {
+		return normalised
+	}
+	content, err := json.Marshal(arguments)
+	if err != nil {
+		return arguments
+	}
+	_ = json.Unmarshal(content, &normalised)
+	return normalised
+}
@@ -0,0 +1,90 @@
+package runamqp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mergermarket/run-amqp/helpers"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type stubBindingLister map[string][]BindingDeclaration
+
+func (s stubBindingLister) QueueBindings(_ context.Context, queue string) ([]BindingDeclaration, error) {
+	return s[queue], nil
+}
+
+func TestStaleBindingsAreTheOnesNoLongerConfigured(t *testing.T) {
+	topology := Topology{
+		Queues:   []QueueDeclaration{{Name: "queue"}},
+		Bindings: []BindingDeclaration{{Source: "exchange", Destination: "queue", Pattern: "a.*"}, {Source: "headers", Destination: "queue", Arguments: amqp.Table{"x-match": "all", "priority": 1}}},
+	}
+
+	existing := []BindingDeclaration{
+		{Source: "exchange", Destination: "queue", Pattern: "a.*"},
+		{Source: "exchange", Destination: "queue", Pattern: "b.#"},
+		{Source: "headers", Destination: "queue", Arguments: amqp.Table{"x-match": "all", "priority": float64(1)}},
+	}
+
+	stale := staleBindings(topology, "queue", existing)
+
+	if len(stale) != 1 || stale[0].Pattern != "b.#" {
+		t.Error("expected only the removed pattern to be stale but got", stale)
+	}
+}
+
+func TestReconcileBindingsDryRunOnlyReports(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{Patterns: []string{"a.*"}})
+
+	topology, err := config.Topology()
+	assertNoError(t, err)
+
+	lister := stubBindingLister{
+		config.queue.Name: {
+			{Source: config.exchange.Name, Destination: config.queue.Name, Pattern: "a.*"},
+			{Source: config.exchange.Name, Destination: config.queue.Name, Pattern: "removed"},
+			{Source: config.exchange.RetryNow, Destination: config.queue.Name, Pattern: matchAllPattern},
+		},
+	}
+
+	clientConfig := NewClientConfig{URL: unreachableRabbitURI, Logger: helpers.NewTestLogger(t)}
+	client := NewClient(clientConfig.Config())
+	defer client.Close()
+
+	stale, err := client.ReconcileBindings(context.Background(), topology, lister, true)
+	assertNoError(t, err)
+
+	if len(stale) != 1 || stale[0].Pattern != "removed" {
+		t.Error("expected the removed pattern to be reported but got", stale)
+	}
+}
+
+// unbindingLister is a BindingRemover whose removals do not take, as when the arguments do not match exactly
+type unbindingLister struct {
+	stubBindingLister
+	removed []BindingDeclaration
+}
+
+func (u *unbindingLister) RemoveBinding(_ context.Context, binding BindingDeclaration) error {
+	u.removed = append(u.removed, binding)
+	return nil
+}
+
+func TestReconcileBindingsFailsWhenAStaleBindingIsStillThere(t *testing.T) {
+	topology := Topology{Queues: []QueueDeclaration{{Name: "queue"}}}
+
+	lister := &unbindingLister{stubBindingLister: stubBindingLister{
+		"queue": {{Source: "headers", Destination: "queue", Arguments: amqp.Table{"priority": float64(1)}}},
+	}}
+
+	clientConfig := NewClientConfig{URL: unreachableRabbitURI, Logger: helpers.NewTestLogger(t)}
+	client := NewClient(clientConfig.Config())
+	defer client.Close()
+
+	_, err := client.ReconcileBindings(context.Background(), topology, lister, false)
+	assertSetupError(t, err, StepBind)
+
+	if len(lister.removed) != 1 {
+		t.Error("expected the stale binding to be removed with the lister", lister.removed)
+	}
+}
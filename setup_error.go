@@ -0,0 +1,86 @@
+package runamqp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/mergermarket/run-amqp/connection"
+)
+
+// SetupStep is a step of setting up a consumer or publisher with rabbit
+type SetupStep string
+
+const (
+	// StepDial is connecting to rabbit
+	StepDial SetupStep = "dial"
+
+	// StepChannel is opening a channel on the connection
+	StepChannel SetupStep = "channel"
+
+	// StepDeclare is declaring an exchange or a queue
+	StepDeclare SetupStep = "declare"
+
+	// StepBind is binding a queue to an exchange
+	StepBind SetupStep = "bind"
+
+	// StepConsume is starting to consume from a queue
+	StepConsume SetupStep = "consume"
+)
+
+// SetupError describes which step of setting up a consumer or publisher failed, and on what
+type SetupError struct {
+	Step SetupStep
+	// Name is the exchange or queue the step was for, it is empty for dialing
+	Name string
+	Err  error
+}
+
+func (e *SetupError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("failed to %s: %v", e.Step, e.Err)
+	}
+	return fmt.Sprintf(`failed to %s "%s": %v`, e.Step, e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error, such as an *amqp.Error or the error of the context
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+func newSetupError(step SetupStep, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SetupError{Step: step, Name: name, Err: err}
+}
+
+// setUpProgress records the last thing that went wrong setting up, so that a timeout can say which step it got stuck on
+type setUpProgress struct {
+	sync.Mutex
+	lastErr error
+}
+
+func (p *setUpProgress) failed(err error) {
+	p.Lock()
+	defer p.Unlock()
+	p.lastErr = err
+}
+
+// timedOut returns a *SetupError for the step that was being made when ctxErr happened: dialing while there is no connection, otherwise the step that last failed, otherwise opening a channel
+func (p *setUpProgress) timedOut(connectionManager connection.ConnectionManager, ctxErr error) error {
+	if err := connectionManager.ConnectionError(); err != nil {
+		return &SetupError{Step: StepDial, Err: fmt.Errorf("%w: %w", ctxErr, err)}
+	}
+
+	p.Lock()
+	lastErr := p.lastErr
+	p.Unlock()
+
+	var setupErr *SetupError
+	if errors.As(lastErr, &setupErr) {
+		return &SetupError{Step: setupErr.Step, Name: setupErr.Name, Err: fmt.Errorf("%w: %w", ctxErr, setupErr.Err)}
+	}
+
+	return &SetupError{Step: StepChannel, Err: ctxErr}
+}
@@ -0,0 +1,172 @@
+package runamqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mergermarket/run-amqp/connection"
+)
+
+// consistentHashWeight is the binding key of every partition queue, a consistent hash exchange reads it as the weight of the queue
+const consistentHashWeight = "1"
+
+// ShardedConsumer consumes the partitions of a consumer, each of which is a queue bound to a ConsistentHash exchange. Every instance declares all the partitions, so messages are spread over the same partitions whichever instances are running, but only consumes the ones it claims. The messages with the same routing key always go to the same partition, and each partition has a single active consumer across the instances of the service, so they are processed in order.
+type ShardedConsumer struct {
+	// Partitions are the consumers of the claimed partitions, their ActiveChanges tell whether this instance is the one processing them
+	Partitions        []*Consumer
+	config            ConsumerConfig
+	connectionManager connection.ConnectionManager
+	ownsConnection    bool
+	progress          *setUpProgress
+	ctx               context.Context
+	cancel            context.CancelFunc
+}
+
+// NewShardedConsumer returns a ShardedConsumer once it is consuming its partitions, waiting up to 30 seconds for it to be ready. This will create a managed connection to rabbit which all the partitions share.
+func NewShardedConsumer(config ConsumerConfig) (*ShardedConsumer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSetUpTimeout)
+	defer cancel()
+	return NewShardedConsumerContext(ctx, config)
+}
+
+// NewShardedConsumerContext returns a ShardedConsumer once it is consuming its partitions. If that fails, or ctx is done before then, it returns a *SetupError describing the step that failed and closes everything it opened.
+func NewShardedConsumerContext(ctx context.Context, config ConsumerConfig) (*ShardedConsumer, error) {
+	if err := config.validatePartitions(); err != nil {
+		return nil, err
+	}
+	return newShardedConsumerContext(ctx, config, config.newConnectionManager(), true)
+}
+
+func newShardedConsumerContext(ctx context.Context, config ConsumerConfig, connectionManager connection.ConnectionManager, ownsConnection bool) (*ShardedConsumer, error) {
+	topology, err := config.Topology()
+	if err := validTopology(topology, err); err != nil {
+		if ownsConnection {
+			connectionManager.Close()
+		}
+		return nil, err
+	}
+
+	sharded := &ShardedConsumer{
+		config:            config,
+		connectionManager: connectionManager,
+		ownsConnection:    ownsConnection,
+		progress:          new(setUpProgress),
+	}
+	sharded.ctx, sharded.cancel = context.WithCancel(context.Background())
+
+	declared := make(chan error, 1)
+	go sharded.keepPartitionsDeclared(topology, declared)
+
+	select {
+	case err := <-declared:
+		if err != nil {
+			sharded.Close()
+			return nil, err
+		}
+	case <-ctx.Done():
+		err := sharded.progress.timedOut(connectionManager, ctx.Err())
+		sharded.Close()
+		return nil, err
+	}
+
+	for _, partition := range config.claimedPartitions() {
+		consumer, err := newConsumerContext(ctx, config.partitionConfig(partition), connectionManager, false)
+		if err != nil {
+			sharded.Close()
+			return nil, err
+		}
+		sharded.Partitions = append(sharded.Partitions, consumer)
+	}
+
+	return sharded, nil
+}
+
+// keepPartitionsDeclared declares every partition on each channel opened for them, including the ones this instance does not consume, until the consumer is closed. Only the first outcome is signalled on isReady, which has to be buffered.
+func (s *ShardedConsumer) keepPartitionsDeclared(topology Topology, isReady chan<- error) {
+	for channel := range s.connectionManager.OpenChannelContext(s.ctx, fmt.Sprintf("partitions of %s", s.config.queue.Name)) {
+		err := topology.applyWith(channel, s.config.topologyMode, s.connectionManager)
+		if err != nil {
+			s.config.Logger.Error(err)
+			s.progress.failed(err)
+		}
+		select {
+		case isReady <- err:
+		default:
+		}
+	}
+}
+
+// Process runs handler on the messages of every partition, with one worker per partition so that they are handled in the order they were published
+func (s *ShardedConsumer) Process(handler MessageHandler) {
+	for _, partition := range s.Partitions {
+		partition.Process(handler, 1)
+	}
+}
+
+// Close stops consuming every partition, and closes the connection unless it was made by a Client
+func (s *ShardedConsumer) Close() {
+	for _, partition := range s.Partitions {
+		partition.Close()
+	}
+	s.cancel()
+	if s.ownsConnection {
+		s.connectionManager.Close()
+	}
+}
+
+func (c ConsumerConfig) validatePartitions() error {
+	if c.partitions.Count < 1 {
+		return newSetupError(StepDeclare, c.queue.Name, errors.New("a sharded consumer needs at least one partition"))
+	}
+
+	if c.exchange.Type != ConsistentHash {
+		return newSetupError(StepDeclare, c.exchange.Name, fmt.Errorf("a sharded consumer needs a %s exchange but it is %s", ConsistentHash, c.exchange.Type))
+	}
+
+	if c.queue.Ephemeral {
+		return newSetupError(StepDeclare, c.queue.Name, errors.New("the partitions of a sharded consumer are shared by its instances, they can not be ephemeral"))
+	}
+
+	if c.queue.Exclusive {
+		return newSetupError(StepConsume, c.queue.Name, errors.New("the partitions of a sharded consumer have a single active consumer, they can not be consumed exclusively"))
+	}
+
+	for _, partition := range c.partitions.Claimed {
+		if partition < 0 || partition >= c.partitions.Count {
+			return newSetupError(StepConsume, c.queue.Name, fmt.Errorf("partition %d was claimed but there are %d partitions", partition, c.partitions.Count))
+		}
+	}
+
+	return nil
+}
+
+func (c ConsumerConfig) claimedPartitions() []int {
+	if len(c.partitions.Claimed) > 0 {
+		return c.partitions.Claimed
+	}
+
+	all := make([]int, c.partitions.Count)
+	for i := range all {
+		all[i] = i
+	}
+	return all
+}
+
+// partitionConfig is the config of the consumer of one partition. Every partition has its own queue and retry exchanges named by the NamingStrategy, so retried messages go back to the partition they came from, but they share the DLE and DLQ.
+func (c ConsumerConfig) partitionConfig(partition int) ConsumerConfig {
+	// a partition is named like a service of its own, <service>-partition-<n>, by the naming strategy of the consumer
+	service := fmt.Sprintf("%s-partition-%d", c.naming.service, partition)
+	names := orDefaultNaming(c.naming.strategy).ConsumerNames(c.naming.exchange, service, c.queue.RequeueTTL)
+
+	config := c
+	config.exchange.RetryNow = names.RetryNowExchange
+	config.exchange.RetryLater = names.RetryLaterExchange
+	config.queue.Name = names.Queue
+	config.queue.RetryLater = names.RetryLaterQueue
+	config.queue.Patterns = []string{consistentHashWeight}
+	config.queue.SingleActive = true
+	config.partitions = partitions{}
+
+	return config
+}
@@ -0,0 +1,152 @@
+package runamqp
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPartitionConfig(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{Partitions: 4})
+
+	partition := config.partitionConfig(2)
+
+	if partition.queue.Name != config.queue.Name+"-partition-2" {
+		t.Error("unexpected partition queue name", partition.queue.Name)
+	}
+
+	if partition.exchange.RetryNow == config.exchange.RetryNow || partition.queue.RetryLater == config.queue.RetryLater {
+		t.Error("expected every partition to have its own retries")
+	}
+
+	if partition.queue.DLQ != config.queue.DLQ || partition.exchange.DLE != config.exchange.DLE {
+		t.Error("expected the partitions to share the DLQ")
+	}
+
+	if !partition.queue.SingleActive || len(partition.queue.Patterns) != 1 || partition.queue.Patterns[0] != consistentHashWeight {
+		t.Error("expected the partition to have a single active consumer and to be bound with its weight", partition.queue)
+	}
+
+	if partition.queue.RetryLater != config.queue.Name+"-partition-2-retry-"+strconv.Itoa(int(testRequeueTTL))+"ms-later" {
+		t.Error("unexpected partition retry queue name", partition.queue.RetryLater)
+	}
+
+	if claimed := config.claimedPartitions(); len(claimed) != 4 || claimed[3] != 3 {
+		t.Error("expected all the partitions to be claimed by default", claimed)
+	}
+}
+
+func TestPartitionConfigUsesTheNamingStrategy(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{Partitions: 4, Naming: PrefixedNaming{Prefix: "staging.", Naming: StableRetryNaming{}}})
+
+	partition := config.partitionConfig(1)
+
+	if partition.queue.Name != "staging.exchange-for-"+serviceName+"-partition-1" {
+		t.Error("expected the partition queue to be prefixed", partition.queue.Name)
+	}
+
+	if partition.queue.RetryLater != partition.queue.Name+"-retry-later" || partition.exchange.RetryNow != partition.queue.Name+"-retry-now" {
+		t.Error("expected the partition retries to be named by the strategy", partition.queue.RetryLater, partition.exchange.RetryNow)
+	}
+}
+
+func TestTopologyOfAShardedConsumerHasEveryPartition(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{Partitions: 3, ClaimedPartitions: []int{1}})
+	config.exchange.Type = ConsistentHash
+
+	topology, err := config.Topology()
+	assertNoError(t, err)
+	assertNoError(t, topology.Validate())
+
+	queues := map[string]bool{}
+	for _, q := range topology.Queues {
+		queues[q.Name] = true
+	}
+
+	if queues[config.queue.Name] {
+		t.Error("did not expect the main queue of a sharded consumer to be declared")
+	}
+
+	weights := 0
+	for _, b := range topology.Bindings {
+		if b.Source != config.exchange.Name {
+			continue
+		}
+		if b.Pattern != consistentHashWeight {
+			t.Error("expected the partitions to be bound to the consistent hash exchange with their weight", b)
+		}
+		weights++
+	}
+
+	if weights != 3 {
+		t.Error("expected every partition to be bound, including the unclaimed ones, got", weights)
+	}
+
+	for partition := 0; partition < 3; partition++ {
+		if name := config.partitionConfig(partition).queue.Name; !queues[name] {
+			t.Error("expected the partition queue to be declared", name)
+		}
+	}
+}
+
+func TestValidatePartitions(t *testing.T) {
+	valid := newQueueTestConfig(t, NewConsumerConfig{Partitions: 4, ClaimedPartitions: []int{0, 3}})
+	valid.exchange.Type = ConsistentHash
+
+	assertNoError(t, valid.validatePartitions())
+
+	for name, change := range map[string]func(*ConsumerConfig){
+		"no partitions":          func(c *ConsumerConfig) { c.partitions.Count = 0 },
+		"not a consistent hash":  func(c *ConsumerConfig) { c.exchange.Type = Topic },
+		"exclusive":              func(c *ConsumerConfig) { c.queue.Exclusive = true },
+		"claiming a missing one": func(c *ConsumerConfig) { c.partitions.Claimed = []int{4} },
+	} {
+		config := valid
+		change(&config)
+
+		if err := config.validatePartitions(); err == nil {
+			t.Error("expected an error for", name)
+		}
+	}
+}
+
+func TestShardedConsumerConsumesItsPartitionsInOrder(t *testing.T) {
+	t.Parallel()
+
+	consumerConfig := newTestConsumerConfig(t, consumerConfigOptions{ExchangeType: ConsistentHash})
+	consumerConfig.partitions = partitions{Count: 3}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sharded, err := NewShardedConsumerContext(ctx, consumerConfig)
+	assertNoError(t, err)
+	defer sharded.Close()
+
+	publisher, err := NewPublisherContext(ctx, consumerConfig.NewPublisherConfig())
+	assertNoError(t, err)
+	defer publisher.Close()
+
+	for _, body := range []string{"1", "2", "3"} {
+		assertNoError(t, publisher.Publish([]byte(body), &PublishOptions{Pattern: "the same key"}))
+	}
+
+	var received []string
+	for _, partition := range sharded.Partitions {
+	drain:
+		for {
+			select {
+			case message := <-partition.Messages:
+				received = append(received, string(message.Body()))
+				assertNoError(t, message.Ack())
+			case <-time.After(time.Second):
+				break drain
+			}
+		}
+	}
+
+	if len(received) != 3 || received[0] != "1" || received[2] != "3" {
+		t.Error("expected the messages with the same key to be consumed in order from one partition", received)
+	}
+}
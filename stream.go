@@ -0,0 +1,300 @@
+package runamqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mergermarket/run-amqp/connection"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// StreamMessage is a Message read from a stream, which also knows its offset in the stream
+type StreamMessage interface {
+	Message
+	Offset() int64
+}
+
+// StreamConsumer reads a stream, a replayable log of the messages published to an exchange. Unlike a Consumer it does not remove messages, it resumes after the last processed offset when it has an OffsetStore.
+type StreamConsumer struct {
+	Messages          chan Message
+	config            StreamConsumerConfig
+	connectionManager connection.ConnectionManager
+	ownsConnection    bool
+	tracker           *offsetTracker
+	committer         *offsetCommitter
+	setUpResult       chan error
+	progress          *setUpProgress
+	ctx               context.Context
+	cancel            context.CancelFunc
+}
+
+// NewStreamConsumer returns a StreamConsumer once it is reading the stream, waiting up to 30 seconds for it to be ready. This will create a managed connection to rabbit, use a Client to share one connection.
+func NewStreamConsumer(config StreamConsumerConfig) (*StreamConsumer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSetUpTimeout)
+	defer cancel()
+	return NewStreamConsumerContext(ctx, config)
+}
+
+// NewStreamConsumerContext returns a StreamConsumer once it is reading the stream. If that fails, or ctx is done before then, it returns a *SetupError describing the step that failed and closes everything it opened.
+func NewStreamConsumerContext(ctx context.Context, config StreamConsumerConfig) (*StreamConsumer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return newStreamConsumerContext(ctx, config, config.newConnectionManager(), true)
+}
+
+func (c StreamConsumerConfig) validate() error {
+	if c.stream.PrefetchCount < 1 {
+		return newSetupError(StepConsume, c.stream.Name, errors.New("streams can only be consumed with a prefetch"))
+	}
+	return nil
+}
+
+func newStreamConsumerContext(ctx context.Context, config StreamConsumerConfig, connectionManager connection.ConnectionManager, ownsConnection bool) (*StreamConsumer, error) {
+	if err := validTopology(config.Topology()); err != nil {
+		if ownsConnection {
+			connectionManager.Close()
+		}
+		return nil, err
+	}
+
+	consumer := &StreamConsumer{
+		Messages:          make(chan Message),
+		config:            config,
+		connectionManager: connectionManager,
+		ownsConnection:    ownsConnection,
+		tracker:           newOffsetTracker(),
+		committer:         newOffsetCommitter(config.stream),
+		setUpResult:       make(chan error, 1),
+		progress:          new(setUpProgress),
+	}
+	consumer.ctx, consumer.cancel = context.WithCancel(context.Background())
+
+	go consumer.keepStreamSetUp()
+
+	if consumer.committer != nil {
+		go consumer.commitPeriodically()
+	}
+
+	select {
+	case err := <-consumer.setUpResult:
+		if err != nil {
+			consumer.Close()
+			return nil, err
+		}
+		return consumer, nil
+	case <-ctx.Done():
+		err := consumer.progress.timedOut(connectionManager, ctx.Err())
+		consumer.Close()
+		return nil, err
+	}
+}
+
+// Process creates a worker pool of size numberOfWorkers which will run handler on every message sent to the consumer's Messages channel.
+func (c *StreamConsumer) Process(handler MessageHandler, numberOfWorkers int) {
+	startWorkers(c.Messages, handler, numberOfWorkers, c.config.Logger)
+}
+
+// Close stops reading the stream and stores the last processed offset, then closes the consumer's channel, as well as its connection unless it was made by a Client
+func (c *StreamConsumer) Close() {
+	c.cancel()
+	c.commitOffset()
+	if c.ownsConnection {
+		c.connectionManager.Close()
+	}
+}
+
+// keepStreamSetUp sets up the stream on every channel opened for it, resuming after the last processed offset. Only the first outcome is signalled on setUpResult.
+func (c *StreamConsumer) keepStreamSetUp() {
+	for channel := range c.connectionManager.OpenChannelContext(c.ctx, c.config.stream.Name) {
+		err := c.setUpStream(channel)
+		if err != nil {
+			c.config.Logger.Error(err)
+			c.progress.failed(err)
+		}
+		select {
+		case c.setUpResult <- err:
+		default:
+		}
+	}
+}
+
+func (c *StreamConsumer) setUpStream(amqpChannel *amqp.Channel) error {
+
+	// messages delivered on the previous channel can no longer be acknowledged, they are delivered again from the last processed offset
+	c.tracker.reset()
+
+	topology, err := c.config.Topology()
+
+	if err != nil {
+		return err
+	}
+
+	if err := topology.applyWith(amqpChannel, c.config.topologyMode, c.connectionManager); err != nil {
+		return err
+	}
+
+	if err := amqpChannel.Qos(c.config.stream.PrefetchCount, 0, false); err != nil {
+		return newSetupError(StepConsume, c.config.stream.Name, err)
+	}
+
+	offset, err := c.resumeOffset()
+
+	if err != nil {
+		return newSetupError(StepConsume, c.config.stream.Name, err)
+	}
+
+	c.config.Logger.Info(fmt.Sprintf(`reading the stream "%s" from offset %s`, c.config.stream.Name, offset))
+
+	msgs, err := amqpChannel.Consume(
+		c.config.stream.Name, // queue
+		"",                   // consumer
+		false,                // auto-ack
+		false,                // exclusive
+		false,                // no-local
+		false,                // no-wait
+		amqp.Table{"x-stream-offset": offset.argument()},
+	)
+
+	if err != nil {
+		return newSetupError(StepConsume, c.config.stream.Name, err)
+	}
+
+	go c.forward(msgs)
+
+	return nil
+}
+
+// resumeOffset is after the last offset processed since starting, otherwise after the stored one, otherwise the configured offset
+func (c *StreamConsumer) resumeOffset() (StreamOffset, error) {
+	if last, found := c.tracker.lastProcessed(); found {
+		return OffsetAt(last + 1), nil
+	}
+
+	if c.config.stream.OffsetStore == nil {
+		return c.config.stream.Offset, nil
+	}
+
+	stored, found, err := c.config.stream.OffsetStore.LoadOffset(c.config.stream.Consumer)
+
+	if err != nil {
+		return StreamOffset{}, fmt.Errorf("failed to load the stored offset: %w", err)
+	}
+
+	if !found {
+		return c.config.stream.Offset, nil
+	}
+
+	return OffsetAt(stored + 1), nil
+}
+
+func (c *StreamConsumer) forward(msgs <-chan amqp.Delivery) {
+	for d := range msgs {
+		message := &streamMessage{delivery: d, consumer: c}
+
+		offset, ok := d.Headers["x-stream-offset"].(int64)
+		if ok {
+			message.offset = offset
+			message.generation = c.tracker.delivered(offset)
+		} else {
+			c.config.Logger.Error(fmt.Sprintf(`a message from the stream "%s" has no offset, it will not be tracked`, c.config.stream.Name))
+		}
+		message.tracked = ok
+
+		select {
+		case c.Messages <- message:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// processed records that the message at offset was processed, storing the last processed offset when enough messages were acknowledged since it was last stored
+func (c *StreamConsumer) processed(generation int, offset int64) {
+	c.tracker.processed(generation, offset)
+
+	if c.committer != nil && c.committer.due() {
+		c.commitOffset()
+	}
+}
+
+// commitPeriodically stores the last processed offset every CommitInterval, so it is not held back for long when few messages are acknowledged
+func (c *StreamConsumer) commitPeriodically() {
+	ticker := time.NewTicker(c.config.stream.CommitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.commitOffset()
+		}
+	}
+}
+
+// commitOffset stores the last processed offset, if a message was processed since starting and it has not been stored yet
+func (c *StreamConsumer) commitOffset() {
+	if c.committer == nil {
+		return
+	}
+
+	last, found := c.tracker.lastProcessed()
+	if !found {
+		return
+	}
+
+	if err := c.committer.commit(last); err != nil {
+		c.config.Logger.Error(fmt.Sprintf(`failed to store the offset %d of the stream "%s": %v`, last, c.config.stream.Name, err))
+	}
+}
+
+// errStreamRequeue is returned when requeueing a message read from a stream
+var errStreamRequeue = errors.New("messages read from a stream can not be requeued, the message was skipped but stays in the stream and can be read again from its offset")
+
+type streamMessage struct {
+	delivery   amqp.Delivery
+	consumer   *StreamConsumer
+	offset     int64
+	generation int
+	tracked    bool
+}
+
+// Body returns the body of the AMQP message
+func (m *streamMessage) Body() []byte {
+	return m.delivery.Body
+}
+
+// Offset returns the offset of the message in the stream
+func (m *streamMessage) Offset() int64 {
+	return m.offset
+}
+
+// Ack acknowledges the message, which counts it as processed
+func (m *streamMessage) Ack() error {
+	if err := m.delivery.Ack(false); err != nil {
+		return err
+	}
+
+	if m.tracked {
+		m.consumer.processed(m.generation, m.offset)
+	}
+
+	return nil
+}
+
+// Nack skips the message, streams have no dead letter exchange so the reason is logged and the message is acknowledged
+func (m *streamMessage) Nack(reason string) error {
+	m.consumer.config.Logger.Info(fmt.Sprintf(`skipping the message at offset %d of the stream "%s": %s`, m.offset, m.consumer.config.stream.Name, reason))
+	return m.Ack()
+}
+
+// Requeue is not possible for messages read from a stream, the message is skipped like Nack so later offsets are still counted as processed, and an error is returned
+func (m *streamMessage) Requeue(reason string) error {
+	if err := m.Nack(reason); err != nil {
+		return err
+	}
+	return errStreamRequeue
+}
@@ -0,0 +1,253 @@
+package runamqp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// StreamOffset is where a stream consumer starts reading the stream when there is no stored offset to resume from
+type StreamOffset struct {
+	value interface{}
+}
+
+var (
+	// OffsetFirst starts from the first message still retained in the stream
+	OffsetFirst = StreamOffset{value: "first"}
+
+	// OffsetLast starts from the last chunk written to the stream
+	OffsetLast = StreamOffset{value: "last"}
+
+	// OffsetNext starts with the messages published after the consumer started, it is the default
+	OffsetNext = StreamOffset{value: "next"}
+)
+
+// OffsetAt starts from the message at offset
+func OffsetAt(offset int64) StreamOffset {
+	return StreamOffset{value: offset}
+}
+
+// OffsetFrom starts from the chunk of messages published at timestamp
+func OffsetFrom(timestamp time.Time) StreamOffset {
+	return StreamOffset{value: timestamp}
+}
+
+func (o StreamOffset) argument() interface{} {
+	if o.value == nil {
+		return OffsetNext.value
+	}
+	return o.value
+}
+
+func (o StreamOffset) String() string {
+	return fmt.Sprint(o.argument())
+}
+
+// OffsetStore keeps the offset of the last message a stream consumer processed, so it resumes after it when restarted
+type OffsetStore interface {
+	// LoadOffset returns the offset stored for consumer, found is false when nothing has been stored yet
+	LoadOffset(consumer string) (offset int64, found bool, err error)
+	// StoreOffset stores offset as the last one processed by consumer
+	StoreOffset(consumer string, offset int64) error
+}
+
+const (
+	defaultOffsetCommitEvery    = 100
+	defaultOffsetCommitInterval = 5 * time.Second
+)
+
+// FileOffsetStore is an OffsetStore keeping the offsets of its consumers in a JSON file, which is replaced in one go every time an offset is stored. A StreamConsumer only stores its offset every OffsetCommitEvery acknowledged messages or OffsetCommitInterval, and when it is closed.
+type FileOffsetStore struct {
+	sync.Mutex
+	path    string
+	offsets map[string]int64
+}
+
+// NewFileOffsetStore returns a FileOffsetStore using the file at path, which is made when the first offset is stored
+func NewFileOffsetStore(path string) *FileOffsetStore {
+	return &FileOffsetStore{path: path}
+}
+
+// LoadOffset returns the offset stored for consumer in the file
+func (f *FileOffsetStore) LoadOffset(consumer string) (int64, bool, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.read(); err != nil {
+		return 0, false, err
+	}
+
+	offset, found := f.offsets[consumer]
+	return offset, found, nil
+}
+
+// StoreOffset writes offset for consumer to the file
+func (f *FileOffsetStore) StoreOffset(consumer string, offset int64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.read(); err != nil {
+		return err
+	}
+
+	f.offsets[consumer] = offset
+
+	content, err := json.Marshal(f.offsets)
+	if err != nil {
+		return fmt.Errorf(`failed to encode the offsets for "%s": %v`, f.path, err)
+	}
+
+	// write a temporary file and rename it, so a crash never leaves a half written file behind
+	temporary, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf(`failed to write the offsets file "%s": %v`, f.path, err)
+	}
+	defer os.Remove(temporary.Name())
+
+	if _, err := temporary.Write(content); err != nil {
+		temporary.Close()
+		return fmt.Errorf(`failed to write the offsets file "%s": %v`, f.path, err)
+	}
+
+	if err := temporary.Close(); err != nil {
+		return fmt.Errorf(`failed to write the offsets file "%s": %v`, f.path, err)
+	}
+
+	if err := os.Rename(temporary.Name(), f.path); err != nil {
+		return fmt.Errorf(`failed to write the offsets file "%s": %v`, f.path, err)
+	}
+
+	return nil
+}
+
+// read loads the offsets from the file the first time they are needed, afterwards they are kept in memory
+func (f *FileOffsetStore) read() error {
+	if f.offsets != nil {
+		return nil
+	}
+
+	content, err := os.ReadFile(f.path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		f.offsets = map[string]int64{}
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf(`failed to read the offsets file "%s": %v`, f.path, err)
+	}
+
+	offsets := map[string]int64{}
+	if err := json.Unmarshal(content, &offsets); err != nil {
+		return fmt.Errorf(`failed to parse the offsets file "%s": %v`, f.path, err)
+	}
+
+	f.offsets = offsets
+	return nil
+}
+
+// offsetTracker works out the last processed offset of a stream consumer. Messages may be acknowledged out of order by several workers, so an offset only counts as processed once every message delivered before it has been acknowledged too.
+type offsetTracker struct {
+	sync.Mutex
+	generation int
+	pending    []int64
+	done       map[int64]bool
+	last       int64
+	hasLast    bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{done: map[int64]bool{}}
+}
+
+// delivered records that the message at offset was handed out, and returns the generation to acknowledge it with
+func (t *offsetTracker) delivered(offset int64) int {
+	t.Lock()
+	defer t.Unlock()
+	t.pending = append(t.pending, offset)
+	return t.generation
+}
+
+// processed marks the message at offset as acknowledged, it returns the last processed offset when that moved on. Messages delivered before the last reset are ignored, as they will be delivered again.
+func (t *offsetTracker) processed(generation int, offset int64) (last int64, moved bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	if generation != t.generation {
+		return 0, false
+	}
+
+	t.done[offset] = true
+
+	for len(t.pending) > 0 && t.done[t.pending[0]] {
+		delete(t.done, t.pending[0])
+		t.last, t.hasLast, moved = t.pending[0], true, true
+		t.pending = t.pending[1:]
+	}
+
+	return t.last, moved
+}
+
+// reset forgets the messages that were not acknowledged yet, which happens when the channel they were delivered on is gone
+func (t *offsetTracker) reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.generation++
+	t.pending = nil
+	t.done = map[int64]bool{}
+}
+
+// lastProcessed returns the last processed offset, if any message was processed since starting
+func (t *offsetTracker) lastProcessed() (int64, bool) {
+	t.Lock()
+	defer t.Unlock()
+	return t.last, t.hasLast
+}
+
+// offsetCommitter stores the last processed offset of a stream consumer every so many acknowledged messages, rather than on every one, never storing an offset older than the one already stored
+type offsetCommitter struct {
+	sync.Mutex
+	store        OffsetStore
+	consumer     string
+	every        int
+	acks         int
+	committed    int64
+	hasCommitted bool
+}
+
+// newOffsetCommitter returns nil when the consumer has no OffsetStore
+func newOffsetCommitter(config stream) *offsetCommitter {
+	if config.OffsetStore == nil {
+		return nil
+	}
+	return &offsetCommitter{store: config.OffsetStore, consumer: config.Consumer, every: config.CommitEvery}
+}
+
+// due counts an acknowledged message, and returns whether enough were acknowledged since the last commit to commit again
+func (o *offsetCommitter) due() bool {
+	o.Lock()
+	defer o.Unlock()
+	o.acks++
+	return o.acks >= o.every
+}
+
+// commit stores last unless it is already stored
+func (o *offsetCommitter) commit(last int64) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.hasCommitted && last <= o.committed {
+		return nil
+	}
+
+	if err := o.store.StoreOffset(o.consumer, last); err != nil {
+		return err
+	}
+
+	o.committed, o.hasCommitted, o.acks = last, true, 0
+	return nil
+}
@@ -0,0 +1,156 @@
+package runamqp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestStreamOffsetArguments(t *testing.T) {
+	timestamp := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for offset, expected := range map[StreamOffset]interface{}{
+		{}:                    "next",
+		OffsetFirst:           "first",
+		OffsetLast:            "last",
+		OffsetNext:            "next",
+		OffsetAt(42):          int64(42),
+		OffsetFrom(timestamp): timestamp,
+	} {
+		if offset.argument() != expected {
+			t.Error("expected the argument to be", expected, "but got", offset.argument())
+		}
+	}
+}
+
+func TestFileOffsetStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offsets.json")
+	store := NewFileOffsetStore(path)
+
+	if _, found, err := store.LoadOffset("consumer"); found || err != nil {
+		t.Fatal("did not expect an offset before one was stored", found, err)
+	}
+
+	assertNoError(t, store.StoreOffset("consumer", 10))
+	assertNoError(t, store.StoreOffset("another-consumer", 3))
+	assertNoError(t, store.StoreOffset("consumer", 11))
+
+	restarted := NewFileOffsetStore(path)
+
+	if offset, found, err := restarted.LoadOffset("consumer"); !found || err != nil || offset != 11 {
+		t.Error("expected the stored offset to be read back, got", offset, found, err)
+	}
+
+	if offset, _, _ := restarted.LoadOffset("another-consumer"); offset != 3 {
+		t.Error("expected the offset of the other consumer to be kept, got", offset)
+	}
+
+	assertNoError(t, os.WriteFile(path, []byte("not json"), 0600))
+
+	if _, _, err := NewFileOffsetStore(path).LoadOffset("consumer"); err == nil {
+		t.Error("expected an error for a file which can not be parsed")
+	}
+}
+
+func TestOffsetTrackerOnlyMovesPastContiguouslyProcessedOffsets(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	generation := tracker.delivered(5)
+	tracker.delivered(6)
+	tracker.delivered(7)
+
+	if _, moved := tracker.processed(generation, 6); moved {
+		t.Error("did not expect the offset to move on while 5 is being processed")
+	}
+
+	if last, moved := tracker.processed(generation, 5); !moved || last != 6 {
+		t.Error("expected the offset to move on to 6, got", last, moved)
+	}
+
+	tracker.reset()
+
+	if _, moved := tracker.processed(generation, 7); moved {
+		t.Error("did not expect a message delivered before the reset to count")
+	}
+
+	if last, found := tracker.lastProcessed(); !found || last != 6 {
+		t.Error("expected the last processed offset to survive the reset, got", last, found)
+	}
+}
+
+type countingOffsetStore struct {
+	stored []int64
+}
+
+func (s *countingOffsetStore) LoadOffset(string) (int64, bool, error) {
+	return 0, false, nil
+}
+
+func (s *countingOffsetStore) StoreOffset(_ string, offset int64) error {
+	s.stored = append(s.stored, offset)
+	return nil
+}
+
+func TestOffsetCommitterStoresEveryFewAcknowledgements(t *testing.T) {
+	store := &countingOffsetStore{}
+	committer := newOffsetCommitter(stream{OffsetStore: store, Consumer: "consumer", CommitEvery: 3})
+
+	for offset := int64(1); offset <= 7; offset++ {
+		if committer.due() {
+			assertNoError(t, committer.commit(offset))
+		}
+	}
+
+	if len(store.stored) != 2 || store.stored[0] != 3 || store.stored[1] != 6 {
+		t.Error("expected the offset to be stored after every third acknowledgement, got", store.stored)
+	}
+
+	assertNoError(t, committer.commit(6))
+	assertNoError(t, committer.commit(4))
+
+	if len(store.stored) != 2 {
+		t.Error("did not expect an offset to be stored again, or an older one to be stored, got", store.stored)
+	}
+
+	assertNoError(t, committer.commit(7))
+
+	if store.stored[len(store.stored)-1] != 7 {
+		t.Error("expected the last processed offset to be stored when committed, got", store.stored)
+	}
+}
+
+func TestRequeuedStreamMessagesDoNotHoldBackTheOffset(t *testing.T) {
+	store := &countingOffsetStore{}
+	config := newTestStreamConsumerConfig(t, "exchange", store)
+	config.stream.CommitEvery = 1
+
+	consumer := &StreamConsumer{config: config, tracker: newOffsetTracker(), committer: newOffsetCommitter(config.stream)}
+
+	var messages []*streamMessage
+	for offset := int64(1); offset <= 2; offset++ {
+		messages = append(messages, &streamMessage{
+			delivery:   amqp.Delivery{Acknowledger: &fakeAcknowledger{}},
+			consumer:   consumer,
+			offset:     offset,
+			generation: consumer.tracker.delivered(offset),
+			tracked:    true,
+		})
+	}
+
+	if err := messages[0].Requeue("try again"); !errors.Is(err, errStreamRequeue) {
+		t.Error("expected requeueing a stream message to fail, got", err)
+	}
+	assertNoError(t, messages[1].Ack())
+
+	if last, found := consumer.tracker.lastProcessed(); !found || last != 2 {
+		t.Error("expected the offset to move past the requeued message, got", last, found)
+	}
+
+	if len(store.stored) == 0 || store.stored[len(store.stored)-1] != 2 {
+		t.Error("expected the offset after the requeued message to be stored, got", store.stored)
+	}
+}
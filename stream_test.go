@@ -0,0 +1,104 @@
+package runamqp
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/run-amqp/helpers"
+)
+
+func newTestStreamConsumerConfig(t *testing.T, exchangeName string, store OffsetStore) StreamConsumerConfig {
+	c := NewStreamConsumerConfig{
+		URL:          testRabbitURI,
+		ExchangeName: exchangeName,
+		ExchangeType: Fanout,
+		Logger:       helpers.NewTestLogger(t),
+		ServiceName:  serviceName,
+		Prefetch:     defaultPrefetch,
+		Offset:       OffsetFirst,
+		OffsetStore:  store,
+		MaxAge:       "1h",
+	}
+	return c.Config()
+}
+
+func TestStreamConsumerNeedsAPrefetch(t *testing.T) {
+	config := newTestStreamConsumerConfig(t, "exchange", nil)
+	config.stream.PrefetchCount = 0
+
+	consumer, err := NewStreamConsumerContext(context.Background(), config)
+
+	if consumer != nil {
+		t.Error("did not expect a consumer")
+	}
+
+	assertSetupError(t, err, StepConsume)
+}
+
+func TestStreamConsumerWithAnInvalidTopologyFailsBeforeConnecting(t *testing.T) {
+	config := newTestStreamConsumerConfig(t, "exchange", nil)
+	config.URL = unreachableRabbitURI
+	config.exchange.Type = Unrecognised
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	consumer, err := NewStreamConsumerContext(ctx, config)
+
+	if consumer != nil {
+		t.Error("did not expect a consumer")
+	}
+
+	assertSetupError(t, err, StepDeclare)
+
+	if time.Since(start) > time.Second {
+		t.Error("expected the topology to fail without waiting to connect")
+	}
+}
+
+func TestStreamConsumerResumesFromTheStoredOffset(t *testing.T) {
+	t.Parallel()
+
+	store := NewFileOffsetStore(filepath.Join(t.TempDir(), "offsets.json"))
+	config := newTestStreamConsumerConfig(t, "test-stream-"+randomString(5), store)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	consumer, err := NewStreamConsumerContext(ctx, config)
+	assertNoError(t, err)
+
+	publisher, err := NewPublisherContext(ctx, config.NewPublisherConfig())
+	assertNoError(t, err)
+	defer publisher.Close()
+
+	assertNoError(t, publisher.Publish([]byte("first"), nil))
+	assertNoError(t, publisher.Publish([]byte("second"), nil))
+	assertNoError(t, publisher.Publish([]byte("third"), nil))
+
+	message := getMessage(t, consumer.Messages)
+	if string(message.Body()) != "first" {
+		t.Fatal("expected the first message, got", string(message.Body()))
+	}
+	assertNoError(t, message.Ack())
+
+	if !errors.Is(getMessage(t, consumer.Messages).Requeue("nope"), errStreamRequeue) {
+		t.Error("expected stream messages not to be requeued")
+	}
+
+	consumer.Close()
+
+	restarted, err := NewStreamConsumerContext(ctx, config)
+	assertNoError(t, err)
+	defer restarted.Close()
+
+	message = getMessage(t, restarted.Messages)
+	if string(message.Body()) != "third" {
+		t.Fatal("expected to resume after the processed and the skipped message, got", string(message.Body()))
+	}
+	assertNoError(t, message.Ack())
+}
@@ -0,0 +1,589 @@
+package runamqp
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/mergermarket/run-amqp/connection"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Topology lists the exchanges, queues and bindings a consumer or publisher declares, so they can be inspected, validated and compared with the broker before they are applied
+type Topology struct {
+	Exchanges []ExchangeDeclaration
+	Queues    []QueueDeclaration
+	Bindings  []BindingDeclaration
+}
+
+// ExchangeDeclaration is an exchange of a Topology
+type ExchangeDeclaration struct {
+	Name      string
+	Type      ExchangeType
+	Arguments amqp.Table
+	// External exchanges are declared by someone else, they are only checked to exist
+	External bool
+}
+
+// QueueDeclaration is a durable queue of a Topology
+type QueueDeclaration struct {
+	Name      string
+	Arguments amqp.Table
+}
+
+// BindingDeclaration binds a queue, or an exchange, to a source exchange
+type BindingDeclaration struct {
+	Source      string
+	Destination string
+	// ToExchange is true when the destination is an exchange rather than a queue
+	ToExchange bool
+	Pattern    string
+	Arguments  amqp.Table
+}
+
+// DifferenceKind is how the broker differs from a Topology
+type DifferenceKind string
+
+const (
+	// Missing exchanges or queues do not exist on the broker
+	Missing DifferenceKind = "missing"
+
+	// Conflicting exchanges or queues exist with a different type or arguments, declaring them fails with PRECONDITION_FAILED
+	Conflicting DifferenceKind = "conflicting"
+)
+
+// TopologyDifference is an exchange or queue of a Topology which is not on the broker as it is declared
+type TopologyDifference struct {
+	Kind DifferenceKind
+	// Entity is exchange or queue
+	Entity string
+	Name   string
+	// Reason is what the broker replied
+	Reason string
+}
+
+func (d TopologyDifference) String() string {
+	return fmt.Sprintf(`%s %s "%s": %s`, d.Kind, d.Entity, d.Name, d.Reason)
+}
+
+// merge returns the topology with the declarations of others added, leaving out the ones it already has
+func (t Topology) merge(others ...Topology) Topology {
+	for _, other := range others {
+		for _, e := range other.Exchanges {
+			if !containsDeclaration(t.Exchanges, e) {
+				t.Exchanges = append(t.Exchanges, e)
+			}
+		}
+		for _, q := range other.Queues {
+			if !containsDeclaration(t.Queues, q) {
+				t.Queues = append(t.Queues, q)
+			}
+		}
+		for _, b := range other.Bindings {
+			if !containsDeclaration(t.Bindings, b) {
+				t.Bindings = append(t.Bindings, b)
+			}
+		}
+	}
+	return t
+}
+
+func containsDeclaration[T any](declarations []T, declaration T) bool {
+	for _, d := range declarations {
+		if reflect.DeepEqual(d, declaration) {
+			return true
+		}
+	}
+	return false
+}
+
+// String lists the declarations of the topology, one per line
+func (t Topology) String() string {
+	var lines []string
+	for _, e := range t.Exchanges {
+		if e.External {
+			lines = append(lines, fmt.Sprintf(`exchange "%s" (external)`, e.Name))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(`exchange "%s" of type %s %v`, e.Name, e.Type, e.Arguments))
+	}
+	for _, q := range t.Queues {
+		lines = append(lines, fmt.Sprintf(`queue "%s" %v`, q.Name, q.Arguments))
+	}
+	for _, b := range t.Bindings {
+		lines = append(lines, fmt.Sprintf(`binding "%s" to "%s" with "%s" %v`, b.Destination, b.Source, b.Pattern, b.Arguments))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// maxNameLength is the most bytes AMQP allows in the name of an exchange or queue, and in a routing key
+const maxNameLength = 255
+
+// Validate checks the topology is complete and consistent without connecting to the broker, it returns all the problems it finds joined together
+func (t Topology) Validate() error {
+	var errs []error
+
+	exchanges := map[string]ExchangeDeclaration{}
+	for _, e := range t.Exchanges {
+		if e.Name == "" {
+			errs = append(errs, errors.New("an exchange has no name"))
+			continue
+		}
+		if len(e.Name) > maxNameLength {
+			errs = append(errs, fmt.Errorf(`the exchange name "%s" is longer than %d bytes`, e.Name, maxNameLength))
+		}
+		if !e.External && (e.Type == "" || e.Type == Unrecognised) {
+			errs = append(errs, fmt.Errorf(`the exchange "%s" has an unrecognised type "%s"`, e.Name, e.Type))
+		}
+		if err := e.Arguments.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf(`the arguments of the exchange "%s" are invalid: %v`, e.Name, err))
+		}
+		if previous, found := exchanges[e.Name]; found && !previous.External && !e.External && !reflect.DeepEqual(previous, e) {
+			errs = append(errs, fmt.Errorf(`the exchange "%s" is declared twice differently`, e.Name))
+		}
+		if previous, found := exchanges[e.Name]; !found || previous.External {
+			exchanges[e.Name] = e
+		}
+	}
+
+	queues := map[string]QueueDeclaration{}
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			errs = append(errs, errors.New("a queue has no name"))
+			continue
+		}
+		if len(q.Name) > maxNameLength {
+			errs = append(errs, fmt.Errorf(`the queue name "%s" is longer than %d bytes`, q.Name, maxNameLength))
+		}
+		if err := q.Arguments.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf(`the arguments of the queue "%s" are invalid: %v`, q.Name, err))
+		}
+		if previous, found := queues[q.Name]; found && !reflect.DeepEqual(previous, q) {
+			errs = append(errs, fmt.Errorf(`the queue "%s" is declared twice differently`, q.Name))
+		}
+		queues[q.Name] = q
+	}
+
+	for _, b := range t.Bindings {
+		if _, found := exchanges[b.Source]; !found {
+			errs = append(errs, fmt.Errorf(`"%s" is bound to the exchange "%s" which is not in the topology`, b.Destination, b.Source))
+		}
+		if _, found := exchanges[b.Destination]; b.ToExchange && !found {
+			errs = append(errs, fmt.Errorf(`the exchange "%s" is bound to "%s" but is not in the topology`, b.Destination, b.Source))
+		}
+		if _, found := queues[b.Destination]; !b.ToExchange && !found {
+			errs = append(errs, fmt.Errorf(`the queue "%s" is bound to "%s" but is not in the topology`, b.Destination, b.Source))
+		}
+		if len(b.Pattern) > maxNameLength {
+			errs = append(errs, fmt.Errorf(`the binding of "%s" to "%s" has a pattern longer than %d bytes`, b.Destination, b.Source, maxNameLength))
+		}
+		if err := b.Arguments.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf(`the arguments of the binding of "%s" to "%s" are invalid: %v`, b.Destination, b.Source, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Apply declares the exchanges, then the queues, then the bindings of the topology on ch. It returns a *SetupError for the first one that fails, after which rabbit has closed ch.
+func (t Topology) Apply(ch *amqp.Channel) error {
+	for _, e := range t.Exchanges {
+		if err := declareExchange(ch, e); err != nil {
+			return err
+		}
+	}
+
+	for _, q := range t.Queues {
+		if err := declareQueue(ch, q); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range t.Bindings {
+		var err error
+		if b.ToExchange {
+			err = ch.ExchangeBind(b.Destination, b.Pattern, b.Source, nowait, b.Arguments)
+		} else {
+			err = ch.QueueBind(b.Destination, b.Pattern, b.Source, nowait, b.Arguments)
+		}
+		if err != nil {
+			return newSetupError(StepBind, b.Destination, fmt.Errorf(`failed to bind to "%s": %w`, b.Source, err))
+		}
+	}
+
+	return nil
+}
+
+// TopologyMode is how a consumer or publisher makes sure its topology is on the broker
+type TopologyMode string
+
+const (
+	// DeclareTopology declares the topology, creating whatever is missing, it is the default
+	DeclareTopology TopologyMode = "declare"
+
+	// VerifyTopology checks the exchanges and queues exist as they are declared, for brokers provisioned by someone else, and fails with every difference it finds. Their type and arguments are compared by declaring them again, which changes nothing when they match. Without the configure permission that is refused, so only their existence is checked. Bindings can not be checked so they are left as they are.
+	VerifyTopology TopologyMode = "verify"
+
+	// SkipTopology leaves the broker as it is and starts straight away
+	SkipTopology TopologyMode = "skip"
+)
+
+// applyWith makes sure the topology is on the broker as mode says. Verifying opens channels of its own on the connection of channels, as rabbit closes the channel of a check that fails.
+func (t Topology) applyWith(ch *amqp.Channel, mode TopologyMode, channels connection.ConnectionManager) error {
+	switch mode {
+	case "", DeclareTopology:
+		return t.Apply(ch)
+	case VerifyTopology:
+		pool := channels.NewChannelPool("verifying the topology", 1, nil)
+		defer pool.Close()
+		return t.verify(pool.Get, pool.Put)
+	case SkipTopology:
+		return nil
+	default:
+		return &SetupError{Step: StepDeclare, Err: fmt.Errorf("unrecognised topology mode %s", mode)}
+	}
+}
+
+// Verify checks the exchanges and queues of the topology are on the broker as declared, see VerifyTopology. It returns a *SetupError with every difference found joined together.
+func (t Topology) Verify(conn *amqp.Connection) error {
+	return t.verify(conn.Channel, func(ch *amqp.Channel) { ch.Close() })
+}
+
+func (t Topology) verify(open func() (*amqp.Channel, error), done func(*amqp.Channel)) error {
+	differences, err := t.diff(open, done)
+	if err != nil {
+		return newSetupError(StepDeclare, "", fmt.Errorf("failed to verify the topology: %w", err))
+	}
+	return verificationError(differences)
+}
+
+// verificationError joins the differences found verifying a topology together, or returns nil when there are none
+func verificationError(differences []TopologyDifference) error {
+	if len(differences) == 0 {
+		return nil
+	}
+
+	errs := make([]error, len(differences))
+	for i, d := range differences {
+		if d.Kind == Missing {
+			errs[i] = fmt.Errorf("%s, it has to be provisioned on the broker before it is used", d)
+		} else {
+			errs[i] = fmt.Errorf("%s, it has to be provisioned as it is declared", d)
+		}
+	}
+
+	return &SetupError{Step: StepDeclare, Err: errors.Join(errs...)}
+}
+
+// Diff compares the exchanges and queues of the topology with the broker, opening a channel for every check as rabbit closes the channel of a check that fails. Existing exchanges and queues are declared again, which changes nothing when they are as declared and fails with PRECONDITION_FAILED when they are not. Without the configure permission they are only checked to exist. Bindings can not be inspected over AMQP, so they are not compared.
+func (t Topology) Diff(conn *amqp.Connection) ([]TopologyDifference, error) {
+	return t.diff(conn.Channel, func(ch *amqp.Channel) { ch.Close() })
+}
+
+func (t Topology) diff(open func() (*amqp.Channel, error), done func(*amqp.Channel)) ([]TopologyDifference, error) {
+	var differences []TopologyDifference
+
+	check := func(entity, name string, passive, declare func(*amqp.Channel) error) error {
+		for i, step := range []func(*amqp.Channel) error{passive, declare} {
+			if step == nil {
+				return nil
+			}
+
+			ch, err := open()
+			if err != nil {
+				return err
+			}
+
+			err = step(ch)
+			done(ch)
+
+			var amqpErr *amqp.Error
+			switch {
+			case err == nil:
+				continue
+			case errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound:
+				differences = append(differences, TopologyDifference{Kind: Missing, Entity: entity, Name: name, Reason: amqpErr.Reason})
+			case errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed:
+				differences = append(differences, TopologyDifference{Kind: Conflicting, Entity: entity, Name: name, Reason: amqpErr.Reason})
+			case errors.As(err, &amqpErr) && amqpErr.Code == amqp.AccessRefused && i > 0:
+				// it exists, but can not be compared without the configure permission
+			default:
+				return err
+			}
+			return nil
+		}
+		return nil
+	}
+
+	for _, e := range t.Exchanges {
+		e := e
+		passive := func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclarePassive(e.Name, string(e.Type), durable, autoDelete, internal, nowait, nil)
+		}
+		var declare func(*amqp.Channel) error
+		if !e.External {
+			declare = func(ch *amqp.Channel) error {
+				return ch.ExchangeDeclare(e.Name, string(e.Type), durable, autoDelete, internal, nowait, e.Arguments)
+			}
+		}
+		if err := check("exchange", e.Name, passive, declare); err != nil {
+			return differences, err
+		}
+	}
+
+	for _, q := range t.Queues {
+		q := q
+		passive := func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclarePassive(q.Name, durable, autoDelete, false, nowait, nil)
+			return err
+		}
+		declare := func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclare(q.Name, durable, autoDelete, false, nowait, q.Arguments)
+			return err
+		}
+		if err := check("queue", q.Name, passive, declare); err != nil {
+			return differences, err
+		}
+	}
+
+	return differences, nil
+}
+
+// validTopology checks the topology made from a config before anything is declared, so misconfiguration fails straight away
+func validTopology(t Topology, err error) error {
+	if err != nil {
+		return err
+	}
+	if err := t.Validate(); err != nil {
+		return &SetupError{Step: StepDeclare, Err: err}
+	}
+	return nil
+}
+
+func declareExchange(ch *amqp.Channel, e ExchangeDeclaration) error {
+	if e.External {
+		err := ch.ExchangeDeclarePassive(e.Name, string(e.Type), durable, autoDelete, internal, nowait, nil)
+		return newSetupError(StepDeclare, e.Name, err)
+	}
+	return makeExchange(ch, e.Name, e.Type, e.Arguments)
+}
+
+func declareQueue(ch *amqp.Channel, q QueueDeclaration) error {
+	_, err := ch.QueueDeclare(
+		q.Name,      // name
+		durable,     // durable
+		autoDelete,  // delete when usused
+		false,       // exclusive
+		nowait,      // no-wait
+		q.Arguments, // arguments
+	)
+	return newSetupError(StepDeclare, q.Name, err)
+}
+
+// queueBindings binds queueName to exchangeName with each of the patterns
+func queueBindings(queueName, exchangeName string, patterns []string) []BindingDeclaration {
+	bindings := make([]BindingDeclaration, 0, len(patterns))
+	for _, pattern := range patterns {
+		bindings = append(bindings, BindingDeclaration{Source: exchangeName, Destination: queueName, Pattern: pattern})
+	}
+	return bindings
+}
+
+// topology is the exchange with its alternate exchange and its bindings to other exchanges
+func (e exchange) topology() (Topology, error) {
+	arguments := amqp.Table{}
+	for key, value := range e.Arguments {
+		arguments[key] = value
+	}
+
+	var t Topology
+
+	if e.AlternateExchange != "" {
+		arguments["alternate-exchange"] = e.AlternateExchange
+		t.Exchanges = append(t.Exchanges, ExchangeDeclaration{Name: e.AlternateExchange, Type: Fanout})
+		t.Queues = append(t.Queues, QueueDeclaration{Name: e.AlternateExchange})
+		t.Bindings = append(t.Bindings, queueBindings(e.AlternateExchange, e.AlternateExchange, []string{matchAllPattern})...)
+	}
+
+	if len(arguments) == 0 {
+		arguments = nil
+	}
+
+	t.Exchanges = append(t.Exchanges, ExchangeDeclaration{Name: e.Name, Type: e.Type, Arguments: arguments})
+
+	for _, binding := range e.Bindings {
+		source, destination, other, err := binding.ends(e.Name)
+		if err != nil {
+			return Topology{}, newSetupError(StepBind, e.Name, err)
+		}
+
+		t.Exchanges = append(t.Exchanges, ExchangeDeclaration{Name: other, Type: binding.Type, External: binding.Type == ""})
+
+		patterns := binding.Patterns
+		if len(patterns) == 0 {
+			patterns = []string{matchAllPattern}
+		}
+
+		for _, pattern := range patterns {
+			t.Bindings = append(t.Bindings, BindingDeclaration{Source: source, Destination: destination, ToExchange: true, Pattern: pattern, Arguments: amqp.Table(binding.Arguments)})
+		}
+	}
+
+	return t, nil
+}
+
+// Topology returns everything the publisher declares, its exchange and the exchange delayed messages are published to. The queues of DelayQueues are declared for each delay when it is first used.
+func (c PublisherConfig) Topology() (Topology, error) {
+	t, err := c.exchange.topology()
+	if err != nil {
+		return Topology{}, err
+	}
+
+	delay, err := c.delayTopology()
+	if err != nil {
+		return Topology{}, err
+	}
+
+	return t.merge(delay), nil
+}
+
+// Topology returns everything the consumer declares, its exchange with the main queue, the DLE with the DLQ and the retry exchanges with the retry queue. An ephemeral consumer only declares its exchange, as its queue is made for each instance. A sharded consumer declares the queue and retries of every partition instead of the main queue, each bound with its weight.
+func (c ConsumerConfig) Topology() (Topology, error) {
+	if c.partitions.Count > 0 {
+		return c.partitionsTopology()
+	}
+
+	main, err := c.mainTopology()
+	if err != nil {
+		return Topology{}, err
+	}
+
+	if c.queue.Ephemeral {
+		return main.without(c.queue.Name), nil
+	}
+
+	deadLetter, err := c.deadLetterTopology()
+	if err != nil {
+		return Topology{}, err
+	}
+
+	retry, err := c.retryTopology()
+	if err != nil {
+		return Topology{}, err
+	}
+
+	return main.merge(deadLetter, retry), nil
+}
+
+// partitionsTopology is the topology of every partition, claimed or not, so the consistent hash exchange spreads the messages over all of them whichever instances are running
+func (c ConsumerConfig) partitionsTopology() (Topology, error) {
+	var t Topology
+	for partition := 0; partition < c.partitions.Count; partition++ {
+		partitionTopology, err := c.partitionConfig(partition).Topology()
+		if err != nil {
+			return Topology{}, err
+		}
+		t = t.merge(partitionTopology)
+	}
+	return t, nil
+}
+
+// without returns the topology without the queue and its bindings
+func (t Topology) without(queue string) Topology {
+	var rest Topology
+	rest.Exchanges = t.Exchanges
+	for _, q := range t.Queues {
+		if q.Name != queue {
+			rest.Queues = append(rest.Queues, q)
+		}
+	}
+	for _, b := range t.Bindings {
+		if b.ToExchange || b.Destination != queue {
+			rest.Bindings = append(rest.Bindings, b)
+		}
+	}
+	return rest
+}
+
+func (c ConsumerConfig) mainTopology() (Topology, error) {
+	t, err := c.exchange.topology()
+	if err != nil {
+		return Topology{}, err
+	}
+
+	args, err := c.mainQueueArguments()
+	if err != nil {
+		return Topology{}, newSetupError(StepDeclare, c.queue.Name, err)
+	}
+
+	t.Queues = append(t.Queues, QueueDeclaration{Name: c.queue.Name, Arguments: args})
+
+	switch {
+	case c.exchange.Type == Headers:
+		bindings := c.queue.HeaderBindings
+		if len(bindings) == 0 {
+			bindings = []HeaderBinding{{}}
+		}
+
+		for _, binding := range bindings {
+			bindingArgs, err := binding.arguments()
+			if err != nil {
+				return Topology{}, newSetupError(StepBind, c.queue.Name, err)
+			}
+			t.Bindings = append(t.Bindings, BindingDeclaration{Source: c.exchange.Name, Destination: c.queue.Name, Arguments: bindingArgs})
+		}
+	case len(c.queue.HeaderBindings) > 0:
+		return Topology{}, newSetupError(StepBind, c.queue.Name, fmt.Errorf(`header bindings need a headers exchange but "%s" is %s`, c.exchange.Name, c.exchange.Type))
+	default:
+		t.Bindings = append(t.Bindings, queueBindings(c.queue.Name, c.exchange.Name, c.queue.Patterns)...)
+	}
+
+	return t, nil
+}
+
+func (c ConsumerConfig) deadLetterTopology() (Topology, error) {
+	args, err := c.deadLetterQueueArguments()
+	if err != nil {
+		return Topology{}, newSetupError(StepDeclare, c.queue.DLQ, err)
+	}
+
+	return Topology{
+		Exchanges: []ExchangeDeclaration{{Name: c.exchange.DLE, Type: c.exchange.deadLetterType()}},
+		Queues:    []QueueDeclaration{{Name: c.queue.DLQ, Arguments: args}},
+		Bindings:  queueBindings(c.queue.DLQ, c.exchange.DLE, []string{matchAllPattern}),
+	}, nil
+}
+
+// retryTopology is the retry later exchange routing to the retry queue, whose messages are dead-lettered to the retry now exchange once their TTL is up, which routes them back to the main queue
+func (c ConsumerConfig) retryTopology() (Topology, error) {
+	args, err := c.retryQueueArguments()
+	if err != nil {
+		return Topology{}, newSetupError(StepDeclare, c.queue.RetryLater, err)
+	}
+
+	return Topology{
+		Exchanges: []ExchangeDeclaration{
+			{Name: c.exchange.RetryNow, Type: c.exchange.deadLetterType()},
+			{Name: c.exchange.RetryLater, Type: c.exchange.deadLetterType()},
+		},
+		Queues: []QueueDeclaration{{Name: c.queue.RetryLater, Arguments: args}},
+		Bindings: append(
+			queueBindings(c.queue.RetryLater, c.exchange.RetryLater, []string{matchAllPattern}),
+			queueBindings(c.queue.Name, c.exchange.RetryNow, []string{matchAllPattern})...,
+		),
+	}, nil
+}
+
+// Topology returns everything the stream consumer declares
+func (c StreamConsumerConfig) Topology() (Topology, error) {
+	t, err := c.exchange.topology()
+	if err != nil {
+		return Topology{}, err
+	}
+
+	t.Queues = append(t.Queues, QueueDeclaration{Name: c.stream.Name, Arguments: c.streamArguments()})
+	t.Bindings = append(t.Bindings, queueBindings(c.stream.Name, c.exchange.Name, c.stream.Patterns)...)
+
+	return t, nil
+}
@@ -0,0 +1,223 @@
+package runamqp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/run-amqp/helpers"
+)
+
+func TestConsumerTopology(t *testing.T) {
+	config := newQueueTestConfig(t, NewConsumerConfig{
+		Patterns:          []string{"a.*", "b.#"},
+		AlternateExchange: "unroutable",
+		ExchangeBindings:  []ExchangeBinding{{Source: "upstream"}},
+	})
+
+	topology, err := config.Topology()
+	assertNoError(t, err)
+	assertNoError(t, topology.Validate())
+
+	exchanges := map[string]ExchangeDeclaration{}
+	for _, e := range topology.Exchanges {
+		exchanges[e.Name] = e
+	}
+
+	for _, name := range []string{"exchange", "unroutable", "upstream", config.exchange.DLE, config.exchange.RetryNow, config.exchange.RetryLater} {
+		if _, found := exchanges[name]; !found {
+			t.Error("expected the exchange", name, "in the topology")
+		}
+	}
+
+	if exchanges["exchange"].Arguments["alternate-exchange"] != "unroutable" {
+		t.Error("expected the exchange to have its alternate exchange", exchanges["exchange"])
+	}
+
+	if !exchanges["upstream"].External {
+		t.Error("expected the source exchange without a type to be external")
+	}
+
+	if len(topology.Queues) != 4 {
+		t.Error("expected the main queue, the DLQ, the retry queue and the queue of the alternate exchange", topology.Queues)
+	}
+
+	bound := map[string]bool{}
+	for _, b := range topology.Bindings {
+		bound[b.Destination+"<-"+b.Source+":"+b.Pattern] = true
+	}
+
+	for _, binding := range []string{
+		config.queue.Name + "<-exchange:a.*",
+		config.queue.Name + "<-exchange:b.#",
+		config.queue.Name + "<-" + config.exchange.RetryNow + ":#",
+		config.queue.DLQ + "<-" + config.exchange.DLE + ":#",
+		config.queue.RetryLater + "<-" + config.exchange.RetryLater + ":#",
+		"exchange<-upstream:#",
+	} {
+		if !bound[binding] {
+			t.Error("expected the binding", binding, "in", topology)
+		}
+	}
+}
+
+func TestTopologyValidate(t *testing.T) {
+	topology := Topology{
+		Exchanges: []ExchangeDeclaration{
+			{Name: "exchange", Type: Topic},
+			{Name: "exchange", Type: Fanout},
+			{Name: "untyped"},
+		},
+		Queues: []QueueDeclaration{{Name: ""}},
+		Bindings: []BindingDeclaration{
+			{Source: "missing", Destination: "queue"},
+		},
+	}
+
+	err := topology.Validate()
+
+	if err == nil {
+		t.Fatal("expected the topology to be invalid")
+	}
+
+	for _, problem := range []string{
+		`"exchange" is declared twice differently`,
+		`"untyped" has an unrecognised type`,
+		"a queue has no name",
+		`exchange "missing" which is not in the topology`,
+		`the queue "queue" is bound`,
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Error("expected the problem", problem, "in", err)
+		}
+	}
+}
+
+func TestTopologyMergeLeavesOutDuplicates(t *testing.T) {
+	a := Topology{Exchanges: []ExchangeDeclaration{{Name: "exchange", Type: Topic}}}
+	b := Topology{Exchanges: []ExchangeDeclaration{{Name: "exchange", Type: Topic}, {Name: "other", Type: Topic}}}
+
+	if merged := a.merge(b); len(merged.Exchanges) != 2 {
+		t.Error("expected the duplicate exchange to be left out", merged)
+	}
+}
+
+func TestInvalidTopologyFailsBeforeConnecting(t *testing.T) {
+	c := NewPublisherConfig{
+		URL:              unreachableRabbitURI,
+		ExchangeName:     "exchange",
+		ExchangeType:     Unrecognised,
+		Logger:           helpers.NewTestLogger(t),
+		ExchangeBindings: []ExchangeBinding{{}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := NewPublisherContext(ctx, c.Config())
+
+	assertSetupError(t, err, StepBind)
+
+	if time.Since(start) > time.Second {
+		t.Error("expected the topology to fail without waiting to connect")
+	}
+}
+
+func TestDiffTopologyFindsMissingAndConflictingQueues(t *testing.T) {
+	t.Parallel()
+
+	config := newTestConsumerConfig(t, consumerConfigOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientConfig := NewClientConfig{URL: testRabbitURI, Logger: helpers.NewTestLogger(t)}
+	client := NewClient(clientConfig.Config())
+	defer client.Close()
+
+	topology, err := config.Topology()
+	assertNoError(t, err)
+
+	differences, err := client.DiffTopology(ctx, topology)
+	assertNoError(t, err)
+
+	if len(differences) == 0 || differences[0].Kind != Missing {
+		t.Fatal("expected the topology to be missing", differences)
+	}
+
+	assertNoError(t, client.ApplyTopology(ctx, topology))
+
+	config.queue.MaxPriority = 9
+	changed, err := config.Topology()
+	assertNoError(t, err)
+
+	differences, err = client.DiffTopology(ctx, changed)
+	assertNoError(t, err)
+
+	if len(differences) != 1 || differences[0].Kind != Conflicting || differences[0].Name != config.queue.Name {
+		t.Error("expected the main queue to conflict", differences)
+	}
+}
+
+func TestSkipTopologyLeavesTheBrokerAlone(t *testing.T) {
+	topology := Topology{Exchanges: []ExchangeDeclaration{{Name: "exchange", Type: Topic}}}
+
+	// a nil channel would panic if anything was declared on it
+	assertNoError(t, topology.applyWith(nil, SkipTopology, nil))
+}
+
+func TestUnrecognisedTopologyModeFailsToDeclare(t *testing.T) {
+	err := Topology{}.applyWith(nil, TopologyMode("create"), nil)
+
+	assertSetupError(t, err, StepDeclare)
+}
+
+func TestVerificationErrorReportsEveryDifference(t *testing.T) {
+	assertNoError(t, verificationError(nil))
+
+	err := verificationError([]TopologyDifference{
+		{Kind: Missing, Entity: "exchange", Name: "orders", Reason: "NOT_FOUND - no exchange 'orders'"},
+		{Kind: Conflicting, Entity: "queue", Name: "orders-for-billing", Reason: "PRECONDITION_FAILED - inequivalent arg 'x-queue-type'"},
+	})
+	assertSetupError(t, err, StepDeclare)
+
+	for _, expected := range []string{`missing exchange "orders"`, "has to be provisioned on the broker", `conflicting queue "orders-for-billing"`, "x-queue-type"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected the error to contain %q but got %v", expected, err)
+		}
+	}
+}
+
+func TestVerifyTopologyReportsWhatIsMissing(t *testing.T) {
+	t.Parallel()
+
+	config := newTestConsumerConfig(t, consumerConfigOptions{})
+	config.topologyMode = VerifyTopology
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := NewConsumerContext(ctx, config)
+	assertSetupError(t, err, StepDeclare)
+
+	// both the missing exchange and the queue bound to it are reported, not only the first
+	for _, name := range []string{config.exchange.Name, config.queue.Name} {
+		if !strings.Contains(err.Error(), name) {
+			t.Error("expected the error to name", name, err)
+		}
+	}
+
+	clientConfig := NewClientConfig{URL: testRabbitURI, Logger: helpers.NewTestLogger(t)}
+	client := NewClient(clientConfig.Config())
+	defer client.Close()
+
+	topology, err := config.Topology()
+	assertNoError(t, err)
+	assertNoError(t, client.ApplyTopology(ctx, topology))
+
+	consumer, err := NewConsumerContext(ctx, config)
+	assertNoError(t, err)
+	consumer.Close()
+}